@@ -8,14 +8,19 @@ import (
 	"github.com/avast/retry-go/v4"
 	"github.com/breml/rootcerts/embedded"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/localcache"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/network"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/signalfilter"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/steplogs"
 	"github.com/cirruslabs/cirrus-ci-agent/pkg/grpchelper"
+	"github.com/dustin/go-humanize"
 	"github.com/getsentry/sentry-go"
 	"github.com/grpc-ecosystem/go-grpc-middleware/retry"
 	goversion "github.com/hashicorp/go-version"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -40,6 +45,8 @@ var (
 	commit  = "unknown"
 )
 
+var logger = agentlog.WithSubsystem("agent")
+
 func fullVersion() string {
 	var versionToNormalize string
 
@@ -81,6 +88,21 @@ func main() {
 	commandToPtr := flag.String("command-to", "", "Command to stop execution at (exclusive)")
 	preCreatedWorkingDir := flag.String("pre-created-working-dir", "",
 		"working directory to use when spawned via Persistent Worker")
+	logFormat := flag.String("log-format", envOrDefault("CIRRUS_AGENT_LOG_FORMAT", agentlog.FormatText),
+		"agent log format, either \"text\" or \"json\" (can also be set via CIRRUS_AGENT_LOG_FORMAT)")
+	logLevel := flag.String("log-level", envOrDefault("CIRRUS_AGENT_LOG_LEVEL", logrus.InfoLevel.String()),
+		"minimum level of agent log entries (can also be set via CIRRUS_AGENT_LOG_LEVEL)")
+	stepLogsDir := flag.String("step-logs-dir", envOrDefault("CIRRUS_AGENT_STEP_LOGS_DIR", ""),
+		"additionally store each step's output in <dir>/<task ID>/<command name>.log "+
+			"(can also be set via CIRRUS_AGENT_STEP_LOGS_DIR)")
+	stepLogsRetention := flag.String("step-logs-retention", envOrDefault("CIRRUS_AGENT_STEP_LOGS_RETENTION", "168h"),
+		"remove the step logs of other tasks that are older than this, zero disables the removal "+
+			"(can also be set via CIRRUS_AGENT_STEP_LOGS_RETENTION)")
+	localCacheDir := flag.String("local-cache-dir", envOrDefault("CIRRUS_AGENT_LOCAL_CACHE_DIR", ""),
+		"keep the HTTP cache entries in this directory and serve them locally when they're still valid "+
+			"(can also be set via CIRRUS_AGENT_LOCAL_CACHE_DIR)")
+	localCacheSize := flag.String("local-cache-size", envOrDefault("CIRRUS_AGENT_LOCAL_CACHE_SIZE", "10GB"),
+		"maximum size of the local cache directory (can also be set via CIRRUS_AGENT_LOCAL_CACHE_SIZE)")
 	flag.Parse()
 
 	// Initialize Sentry
@@ -102,7 +124,7 @@ func main() {
 	// Parse task ID as an integer for backwards-compatibility with the TaskIdentification message
 	oldStyleTaskID, err := strconv.ParseInt(*taskIdPtr, 10, 64)
 	if err != nil {
-		log.Printf("Failed to parse task ID %q as an integer (%v), assuming that "+
+		logger.Warnf("Failed to parse task ID %q as an integer (%v), assuming that "+
 			"the new format of task IDs is in play", *taskIdPtr, err)
 		oldStyleTaskID = 0
 	}
@@ -130,23 +152,33 @@ func main() {
 	}
 	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0660)
 	if err != nil {
-		log.Printf("Failed to create log file: %v", err)
+		logger.Warnf("Failed to create log file: %v", err)
 	} else {
 		defer func() {
 			logFilePos, err := logFile.Seek(0, io.SeekCurrent)
 			if err != nil {
-				log.Printf("Failed to determine the final log file size: %v", err)
+				logger.Warnf("Failed to determine the final log file size: %v", err)
 			}
 
-			log.Printf("Finalizing log file, %d bytes written", logFilePos)
+			logger.Infof("Finalizing log file, %d bytes written", logFilePos)
 
 			_ = logFile.Close()
 			uploadAgentLogs(context.Background(), logFilePath, oldStyleTaskID, *clientTokenPtr)
 		}()
 	}
 	multiWriter := io.MultiWriter(logFile, os.Stdout)
-	log.SetOutput(multiWriter)
-	grpclog.SetLoggerV2(grpclog.NewLoggerV2(multiWriter, multiWriter, multiWriter))
+	if err := agentlog.Configure(multiWriter, *logFormat, *logLevel); err != nil {
+		log.Fatalf("failed to configure the agent logger: %v", err)
+	}
+	agentlog.SetTaskID(*taskIdPtr)
+
+	// Route the output of the standard library's logger and
+	// the gRPC's logger through the agent-wide logger too
+	log.SetFlags(0)
+	log.SetOutput(logger.WriterLevel(logrus.InfoLevel))
+	grpcLogger := agentlog.WithSubsystem("grpc")
+	grpclog.SetLoggerV2(grpclog.NewLoggerV2(grpcLogger.WriterLevel(logrus.InfoLevel),
+		grpcLogger.WriterLevel(logrus.WarnLevel), grpcLogger.WriterLevel(logrus.ErrorLevel)))
 
 	// Handle panics
 	defer func() {
@@ -160,9 +192,9 @@ func main() {
 		hub.Recover(err)
 
 		// Report exception to log file
-		log.Printf("Recovered an error: %v", err)
+		logger.Errorf("Recovered an error: %v", err)
 		stack := string(debug.Stack())
-		log.Println(stack)
+		logger.Error(stack)
 
 		// Report exception to Cirrus CI
 		if client.CirrusClient == nil {
@@ -179,7 +211,7 @@ func main() {
 		}
 		_, err = client.CirrusClient.ReportAgentError(context.Background(), request)
 		if err != nil {
-			log.Printf("Failed to report agent error: %v\n", err)
+			logger.Warnf("Failed to report agent error: %v", err)
 		}
 	}()
 
@@ -195,7 +227,7 @@ func main() {
 
 	var conn *grpc.ClientConn
 
-	log.Printf("Running agent version %s", fullVersion())
+	logger.Infof("Running agent version %s", fullVersion())
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -216,7 +248,7 @@ func main() {
 				continue
 			}
 
-			log.Printf("Captured %v...", sig)
+			logger.Infof("Captured %v...", sig)
 
 			reportSignal(context.Background(), sig, oldStyleTaskID, *clientTokenPtr)
 		}
@@ -233,7 +265,7 @@ func main() {
 			conn, err = dialWithTimeout(ctx, *apiEndpointPtr, md)
 			return err
 		}, retry.OnRetry(func(n uint, err error) {
-			log.Printf("Failed to open a connection: %v\n", err)
+			logger.Warnf("Failed to open a connection: %v", err)
 		}),
 		retry.Delay(1*time.Second), retry.MaxDelay(1*time.Second),
 		retry.Attempts(0), retry.LastErrorOnly(true),
@@ -244,12 +276,12 @@ func main() {
 		return
 	}
 
-	log.Printf("Connected!\n")
+	logger.Info("Connected!")
 
 	client.InitClient(conn)
 
 	if *stopHook {
-		log.Printf("Stop hook!\n")
+		logger.Info("Stop hook!")
 		taskIdentification := api.TaskIdentification{
 			TaskId: oldStyleTaskID,
 			Secret: *clientTokenPtr,
@@ -259,7 +291,7 @@ func main() {
 		}
 		_, err = client.CirrusClient.ReportStopHook(ctx, &request)
 		if err != nil {
-			log.Printf("Failed to report stop hook for task %s: %v\n", *taskIdPtr, err)
+			logger.Warnf("Failed to report stop hook for task %s: %v", *taskIdPtr, err)
 		} else {
 			logFile.Close()
 			os.Remove(logFilePath)
@@ -276,7 +308,7 @@ func main() {
 				continue
 			}
 
-			log.Printf("Waiting on port %v...\n", port)
+			logger.Infof("Waiting on port %v...", port)
 
 			subCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
 			network.WaitForLocalPort(subCtx, portNumber)
@@ -286,8 +318,39 @@ func main() {
 
 	go runHeartbeat(oldStyleTaskID, *clientTokenPtr, conn)
 
+	var executorOpts []executor.Option
+
+	if *stepLogsDir != "" {
+		retention, err := time.ParseDuration(*stepLogsRetention)
+		if err != nil {
+			logger.Warnf("Failed to parse step logs retention %q, not removing the step logs of other tasks: %v",
+				*stepLogsRetention, err)
+			retention = 0
+		}
+
+		stepLogs, err := steplogs.New(*stepLogsDir, *taskIdPtr, retention)
+		if err != nil {
+			logger.Warnf("Failed to initialize step logs: %v", err)
+		} else {
+			logger.Infof("Storing step logs in %s", stepLogs.Dir())
+			executorOpts = append(executorOpts, executor.WithStepLogs(stepLogs))
+		}
+	}
+
+	if *localCacheDir != "" {
+		maxBytes, err := humanize.ParseBytes(*localCacheSize)
+		if err != nil {
+			logger.Warnf("Failed to parse local cache size %q: %v", *localCacheSize, err)
+		} else if localCache, err := localcache.New(*localCacheDir, int64(maxBytes)); err != nil {
+			logger.Warnf("Failed to initialize local cache: %v", err)
+		} else {
+			logger.Infof("Using local cache in %s (up to %s)", localCache.Dir(), humanize.Bytes(maxBytes))
+			executorOpts = append(executorOpts, executor.WithLocalCache(localCache))
+		}
+	}
+
 	buildExecutor := executor.NewExecutor(oldStyleTaskID, *clientTokenPtr, *serverTokenPtr, *commandFromPtr, *commandToPtr,
-		*preCreatedWorkingDir)
+		*preCreatedWorkingDir, executorOpts...)
 	buildExecutor.RunBuild(ctx)
 }
 
@@ -330,6 +393,14 @@ func reportSignal(ctx context.Context, sig os.Signal, taskId int64, clientToken
 	_, _ = client.CirrusClient.ReportAgentSignal(ctx, &request)
 }
 
+func envOrDefault(key string, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+
+	return defaultValue
+}
+
 func dialWithTimeout(ctx context.Context, apiEndpoint string, md metadata.MD) (*grpc.ClientConn, error) {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer cancel()
@@ -383,17 +454,17 @@ func runHeartbeat(taskId int64, clientToken string, conn *grpc.ClientConn) {
 		Secret: clientToken,
 	}
 	for {
-		log.Println("Sending heartbeat...")
+		logger.Info("Sending heartbeat...")
 		_, err := client.CirrusClient.Heartbeat(context.Background(), &api.HeartbeatRequest{TaskIdentification: &taskIdentification})
 		if err != nil {
-			log.Printf("Failed to send heartbeat: %v", err)
+			logger.Warnf("Failed to send heartbeat: %v", err)
 			connectionState := conn.GetState()
-			log.Printf("Connection state: %v", connectionState.String())
+			logger.Infof("Connection state: %v", connectionState.String())
 			if connectionState == connectivity.TransientFailure {
 				conn.ResetConnectBackoff()
 			}
 		} else {
-			log.Printf("Sent heartbeat!")
+			logger.Info("Sent heartbeat!")
 		}
 		time.Sleep(60 * time.Second)
 	}
@@ -0,0 +1,100 @@
+package agentlog
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	FieldTaskID    = "task_id"
+	FieldCommand   = "command"
+	FieldSubsystem = "subsystem"
+)
+
+var (
+	logger     = logrus.New()
+	globalHook = &fieldsHook{fields: logrus.Fields{}}
+)
+
+func init() {
+	logger.AddHook(globalHook)
+}
+
+// Configure sets up the agent-wide logger to write entries of at least
+// the specified level to the output in a specified format.
+func Configure(output io.Writer, format string, level string) error {
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		logger.SetFormatter(&logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		})
+	case FormatJSON:
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format %q, expected either %q or %q", format, FormatText, FormatJSON)
+	}
+
+	if level == "" {
+		level = logrus.InfoLevel.String()
+	}
+
+	parsedLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logger.SetLevel(parsedLevel)
+	logger.SetOutput(output)
+
+	return nil
+}
+
+// SetTaskID makes all subsequent log entries carry the task ID.
+func SetTaskID(taskID string) {
+	globalHook.mtx.Lock()
+	defer globalHook.mtx.Unlock()
+
+	globalHook.fields[FieldTaskID] = taskID
+}
+
+// Logger returns the agent-wide logger.
+func Logger() *logrus.Logger {
+	return logger
+}
+
+// WithSubsystem returns a logger entry that tags all the
+// log entries produced through it with a subsystem name.
+func WithSubsystem(name string) *logrus.Entry {
+	return logger.WithField(FieldSubsystem, name)
+}
+
+// fieldsHook adds the fields that are only known after
+// the package-level loggers were created (e.g. task ID).
+type fieldsHook struct {
+	fields logrus.Fields
+	mtx    sync.RWMutex
+}
+
+func (hook *fieldsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *fieldsHook) Fire(entry *logrus.Entry) error {
+	hook.mtx.RLock()
+	defer hook.mtx.RUnlock()
+
+	for key, value := range hook.fields {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package agentlog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, agentlog.Configure(&buf, agentlog.FormatJSON, "info"))
+	agentlog.SetTaskID("42")
+
+	agentlog.WithSubsystem("executor").WithField(agentlog.FieldCommand, "main").Info("Executing main...")
+	agentlog.WithSubsystem("executor").Debug("should be filtered out")
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+
+	require.Equal(t, "info", entry["level"])
+	require.Equal(t, "Executing main...", entry["msg"])
+	require.Equal(t, "42", entry[agentlog.FieldTaskID])
+	require.Equal(t, "executor", entry[agentlog.FieldSubsystem])
+	require.Equal(t, "main", entry[agentlog.FieldCommand])
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	require.Error(t, agentlog.Configure(&bytes.Buffer{}, "xml", "info"))
+}
@@ -0,0 +1,144 @@
+// Package cachecrypt implements the authenticated encryption of the cache entries.
+//
+// The plaintext is split into segments that are sealed independently using AES-256-GCM
+// with a key derived from the secret and a random per-entry salt, which allows both
+// encrypting and decrypting the entries in a streaming fashion. Each segment's nonce
+// includes its index and whether it's the last one, so reordered, duplicated and
+// truncated segments are detected too.
+package cachecrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magic = "cirrus-encrypted-cache-v1\n"
+
+	saltSize     = 16
+	keyCheckSize = 16
+	headerSize   = len(magic) + saltSize + keyCheckSize
+
+	segmentSize          = 64 * 1024
+	tagSize              = 16
+	sealedSegmentSize    = segmentSize + tagSize
+	minimumSecretLength  = 16
+	nonceLastSegmentFlag = 1
+)
+
+var (
+	ErrKeyMismatch  = errors.New("cache entry was encrypted with a different key")
+	ErrNotEncrypted = errors.New("cache entry is not encrypted")
+	ErrCorrupted    = errors.New("cache entry was tampered with or is truncated")
+	ErrWeakSecret   = fmt.Errorf("encryption secret should be at least %d characters long", minimumSecretLength)
+)
+
+// Key is a secret used to encrypt and decrypt the cache entries.
+type Key struct {
+	secret []byte
+}
+
+func NewKey(secret string) (*Key, error) {
+	if len(secret) < minimumSecretLength {
+		return nil, ErrWeakSecret
+	}
+
+	return &Key{secret: []byte(secret)}, nil
+}
+
+// IsEncrypted checks whether the data looks like the beginning of an encrypted cache entry.
+func IsEncrypted(prefix []byte) bool {
+	n := min(len(prefix), len(magic))
+
+	return n != 0 && string(prefix[:n]) == magic[:n]
+}
+
+// EncryptedSize returns the size of an encrypted entry given the size of its plaintext.
+func EncryptedSize(size int64) int64 {
+	segments := max((size+segmentSize-1)/segmentSize, 1)
+
+	return int64(headerSize) + size + segments*tagSize
+}
+
+// DecryptedSize returns the size of the plaintext given the size of an encrypted entry.
+func DecryptedSize(size int64) (int64, error) {
+	sealed := size - int64(headerSize)
+	if sealed < tagSize {
+		return 0, ErrCorrupted
+	}
+
+	segments := (sealed + sealedSegmentSize - 1) / sealedSegmentSize
+	if remainder := sealed % sealedSegmentSize; remainder != 0 && remainder < tagSize {
+		return 0, ErrCorrupted
+	}
+
+	return sealed - segments*tagSize, nil
+}
+
+func (key *Key) aead(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte("cirrus-cache-encryption"))
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (key *Key) keyCheck(salt []byte) []byte {
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write([]byte("cirrus-cache-key-check"))
+	mac.Write(salt)
+
+	return mac.Sum(nil)[:keyCheckSize]
+}
+
+func segmentNonce(nonce []byte, index uint64, last bool) []byte {
+	clear(nonce)
+	binary.BigEndian.PutUint64(nonce[:8], index)
+	if last {
+		nonce[len(nonce)-1] = nonceLastSegmentFlag
+	}
+
+	return nonce
+}
+
+// NewEncryptingReader returns a reader that yields the encrypted contents of r.
+func NewEncryptingReader(r io.Reader, key *Key) io.ReadCloser {
+	return pipe(r, func(w io.Writer) io.WriteCloser {
+		return NewEncryptingWriter(w, key)
+	})
+}
+
+// NewDecryptingReader returns a reader that yields the decrypted contents of r.
+func NewDecryptingReader(r io.Reader, key *Key) io.ReadCloser {
+	return pipe(r, func(w io.Writer) io.WriteCloser {
+		return NewDecryptingWriter(w, key)
+	})
+}
+
+func pipe(r io.Reader, newWriter func(w io.Writer) io.WriteCloser) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		writer := newWriter(pipeWriter)
+
+		_, err := io.Copy(writer, r)
+		if err == nil {
+			err = writer.Close()
+		}
+
+		_ = pipeWriter.CloseWithError(err)
+	}()
+
+	return pipeReader
+}
@@ -0,0 +1,139 @@
+package cachecrypt_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+const segmentSize = 64 * 1024
+
+func encrypt(t *testing.T, key *cachecrypt.Key, plaintext []byte) []byte {
+	t.Helper()
+
+	var encrypted bytes.Buffer
+
+	writer := cachecrypt.NewEncryptingWriter(&encrypted, key)
+	_, err := writer.Write(plaintext)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return encrypted.Bytes()
+}
+
+func decrypt(key *cachecrypt.Key, encrypted []byte) ([]byte, error) {
+	return io.ReadAll(cachecrypt.NewDecryptingReader(bytes.NewReader(encrypted), key))
+}
+
+func newKey(t *testing.T, secret string) *cachecrypt.Key {
+	t.Helper()
+
+	key, err := cachecrypt.NewKey(secret)
+	require.NoError(t, err)
+
+	return key
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newKey(t, "0123456789abcdef0123456789abcdef")
+
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 42} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			plaintext := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(plaintext)
+
+			encrypted := encrypt(t, key, plaintext)
+			require.True(t, cachecrypt.IsEncrypted(encrypted))
+			require.EqualValues(t, cachecrypt.EncryptedSize(int64(size)), len(encrypted))
+
+			decryptedSize, err := cachecrypt.DecryptedSize(int64(len(encrypted)))
+			require.NoError(t, err)
+			require.EqualValues(t, size, decryptedSize)
+
+			decrypted, err := decrypt(key, encrypted)
+			require.NoError(t, err)
+			require.Equal(t, plaintext, decrypted)
+
+			// The encrypting reader yields an equivalent stream
+			encrypted, err = io.ReadAll(cachecrypt.NewEncryptingReader(bytes.NewReader(plaintext), key))
+			require.NoError(t, err)
+			decrypted, err = decrypt(key, encrypted)
+			require.NoError(t, err)
+			require.Equal(t, plaintext, decrypted)
+		})
+	}
+}
+
+func TestSmallWrites(t *testing.T) {
+	key := newKey(t, "0123456789abcdef0123456789abcdef")
+
+	plaintext := make([]byte, 2*segmentSize+7)
+	rand.New(rand.NewSource(0)).Read(plaintext)
+
+	var encrypted bytes.Buffer
+	writer := cachecrypt.NewEncryptingWriter(&encrypted, key)
+	for _, b := range plaintext {
+		_, err := writer.Write([]byte{b})
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+
+	var decrypted bytes.Buffer
+	decryptingWriter := cachecrypt.NewDecryptingWriter(&decrypted, key)
+	for _, b := range encrypted.Bytes() {
+		_, err := decryptingWriter.Write([]byte{b})
+		require.NoError(t, err)
+	}
+	require.NoError(t, decryptingWriter.Close())
+	require.Equal(t, plaintext, decrypted.Bytes())
+}
+
+func TestDecryptionFailures(t *testing.T) {
+	key := newKey(t, "0123456789abcdef0123456789abcdef")
+
+	plaintext := make([]byte, 3*segmentSize)
+	rand.New(rand.NewSource(0)).Read(plaintext)
+	encrypted := encrypt(t, key, plaintext)
+
+	headerSize := len(encrypted) - len(plaintext) - 3*16
+	sealedSegmentSize := segmentSize + 16
+
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)/2] ^= 1
+
+	reordered := bytes.Clone(encrypted)
+	copy(reordered[headerSize:], encrypted[headerSize+sealedSegmentSize:headerSize+2*sealedSegmentSize])
+	copy(reordered[headerSize+sealedSegmentSize:], encrypted[headerSize:headerSize+sealedSegmentSize])
+
+	testCases := []struct {
+		name      string
+		key       *cachecrypt.Key
+		encrypted []byte
+		err       error
+	}{
+		{"different key", newKey(t, "fedcba9876543210fedcba9876543210"), encrypted, cachecrypt.ErrKeyMismatch},
+		{"plaintext", key, plaintext, cachecrypt.ErrNotEncrypted},
+		{"empty", key, nil, cachecrypt.ErrNotEncrypted},
+		{"truncated header", key, encrypted[:headerSize-1], cachecrypt.ErrCorrupted},
+		{"truncated at segment boundary", key, encrypted[:headerSize+2*sealedSegmentSize], cachecrypt.ErrCorrupted},
+		{"truncated mid-segment", key, encrypted[:len(encrypted)-1], cachecrypt.ErrCorrupted},
+		{"tampered", key, tampered, cachecrypt.ErrCorrupted},
+		{"reordered", key, reordered, cachecrypt.ErrCorrupted},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := decrypt(testCase.key, testCase.encrypted)
+			require.ErrorIs(t, err, testCase.err)
+		})
+	}
+}
+
+func TestWeakSecret(t *testing.T) {
+	_, err := cachecrypt.NewKey("short")
+	require.ErrorIs(t, err, cachecrypt.ErrWeakSecret)
+}
@@ -0,0 +1,217 @@
+package cachecrypt
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"io"
+)
+
+type encryptingWriter struct {
+	w       io.Writer
+	key     *Key
+	aead    cipher.AEAD
+	nonce   []byte
+	index   uint64
+	buf     []byte
+	sealed  []byte
+	err     error
+	started bool
+}
+
+// NewEncryptingWriter returns a writer that encrypts the data written to it and writes
+// the result to w. Close must be called to write the final segment, it doesn't close w.
+func NewEncryptingWriter(w io.Writer, key *Key) io.WriteCloser {
+	return &encryptingWriter{
+		w:   w,
+		key: key,
+		buf: make([]byte, 0, segmentSize),
+	}
+}
+
+func (writer *encryptingWriter) Write(p []byte) (int, error) {
+	if err := writer.start(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+
+	for len(p) != 0 {
+		// Only seal a full segment once we know that it's not the last one
+		if len(writer.buf) == segmentSize {
+			if err := writer.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(writer.buf[len(writer.buf):segmentSize], p)
+		writer.buf = writer.buf[:len(writer.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (writer *encryptingWriter) Close() error {
+	if err := writer.start(); err != nil {
+		return err
+	}
+
+	return writer.seal(true)
+}
+
+func (writer *encryptingWriter) start() error {
+	if writer.err != nil || writer.started {
+		return writer.err
+	}
+	writer.started = true
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		writer.err = err
+
+		return err
+	}
+
+	writer.aead, writer.err = writer.key.aead(salt)
+	if writer.err != nil {
+		return writer.err
+	}
+	writer.nonce = make([]byte, writer.aead.NonceSize())
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = append(header, salt...)
+	header = append(header, writer.key.keyCheck(salt)...)
+
+	_, writer.err = writer.w.Write(header)
+
+	return writer.err
+}
+
+func (writer *encryptingWriter) seal(last bool) error {
+	if writer.err != nil {
+		return writer.err
+	}
+
+	writer.sealed = writer.aead.Seal(writer.sealed[:0], segmentNonce(writer.nonce, writer.index, last), writer.buf, nil)
+	writer.index++
+	writer.buf = writer.buf[:0]
+
+	_, writer.err = writer.w.Write(writer.sealed)
+
+	return writer.err
+}
+
+type decryptingWriter struct {
+	w      io.Writer
+	key    *Key
+	aead   cipher.AEAD
+	nonce  []byte
+	index  uint64
+	buf    []byte
+	opened []byte
+	err    error
+}
+
+// NewDecryptingWriter returns a writer that decrypts the data written to it and writes
+// the result to w. Close must be called to verify and write the final segment, it doesn't
+// close w.
+//
+// Nothing is written to w until the entry's header is verified, so the callers can
+// still handle ErrNotEncrypted and ErrKeyMismatch gracefully.
+func NewDecryptingWriter(w io.Writer, key *Key) io.WriteCloser {
+	return &decryptingWriter{
+		w:   w,
+		key: key,
+	}
+}
+
+func (writer *decryptingWriter) Write(p []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	writer.buf = append(writer.buf, p...)
+
+	if writer.aead == nil {
+		if !IsEncrypted(writer.buf) {
+			writer.err = ErrNotEncrypted
+
+			return 0, writer.err
+		}
+
+		if len(writer.buf) < headerSize {
+			return len(p), nil
+		}
+
+		if writer.err = writer.open(writer.buf[:headerSize]); writer.err != nil {
+			return 0, writer.err
+		}
+
+		writer.buf = writer.buf[headerSize:]
+	}
+
+	// Only open a full segment once we know that it's not the last one
+	consumed := 0
+	for len(writer.buf)-consumed > sealedSegmentSize {
+		if writer.err = writer.unseal(writer.buf[consumed:consumed+sealedSegmentSize], false); writer.err != nil {
+			return 0, writer.err
+		}
+		consumed += sealedSegmentSize
+	}
+	writer.buf = append(writer.buf[:0], writer.buf[consumed:]...)
+
+	return len(p), nil
+}
+
+func (writer *decryptingWriter) Close() error {
+	if writer.err != nil {
+		return writer.err
+	}
+
+	if writer.aead == nil {
+		if len(writer.buf) == 0 || !IsEncrypted(writer.buf) {
+			return ErrNotEncrypted
+		}
+
+		return ErrCorrupted
+	}
+
+	writer.err = writer.unseal(writer.buf, true)
+	writer.buf = writer.buf[:0]
+
+	return writer.err
+}
+
+func (writer *decryptingWriter) open(header []byte) error {
+	salt := header[len(magic) : len(magic)+saltSize]
+
+	if !hmac.Equal(writer.key.keyCheck(salt), header[len(magic)+saltSize:]) {
+		return ErrKeyMismatch
+	}
+
+	aead, err := writer.key.aead(salt)
+	if err != nil {
+		return err
+	}
+
+	writer.aead = aead
+	writer.nonce = make([]byte, aead.NonceSize())
+
+	return nil
+}
+
+func (writer *decryptingWriter) unseal(sealed []byte, last bool) error {
+	opened, err := writer.aead.Open(writer.opened[:0], segmentNonce(writer.nonce, writer.index, last), sealed, nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	writer.opened = opened
+	writer.index++
+
+	_, err = writer.w.Write(opened)
+
+	return err
+}
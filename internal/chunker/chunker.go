@@ -0,0 +1,148 @@
+// Package chunker splits a stream into content-defined chunks using the FastCDC
+// algorithm[1], so that an insertion or a deletion in the stream only affects
+// the chunks around it, while the rest of the chunks stay the same.
+//
+// [1]: https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
+package chunker
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	DefaultMinSize = 256 * 1024
+	DefaultAvgSize = 1024 * 1024
+	DefaultMaxSize = 4 * 1024 * 1024
+)
+
+// The gear table needs to be stable across the agent versions,
+// otherwise the chunks won't be deduplicated, so it's generated
+// using a fixed seed instead of being randomized
+var gear = func() [256]uint64 {
+	var result [256]uint64
+
+	// SplitMix64
+	state := uint64(0x6369727275732d63)
+
+	for i := range result {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		result[i] = z ^ (z >> 31)
+	}
+
+	return result
+}()
+
+type Chunker struct {
+	reader io.Reader
+
+	minSize int
+	avgSize int
+	maxSize int
+
+	// Masks used before and after the average size is reached (normalized chunking),
+	// the most significant bits are used since they depend on the last 64 bytes
+	maskS uint64
+	maskL uint64
+
+	buf []byte
+	n   int
+	eof bool
+}
+
+type Option func(chunker *Chunker)
+
+// WithSizes configures the minimum, the average and the maximum chunk sizes,
+// the average size should be a power of two.
+func WithSizes(minSize int, avgSize int, maxSize int) Option {
+	return func(chunker *Chunker) {
+		chunker.minSize = minSize
+		chunker.avgSize = avgSize
+		chunker.maxSize = maxSize
+	}
+}
+
+func New(reader io.Reader, opts ...Option) *Chunker {
+	chunker := &Chunker{
+		reader:  reader,
+		minSize: DefaultMinSize,
+		avgSize: DefaultAvgSize,
+		maxSize: DefaultMaxSize,
+	}
+
+	for _, opt := range opts {
+		opt(chunker)
+	}
+
+	bits := 0
+	for 1<<(bits+1) <= chunker.avgSize {
+		bits++
+	}
+
+	chunker.maskS = ^uint64(0) << (64 - (bits + 2))
+	chunker.maskL = ^uint64(0) << (64 - (bits - 2))
+	chunker.buf = make([]byte, chunker.maxSize)
+
+	return chunker
+}
+
+// Next returns the next chunk, which is owned by the caller,
+// or io.EOF when the stream is exhausted.
+func (chunker *Chunker) Next() ([]byte, error) {
+	if !chunker.eof && chunker.n < chunker.maxSize {
+		n, err := io.ReadFull(chunker.reader, chunker.buf[chunker.n:])
+		chunker.n += n
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			chunker.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if chunker.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := chunker.cut(chunker.buf[:chunker.n])
+
+	// Move the chunk out of the way, so that the
+	// remainder of the buffer can be re-filled
+	chunk := make([]byte, cut)
+	copy(chunk, chunker.buf[:cut])
+	chunker.n = copy(chunker.buf, chunker.buf[cut:chunker.n])
+
+	return chunk, nil
+}
+
+func (chunker *Chunker) cut(data []byte) int {
+	if len(data) <= chunker.minSize {
+		return len(data)
+	}
+
+	normalSize := min(chunker.avgSize, len(data))
+	maxSize := min(chunker.maxSize, len(data))
+
+	var fingerprint uint64
+
+	i := chunker.minSize
+
+	for ; i < normalSize; i++ {
+		fingerprint = (fingerprint << 1) + gear[data[i]]
+		if fingerprint&chunker.maskS == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < maxSize; i++ {
+		fingerprint = (fingerprint << 1) + gear[data[i]]
+		if fingerprint&chunker.maskL == 0 {
+			return i + 1
+		}
+	}
+
+	return maxSize
+}
@@ -0,0 +1,97 @@
+package chunker_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/chunker"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+const (
+	testMinSize = 1024
+	testAvgSize = 4096
+	testMaxSize = 16384
+)
+
+func chunksHelper(t *testing.T, reader io.Reader) [][]byte {
+	var result [][]byte
+
+	chunker := chunker.New(reader, chunker.WithSizes(testMinSize, testAvgSize, testMaxSize))
+
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return result
+		}
+		require.NoError(t, err)
+
+		result = append(result, chunk)
+	}
+}
+
+func randomBytesHelper(seed int64, n int) []byte {
+	result := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(result)
+
+	return result
+}
+
+func TestChunks(t *testing.T) {
+	data := randomBytesHelper(1, 1024*1024)
+
+	chunks := chunksHelper(t, bytes.NewReader(data))
+	require.Equal(t, data, bytes.Join(chunks, nil))
+
+	for i, chunk := range chunks {
+		require.LessOrEqual(t, len(chunk), testMaxSize)
+
+		if i != len(chunks)-1 {
+			require.GreaterOrEqual(t, len(chunk), testMinSize)
+		}
+	}
+
+	// The boundaries shouldn't depend on how the data is read
+	require.Equal(t, chunks, chunksHelper(t, iotest.HalfReader(bytes.NewReader(data))))
+}
+
+func TestEmpty(t *testing.T) {
+	require.Empty(t, chunksHelper(t, bytes.NewReader(nil)))
+}
+
+func TestInsertionOnlyAffectsNearbyChunks(t *testing.T) {
+	data := randomBytesHelper(2, 1024*1024)
+
+	modified := bytes.Join([][]byte{
+		data[:len(data)/2],
+		[]byte("inserted"),
+		data[len(data)/2:],
+	}, nil)
+
+	digests := func(chunks [][]byte) map[[32]byte]struct{} {
+		result := map[[32]byte]struct{}{}
+
+		for _, chunk := range chunks {
+			result[sha256.Sum256(chunk)] = struct{}{}
+		}
+
+		return result
+	}
+
+	original := digests(chunksHelper(t, bytes.NewReader(data)))
+	changed := chunksHelper(t, bytes.NewReader(modified))
+
+	var reused int
+
+	for digest := range digests(changed) {
+		if _, ok := original[digest]; ok {
+			reused++
+		}
+	}
+
+	require.GreaterOrEqual(t, reused, len(changed)-2)
+}
@@ -0,0 +1,91 @@
+package excluder
+
+import (
+	"fmt"
+	"github.com/bmatcuk/doublestar"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Excluder decides which paths should be excluded from a cache
+// based on a list of globs (with "**" support), where:
+//
+//   - a glob without a path separator (e.g. "*.lock") is matched
+//     against the file name, regardless of the file location
+//   - an absolute glob (e.g. "/home/user/.gradle/caches/*/journal-*")
+//     is matched against the absolute path
+//   - any other glob (e.g. "build/**/*.tmp") is matched against
+//     the path relative to the base folder
+//
+// A nil Excluder excludes nothing.
+type Excluder struct {
+	baseFolder string
+	patterns   []string
+}
+
+func New(baseFolder string, patterns []string) (*Excluder, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	excluder := &Excluder{
+		baseFolder: baseFolder,
+	}
+
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "~/") {
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("failed to expand exclusion pattern %q: %w", pattern, err)
+			}
+
+			pattern = filepath.Join(homeDir, pattern[2:])
+		}
+
+		pattern = filepath.FromSlash(pattern)
+
+		// Validate the pattern, matching against an empty path
+		// won't do since it bails out before parsing the pattern
+		for _, component := range strings.Split(pattern, string(filepath.Separator)) {
+			if _, err := filepath.Match(component, ""); err != nil {
+				return nil, fmt.Errorf("invalid exclusion pattern %q: %w", pattern, err)
+			}
+		}
+
+		excluder.patterns = append(excluder.patterns, pattern)
+	}
+
+	return excluder, nil
+}
+
+// Excluded returns true if the path (which should be absolute) matches any of the patterns.
+func (excluder *Excluder) Excluded(path string) bool {
+	if excluder == nil {
+		return false
+	}
+
+	relativePath, err := filepath.Rel(excluder.baseFolder, path)
+	if err != nil {
+		relativePath = ""
+	}
+
+	for _, pattern := range excluder.patterns {
+		var name string
+
+		switch {
+		case !strings.ContainsRune(pattern, filepath.Separator):
+			name = filepath.Base(path)
+		case filepath.IsAbs(pattern):
+			name = path
+		default:
+			name = relativePath
+		}
+
+		if matched, _ := doublestar.PathMatch(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,53 @@
+package excluder_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/excluder"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	homeDir, err := os.UserHomeDir()
+	require.NoError(t, err)
+
+	baseFolder := filepath.FromSlash("/tmp/project")
+
+	testCases := []struct {
+		Name     string
+		Pattern  string
+		Path     string
+		Expected bool
+	}{
+		{"file name", "*.lock", "/tmp/project/node_modules/yarn.lock", true},
+		{"file name mismatch", "*.lock", "/tmp/project/node_modules/yarn.json", false},
+		{"relative", "build/*.tmp", "/tmp/project/build/file.tmp", true},
+		{"relative doesn't match nested", "build/*.tmp", "/tmp/project/build/sub/file.tmp", false},
+		{"relative double star", "build/**/*.tmp", "/tmp/project/build/sub/file.tmp", true},
+		{"absolute", "/tmp/project/caches/*/journal-*", "/tmp/project/caches/8.0/journal-1", true},
+		{"home directory", "~/.gradle/caches/*/journal-*", filepath.Join(homeDir, ".gradle/caches/8.0/journal-1"), true},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			fileExcluder, err := excluder.New(baseFolder, []string{testCase.Pattern})
+			require.NoError(t, err)
+
+			require.Equal(t, testCase.Expected, fileExcluder.Excluded(filepath.FromSlash(testCase.Path)))
+		})
+	}
+}
+
+func TestNil(t *testing.T) {
+	fileExcluder, err := excluder.New("/tmp", nil)
+	require.NoError(t, err)
+	require.False(t, fileExcluder.Excluded("/tmp/file.txt"))
+}
+
+func TestInvalidPattern(t *testing.T) {
+	_, err := excluder.New("/tmp", []string{"[unterminated"})
+	require.Error(t, err)
+}
@@ -2,16 +2,23 @@ package executor
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/bmatcuk/doublestar"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/excluder"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/rangedownload"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
-	"log"
+	"github.com/sirupsen/logrus"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -19,6 +26,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +38,13 @@ type Cache struct {
 	FileHasher               *hasher.Hasher
 	SkipUpload               bool
 	CacheAvailable           bool
+	RestoreKeys              []string
+	Excluder                 *excluder.Excluder
+	// Key of the entry that was restored using one of the restore keys
+	// instead of the exact key, empty if there was no such restoration
+	RestoredKey string
+	// Scope that the cache is uploaded to, nil when the caches are not scoped
+	Scope *cacheScope
 }
 
 var caches = make([]Cache, 0)
@@ -38,6 +53,28 @@ var httpClient = &http.Client{
 	Timeout: 10 * time.Minute,
 }
 
+// The cache entries are streamed for as long as it takes to extract them, so instead of limiting
+// the total duration of the download, the download is aborted when no data arrives for a while
+var cacheDownloadHTTPClient = &http.Client{
+	Transport: cacheDownloadTransport(),
+}
+
+const cacheDownloadIdleTimeout = 2 * time.Minute
+
+var errCacheDownloadStalled = fmt.Errorf("no data was received for %v", cacheDownloadIdleTimeout)
+
+func cacheDownloadTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = cacheDownloadIdleTimeout
+
+	return transport
+}
+
+// cacheEntryURL returns the URL of the entry in the HTTP cache.
+func cacheEntryURL(cacheHost string, cacheKey string) string {
+	return fmt.Sprintf("http://%s/%s", cacheHost, url.PathEscape(cacheKey))
+}
+
 func (executor *Executor) DownloadCache(
 	ctx context.Context,
 	logUploader *LogUploader,
@@ -51,6 +88,30 @@ func (executor *Executor) DownloadCache(
 		return false
 	}
 
+	scopes, err := cacheScopes(custom_env, commandName)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to configure scope for %s cache: %v", commandName, err)))
+		return false
+	}
+
+	// The cache is uploaded to the first scope, the rest are only used as a fallback
+	unscopedKey := cacheKey
+	var fallbackKeys []string
+	var uploadScope *cacheScope
+	if len(scopes) != 0 {
+		uploadScope = &scopes[0]
+		logUploader.Write([]byte(fmt.Sprintf("\nUsing %s cache scoped to %s...", commandName, scopes[0].description)))
+
+		cacheKey = scopes[0].key(unscopedKey)
+		for _, scope := range scopes[1:] {
+			fallbackKeys = append(fallbackKeys, scope.key(unscopedKey))
+		}
+	}
+
+	if cacheOptionBool(custom_env, commandName, "LOOKUP_ONLY") {
+		return executor.lookUpCache(ctx, logUploader, commandName, cacheHost, cacheKey, fallbackKeys, scopes, custom_env)
+	}
+
 	// Partially expand cache folders without and keep them for further re-evaluation in UploadCache()
 	//
 	// Once in UploadCache(), the cache will be populated, and the globbing may yield a different result.
@@ -105,7 +166,54 @@ func (executor *Executor) DownloadCache(
 		}
 	}
 
+	// Exclusion globs are honored both when archiving and when detecting changes,
+	// so that the excluded files neither end up in the archive nor trigger a re-upload
+	cacheExcluder, err := excluder.New(baseFolder, cacheOptionList(custom_env, commandName, "EXCLUDE"))
+	if err != nil {
+		message := fmt.Sprintf("\nFailed to parse exclusion patterns for %s cache: %v\n", commandName, err)
+		executor.cacheAttempts.Failed(cacheKey, message)
+		logUploader.Write([]byte(message))
+		return false
+	}
+
 	cachePopulated, cacheAvailable := executor.tryToDownloadAndPopulateCache(ctx, logUploader, commandName, cacheHost, cacheKey, baseFolder)
+	if cachePopulated && len(scopes) != 0 {
+		logUploader.Write([]byte(fmt.Sprintf("\nRestored %s cache from the scope of %s.", commandName, scopes[0].description)))
+	}
+
+	// Fall back to the caches of the default branch,
+	// UploadCache() will then re-upload the cache under the scoped key
+	var restoredKey string
+	for i, fallbackKey := range fallbackKeys {
+		if cachePopulated || cacheAvailable {
+			break
+		}
+
+		fallbackScope := scopes[i+1]
+		logUploader.Write([]byte(fmt.Sprintf("\nCache miss in the scope of %s, falling back to the scope of %s...",
+			scopes[0].description, fallbackScope.description)))
+
+		if populated, _ := executor.tryToDownloadAndPopulateCache(ctx, logUploader, commandName, cacheHost, fallbackKey, baseFolder); populated {
+			logUploader.Write([]byte(fmt.Sprintf("\nRestored %s cache from the scope of %s, it will be uploaded to the scope of %s.",
+				commandName, fallbackScope.description, scopes[0].description)))
+			restoredKey = fallbackKey
+			cachePopulated = true
+		}
+	}
+
+	// Fall back to the most recent entry matching one of the restore keys,
+	// UploadCache() will then re-upload the cache under the exact key
+	cacheRestoreKeys := restoreKeys(custom_env, commandName)
+	if !cachePopulated && !cacheAvailable && len(cacheRestoreKeys) != 0 {
+		restoredKey = executor.tryToRestoreCache(ctx, logUploader, commandName, cacheHost, cacheRestoreKeys, scopes, baseFolder)
+		cachePopulated = restoredKey != ""
+	}
+
+	if cachePopulated && restoredKey == "" {
+		exportCacheStatus(custom_env, commandName, cacheKey)
+	} else {
+		exportCacheStatus(custom_env, commandName, restoredKey)
+	}
 
 	// Expand cache folders in case they contain potential globs,
 	// so we can calculate the hashes for directories that already exist
@@ -116,7 +224,24 @@ func (executor *Executor) DownloadCache(
 		return false
 	}
 
-	fileHasher := hasher.New()
+	fileHasherOpts := []hasher.Option{hasher.WithExcluder(cacheExcluder)}
+	// The manifests are not signed, so when the signatures are verified, all
+	// the files are re-hashed instead of trusting a potentially forged manifest
+	if cachePopulated && executor.cacheSigner == nil {
+		manifestKey := cacheKey
+		if restoredKey != "" {
+			manifestKey = restoredKey
+		}
+
+		manifest, err := fetchCacheManifest(ctx, cacheHost, manifestKey)
+		if err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to fetch manifest for %s cache, will re-hash all files: %v", commandName, err)))
+		} else if manifest != nil {
+			fileHasherOpts = append(fileHasherOpts, hasher.WithManifest(manifest))
+		}
+	}
+
+	fileHasher := hasher.New(fileHasherOpts...)
 	if cachePopulated {
 		for _, folderToCache := range foldersToCache {
 			if err := fileHasher.AddFolder(baseFolder, folderToCache); err != nil {
@@ -152,11 +277,55 @@ func (executor *Executor) DownloadCache(
 			FileHasher:               fileHasher,
 			SkipUpload:               cacheAvailable && !instruction.ReuploadOnChanges,
 			CacheAvailable:           cacheAvailable,
+			RestoreKeys:              cacheRestoreKeys,
+			Excluder:                 cacheExcluder,
+			RestoredKey:              restoredKey,
+			Scope:                    uploadScope,
 		},
 	)
 	return true
 }
 
+// tryToRestoreCache tries the restore keys in order, first within the cache's own scope and then
+// within the scope of the default branch, and returns the key of the restored cache entry
+// or an empty string if nothing was restored.
+func (executor *Executor) tryToRestoreCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	restoreKeys []string,
+	scopes []cacheScope,
+	folderToCache string,
+) string {
+	for _, scope := range restoreKeyScopes(scopes) {
+		for _, restoreKey := range restoreKeys {
+			pointerName := restoreKeyPointerName(restoreKey, scope)
+
+			matchingKey, err := resolveRestoreKey(ctx, cacheHost, restoreKey, scope, executor.cacheSigner)
+			if err != nil {
+				logUploader.Write([]byte(fmt.Sprintf("\nFailed to look up restore key %s for %s cache: %v", pointerName, commandName, err)))
+				continue
+			}
+			if matchingKey == "" {
+				logUploader.Write([]byte(fmt.Sprintf("\nNo cache entries match restore key %s.", pointerName)))
+				continue
+			}
+
+			logUploader.Write([]byte(fmt.Sprintf("\nRestore key %s matches cache entry %s...", pointerName, matchingKey)))
+
+			populated, _ := executor.tryToDownloadAndPopulateCache(ctx, logUploader, commandName, cacheHost, matchingKey, folderToCache)
+			if populated {
+				logUploader.Write([]byte(fmt.Sprintf("\nRestored %s cache from %s using restore key %s!\n",
+					commandName, matchingKey, pointerName)))
+				return matchingKey
+			}
+		}
+	}
+
+	return ""
+}
+
 func (executor *Executor) generateCacheKey(
 	ctx context.Context,
 	logUploader *LogUploader,
@@ -170,6 +339,18 @@ func (executor *Executor) generateCacheKey(
 
 	cacheKeyHash := sha256.New()
 
+	fingerprintedFiles, fingerprinted, err := fingerprintFiles(custom_env, commandName, cacheKeyHash)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to fingerprint files for %s cache: %v!", commandName, err)))
+		return "", false
+	}
+	if fingerprinted {
+		logUploader.Write([]byte(fmt.Sprintf("\nFingerprinted %s cache using %d file(s):", commandName, len(fingerprintedFiles))))
+		for _, fingerprintedFile := range fingerprintedFiles {
+			logUploader.Write([]byte(fmt.Sprintf("\n%s", fingerprintedFile)))
+		}
+	}
+
 	if len(instruction.FingerprintScripts) > 0 {
 		cmd, err := ShellCommandsAndWait(ctx, instruction.FingerprintScripts, custom_env, func(bytes []byte) (int, error) {
 			cacheKeyHash.Write(bytes)
@@ -179,7 +360,7 @@ func (executor *Executor) generateCacheKey(
 			logUploader.Write([]byte(fmt.Sprintf("\nFailed to execute fingerprint script for %s cache!", commandName)))
 			return "", false
 		}
-	} else {
+	} else if !fingerprinted {
 		cacheKeyHash.Write([]byte(custom_env.Get("CIRRUS_TASK_NAME")))
 		cacheKeyHash.Write([]byte(custom_env.Get("CI_NODE_INDEX")))
 	}
@@ -221,7 +402,49 @@ func (executor *Executor) tryToDownloadAndPopulateCache(
 	cacheKey string,
 	folderToCache string,
 ) (bool, bool) { // successfully populated, available remotely
-	cacheFile, fetchDuration, err := FetchCache(ctx, logUploader, commandName, cacheHost, cacheKey)
+	if prefetched := executor.prefetcher.take(ctx, cacheKey); prefetched != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nUsing %s cache prefetched at the task start...", commandName)))
+		logDownloadedBytes(logUploader, prefetched.size, prefetched.fetchDuration)
+
+		if !executor.ensureDiskSpace(logUploader, commandName, "extract", folderToCache, uint64(prefetched.size)) {
+			_ = os.Remove(prefetched.path)
+			return executor.skipCacheForDiskSpace(logUploader, commandName, cacheKey)
+		}
+
+		return executor.populateFromCacheFile(ctx, logUploader, commandName, cacheHost, cacheKey,
+			prefetched.path, prefetched.fetchDuration, folderToCache)
+	}
+
+	// Check the free disk space beforehand, since running out of it midway leaves a partially
+	// extracted cache behind. Only the size of the archive is known, so the check only catches
+	// the caches that won't fit for sure, the rest is left to the cleanup after a failure.
+	var entrySize uint64
+	if executor.diskSpaceCheckEnabled(commandName) {
+		size, exists, err := cacheEntrySize(ctx, cacheHost, cacheKey)
+		if err == nil && exists {
+			entrySize = uint64(size)
+		}
+	}
+	if !executor.ensureDiskSpace(logUploader, commandName, "extract", folderToCache, entrySize) {
+		return executor.skipCacheForDiskSpace(logUploader, commandName, cacheKey)
+	}
+
+	// Extract the archive while it's being downloaded, this avoids
+	// writing it to disk first and then reading it back
+	populated, available, err := executor.streamCache(ctx, logUploader, commandName, cacheHost, cacheKey, folderToCache)
+	if err == nil {
+		return populated, available
+	}
+
+	// Fall back to a temporary file, so that a slow extraction won't cause a download timeout
+	logUploader.Write([]byte(fmt.Sprintf("\nFailed to unarchive %s cache because of %s! Retrying...\n", commandName, err)))
+	os.RemoveAll(folderToCache)
+	executor.evictAfterNoSpaceFailure(logUploader, commandName, err)
+	if !executor.ensureDiskSpace(logUploader, commandName, "download", os.TempDir(), entrySize) {
+		return executor.skipCacheForDiskSpace(logUploader, commandName, cacheKey)
+	}
+	cacheFile, fetchDuration, err := FetchCache(ctx, logUploader, commandName, cacheHost, cacheKey,
+		executor.transferConcurrency(commandName), executor.cacheEncryptionKey)
 	if err != nil {
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to fetch archive for %s cache: %s!", commandName, err)))
 		if err, ok := err.(net.Error); ok && err.Timeout() {
@@ -231,60 +454,233 @@ func (executor *Executor) tryToDownloadAndPopulateCache(
 		}
 	}
 	if cacheFile == nil {
+		return false, true
+	}
+
+	return executor.populateFromCacheFile(ctx, logUploader, commandName, cacheHost, cacheKey,
+		cacheFile.Name(), fetchDuration, folderToCache)
+}
+
+// populateFromCacheFile extracts an already downloaded cache entry and removes it afterwards.
+func (executor *Executor) populateFromCacheFile(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	cachePath string,
+	fetchDuration time.Duration,
+	folderToCache string,
+) (bool, bool) { // successfully populated, available remotely
+	if digest, ok := executor.entryDigest(ctx, logUploader, commandName, cacheHost, cacheKey); !ok {
+		_ = os.Remove(cachePath)
 		return false, false
+	} else if digest != nil {
+		sum, size, err := fileDigest(cachePath)
+		if err == nil {
+			err = digest.matches(sum, size)
+		}
+		if err != nil {
+			_ = os.Remove(cachePath)
+			logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss: %s cache is corrupted: %v!", commandName, err)))
+			executor.discardCorruptedEntry(ctx, logUploader, commandName, cacheHost, cacheKey, err)
+			return false, false
+		}
+	}
+
+	cacheFile, err := os.Open(cachePath)
+	if err != nil {
+		_ = os.Remove(cachePath)
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to open archive for %s cache: %s!", commandName, err)))
+		return false, true
+	}
+	defer cacheFile.Close()
+
+	bufferedCacheFile := bufio.NewReader(cacheFile)
+	if isChunkedIndex(bufferedCacheFile) {
+		defer os.Remove(cachePath)
+
+		return executor.downloadChunkedCache(ctx, logUploader, commandName, cacheHost, cacheKey,
+			bufferedCacheFile, folderToCache)
 	}
 
-	cacheFileInfo, statErr := os.Stat(cacheFile.Name())
+	cacheFileInfo, statErr := os.Stat(cachePath)
 	if statErr != nil {
 		executor.cacheAttempts.Failed(cacheKey, fmt.Sprintf("failed to determine cache file size: %v", statErr))
 	}
 
-	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nCache hit for %s!", cacheKey)))
+	compression, _ := targz.Detect(cachePath)
+
 	unarchiveStartTime := time.Now()
-	err = unarchiveCache(cacheFile, folderToCache)
+	err = unarchiveCache(cacheFile, folderToCache, metadataOptions(executor.env, commandName)...)
+	if errors.Is(err, targz.ErrUnsafePath) {
+		executor.discardPoisonedEntry(ctx, logUploader, commandName, cacheHost, cacheKey, err)
+		return false, false
+	}
 	if err != nil {
-		logUploader.Write([]byte(fmt.Sprintf("\nFailed to unarchive %s cache because of %s! Retrying...\n", commandName, err)))
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed again to unarchive %s cache because of %s!\n", commandName, err)))
+		executor.cacheAttempts.Failed(cacheKey, fmt.Sprintf("failed to unarchive %s archive: %v", compression, err))
+		logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss but won't try to re-upload! Cleaning up %s...\n", folderToCache)))
 		os.RemoveAll(folderToCache)
-		cacheFile, fetchDuration, err = FetchCache(ctx, logUploader, commandName, cacheHost, cacheKey)
+		return false, true
+	}
+
+	if statErr == nil {
+		executor.cacheAttempts.Hit(cacheKey, uint64(cacheFileInfo.Size()), compression, fetchDuration,
+			time.Since(unarchiveStartTime))
+	}
+
+	return true, true
+}
+
+// discardPoisonedEntry discards the cache entry that has entries resolving outside of the cache
+// folder. Nothing was written outside, so the folder is left as is instead of being removed,
+// since it might as well be the working directory.
+func (executor *Executor) discardPoisonedEntry(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	err error,
+) {
+	message := fmt.Sprintf("refusing to unarchive %s cache: %v", commandName, err)
+	executor.cacheAttempts.Failed(cacheKey, message)
+	logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss: %s! The entry will be replaced.\n", message)))
+	executor.discardCacheEntry(ctx, logUploader, commandName, cacheHost, cacheKey)
+}
+
+// streamCache downloads the cache archive and extracts it on the fly,
+// returning an error only when the download or extraction failed
+// midway and it makes sense to retry.
+func (executor *Executor) streamCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	folderToCache string,
+) (bool, bool, error) { // successfully populated, available remotely, error worth retrying
+	fetchLogger := logger.WithField(agentlog.FieldCommand, commandName)
+
+	// Untrusted entries are not downloaded at all
+	digest, ok := executor.entryDigest(ctx, logUploader, commandName, cacheHost, cacheKey)
+	if !ok {
+		return false, false, nil
+	}
+
+	downloadStartTime := time.Now()
+	respBody, err := openCache(ctx, fetchLogger, commandName, cacheHost, cacheKey, executor.transferConcurrency(commandName),
+		executor.cacheEncryptionKey)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to fetch archive for %s cache: %s!", commandName, err)))
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return false, true, nil
+		}
+		return false, false, nil
+	}
+	if respBody == nil {
+		return false, false, nil
+	}
+	defer respBody.Close()
+
+	verifiedBody := newVerifyingReader(respBody, digest)
+	body := &countingReader{r: verifiedBody}
+	bufferedBody := bufio.NewReaderSize(body, targz.DEFAULT_BUFFER_SIZE)
+
+	// Corrupted entries are not retried, since the same bytes would be downloaded again,
+	// but deleted instead and then replaced by UploadCache()
+	integrityFailed := func(err error) (bool, bool, error) {
+		logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss: %s cache is corrupted: %v! Cleaning up %s...\n",
+			commandName, err, folderToCache)))
+		os.RemoveAll(folderToCache)
+		executor.discardCorruptedEntry(ctx, logUploader, commandName, cacheHost, cacheKey, err)
+		return false, false, nil
+	}
+
+	if isChunkedIndex(bufferedBody) {
+		// The index is small, so verify it before restoring any of the chunks
+		indexBytes, err := io.ReadAll(bufferedBody)
 		if err != nil {
-			logUploader.Write([]byte(fmt.Sprintf("\nFailed to fetch archive for %s cache: %s!", commandName, err)))
-			if err, ok := err.(net.Error); ok && err.Timeout() {
-				return false, true
-			} else {
-				return false, false
+			if integrityErr := verifiedBody.integrityError(); integrityErr != nil {
+				return integrityFailed(integrityErr)
 			}
+
+			message := fmt.Sprintf("failed to download the index of %s cache: %v", commandName, err)
+			executor.cacheAttempts.Failed(cacheKey, message)
+			logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss: %s!", message)))
+			return false, false, nil
 		}
-		if cacheFile == nil {
-			return false, true
+
+		populated, available := executor.downloadChunkedCache(ctx, logUploader, commandName, cacheHost, cacheKey,
+			bytes.NewReader(indexBytes), folderToCache)
+		return populated, available, nil
+	}
+
+	// Old cache entries are gzip-compressed, so always rely on the actual format
+	// instead of the compression that's currently configured for uploading
+	compression, err := targz.DetectFrom(bufferedBody)
+	if err != nil {
+		message := fmt.Sprintf("failed to detect the format of %s cache archive: %v", commandName, err)
+		executor.cacheAttempts.Failed(cacheKey, message)
+		logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss: %s!", message)))
+		return false, true, nil
+	}
+
+	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nCache hit for %s (%s archive)!", cacheKey, compression)))
+
+	EnsureFolderExists(folderToCache)
+	if err := targz.UnarchiveFrom(bufferedBody, folderToCache, metadataOptions(executor.env, commandName)...); err != nil {
+		if integrityErr := verifiedBody.integrityError(); integrityErr != nil {
+			return integrityFailed(integrityErr)
 		}
-		err = unarchiveCache(cacheFile, folderToCache)
-		if err != nil {
-			logUploader.Write([]byte(fmt.Sprintf("\nFailed again to unarchive %s cache because of %s!\n", commandName, err)))
-			logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss but won't try to re-upload! Cleaning up %s...\n", folderToCache)))
-			os.RemoveAll(folderToCache)
-			return false, true
+
+		// Re-downloading won't help with a poisoned cache entry, so replace it instead
+		if errors.Is(err, targz.ErrUnsafePath) {
+			executor.discardPoisonedEntry(ctx, logUploader, commandName, cacheHost, cacheKey, err)
+			return false, false, nil
 		}
-	} else {
-		unarchiveDuration := time.Since(unarchiveStartTime)
-		if unarchiveDuration > 10*time.Second {
-			logUploader.Write([]byte(fmt.Sprintf("\nUnarchived %s cache entry in %f seconds!\n", commandName, unarchiveDuration.Seconds())))
+
+		return false, true, err
+	}
+
+	// The archive is extracted on the fly, so the files
+	// of an entry that fails the verification are removed
+	if err := verifiedBody.finish(); err != nil {
+		if integrityErr := verifiedBody.integrityError(); integrityErr != nil {
+			return integrityFailed(integrityErr)
 		}
+
+		return false, true, err
 	}
 
-	if statErr == nil {
-		executor.cacheAttempts.Hit(cacheKey, uint64(cacheFileInfo.Size()), fetchDuration, time.Since(unarchiveStartTime))
+	// The archive is downloaded and extracted simultaneously, so the download
+	// time is when the last byte was received and the extraction time spans
+	// the whole pipeline
+	downloadDuration := body.eofAt.Sub(downloadStartTime)
+	if body.eofAt.IsZero() {
+		downloadDuration = time.Since(downloadStartTime)
 	}
+	unarchiveDuration := time.Since(downloadStartTime)
 
-	return true, true
+	logDownloadedBytes(logUploader, body.n, downloadDuration)
+	if unarchiveDuration > 10*time.Second {
+		logUploader.Write([]byte(fmt.Sprintf("\nUnarchived %s cache entry in %f seconds!\n", commandName, unarchiveDuration.Seconds())))
+	}
+
+	executor.cacheAttempts.Hit(cacheKey, uint64(body.n), compression, downloadDuration, unarchiveDuration)
+
+	return true, true, nil
 }
 
 func unarchiveCache(
 	cacheFile *os.File,
 	folderToCache string,
+	opts ...targz.Option,
 ) error {
 	defer os.Remove(cacheFile.Name())
 	EnsureFolderExists(folderToCache)
-	return targz.Unarchive(cacheFile.Name(), folderToCache)
+	return targz.Unarchive(cacheFile.Name(), folderToCache, opts...)
 }
 
 func FetchCache(
@@ -293,45 +689,83 @@ func FetchCache(
 	commandName string,
 	cacheHost string,
 	cacheKey string,
+	concurrency int,
+	encryptionKey *cachecrypt.Key,
 ) (*os.File, time.Duration, error) {
+	fetchLogger := logger.WithField(agentlog.FieldCommand, commandName)
+
 	cacheFile, err := os.CreateTemp(os.TempDir(), commandName)
 	if err != nil {
-		log.Printf("Failed to create a temp file %s: %v\n", commandName, err)
+		fetchLogger.Warnf("Failed to create a temp file %s: %v", commandName, err)
 		logUploader.Write([]byte(fmt.Sprintf("\nCache miss for %s!", commandName)))
 		return nil, 0, err
 	}
 	defer cacheFile.Close()
 
 	downloadStartTime := time.Now()
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/%s", cacheHost, cacheKey), nil)
+	respBody, err := openCache(ctx, fetchLogger, commandName, cacheHost, cacheKey, concurrency, encryptionKey)
 	if err != nil {
-		log.Printf("Failed to create a cache request for %s: %v\n", commandName, err)
 		return nil, 0, err
 	}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		log.Printf("HTTP cache request for %s failed: %v\n", commandName, err)
-		return nil, 0, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("HTTP cache request for %s status: %s\n", commandName, resp.Status)
+	if respBody == nil {
 		return nil, 0, nil
 	}
+	defer respBody.Close()
 
 	bufferedFileWriter := bufio.NewWriter(cacheFile)
-	bytesDownloaded, err := bufferedFileWriter.ReadFrom(bufio.NewReader(resp.Body))
+	bytesDownloaded, err := bufferedFileWriter.ReadFrom(bufio.NewReader(respBody))
 	if err != nil {
-		log.Printf("Failed to finish downloading %s cache: %v\n", commandName, err)
+		fetchLogger.Warnf("Failed to finish downloading %s cache: %v", commandName, err)
 		return nil, 0, err
 	}
 	err = bufferedFileWriter.Flush()
 	if err != nil {
-		log.Printf("Failed to flush %s cache: %v\n", commandName, err)
+		fetchLogger.Warnf("Failed to flush %s cache: %v", commandName, err)
 		return nil, 0, err
 	}
 	downloadDuration := time.Since(downloadStartTime)
+	logDownloadedBytes(logUploader, bytesDownloaded, downloadDuration)
+	return cacheFile, downloadDuration, nil
+}
+
+// openCache requests the cache entry using concurrent Range requests when the cache
+// host supports them, returning a nil body on a cache miss. The entry is decrypted
+// when an encryption key is specified.
+func openCache(
+	ctx context.Context,
+	fetchLogger *logrus.Entry,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	concurrency int,
+	encryptionKey *cachecrypt.Key,
+) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	body, err := rangedownload.Open(ctx, cacheDownloadHTTPClient, cacheEntryURL(cacheHost, cacheKey),
+		concurrency, rangedownload.DefaultPartSize)
+	if err != nil {
+		cancel()
+
+		var statusErr *rangedownload.StatusError
+		if errors.As(err, &statusErr) {
+			fetchLogger.Infof("HTTP cache request for %s status: %s", commandName, statusErr.Status)
+			return nil, nil
+		}
+
+		fetchLogger.Warnf("HTTP cache request for %s failed: %v", commandName, err)
+		return nil, err
+	}
+	body = newIdleTimeoutReader(body, cancel, cacheDownloadIdleTimeout, errCacheDownloadStalled)
+
+	if encryptionKey != nil {
+		return decryptCacheBody(body, encryptionKey)
+	}
+
+	return body, nil
+}
+
+func logDownloadedBytes(logUploader *LogUploader, bytesDownloaded int64, downloadDuration time.Duration) {
 	if bytesDownloaded < 1024 {
 		logUploader.Write([]byte(fmt.Sprintf("\nDownloaded %d bytes.", bytesDownloaded)))
 	} else if bytesDownloaded < 1024*1024 {
@@ -339,7 +773,67 @@ func FetchCache(
 	} else {
 		logUploader.Write([]byte(fmt.Sprintf("\nDownloaded %dMb in %fs.", bytesDownloaded/1024/1024, downloadDuration.Seconds())))
 	}
-	return cacheFile, downloadDuration, nil
+}
+
+// countingReader counts the bytes read and remembers when the EOF was reached.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	eofAt time.Time
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+
+	if err == io.EOF && cr.eofAt.IsZero() {
+		cr.eofAt = time.Now()
+	}
+
+	return n, err
+}
+
+// idleTimeoutReader cancels the download when a single Read() doesn't return for the specified
+// duration, which unlike the total timeout doesn't depend on how long it takes to consume the body.
+type idleTimeoutReader struct {
+	r       io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	err     error
+
+	mtx     sync.Mutex
+	stalled bool
+}
+
+func newIdleTimeoutReader(r io.ReadCloser, cancel context.CancelFunc, timeout time.Duration, err error) io.ReadCloser {
+	return &idleTimeoutReader{r: r, cancel: cancel, timeout: timeout, err: err}
+}
+
+func (reader *idleTimeoutReader) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(reader.timeout, func() {
+		reader.mtx.Lock()
+		reader.stalled = true
+		reader.mtx.Unlock()
+
+		reader.cancel()
+	})
+	n, err := reader.r.Read(p)
+	timer.Stop()
+
+	reader.mtx.Lock()
+	defer reader.mtx.Unlock()
+
+	if reader.stalled {
+		return n, reader.err
+	}
+
+	return n, err
+}
+
+func (reader *idleTimeoutReader) Close() error {
+	reader.cancel()
+
+	return reader.r.Close()
 }
 
 func (executor *Executor) UploadCache(
@@ -363,6 +857,16 @@ func (executor *Executor) UploadCache(
 		return true
 	}
 
+	if executor.cacheSigner != nil && !executor.cacheSigner.canSign() {
+		logUploader.Write([]byte(fmt.Sprintf("Skipping upload of %s cache since there's no key to sign it with!", instruction.CacheName)))
+		return true
+	}
+
+	if executor.httpCacheReadOnly {
+		logUploader.Write([]byte(fmt.Sprintf("Skipping upload of %s cache since the HTTP cache is read-only!", instruction.CacheName)))
+		return true
+	}
+
 	foldersToCache, message := executor.expandAndDeduplicateGlobs(cache.PartiallyExpandedFolders)
 	if message != "" {
 		logUploader.Write([]byte(message))
@@ -376,7 +880,8 @@ func (executor *Executor) UploadCache(
 		return true
 	}
 
-	fileHasher := hasher.New()
+	// Only re-hash the files whose size or modification time have changed since the restoration
+	fileHasher := hasher.New(hasher.WithExcluder(cache.Excluder), hasher.WithManifest(cache.FileHasher.Manifest()))
 	for _, folder := range foldersToCache {
 		if err := fileHasher.AddFolder(cache.BaseFolder, folder); err != nil {
 			logUploader.Write([]byte(fmt.Sprintf("Failed to calculate hash of %s! %s", folder, err)))
@@ -385,9 +890,13 @@ func (executor *Executor) UploadCache(
 		}
 	}
 
-	logUploader.Write([]byte(fmt.Sprintf("SHA for cache folders (%s) is '%s'\n", commaSeparatedFolders, fileHasher.SHA())))
+	logUploader.Write([]byte(fmt.Sprintf("SHA for cache folders (%s) is '%s' (%d out of %d files were unchanged and not re-hashed)\n",
+		commaSeparatedFolders, fileHasher.SHA(), fileHasher.Reused(), fileHasher.Len())))
 
-	if fileHasher.SHA() == cache.FileHasher.SHA() {
+	if cache.RestoredKey != "" {
+		logUploader.Write([]byte(fmt.Sprintf("Cache %s was restored from %s, uploading it under the exact key %s...\n",
+			cache.Name, cache.RestoredKey, cache.Key)))
+	} else if fileHasher.SHA() == cache.FileHasher.SHA() {
 		logUploader.Write([]byte(fmt.Sprintf("Cache %s hasn't changed! Skipping uploading...", cache.Name)))
 		return true
 	}
@@ -400,6 +909,57 @@ func (executor *Executor) UploadCache(
 		}
 	}
 
+	archiveOpts, compression, err := archiveOptions(executor.env, instruction.CacheName)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to configure compression for %s cache: %v", instruction.CacheName, err)))
+		return false
+	}
+	archiveOpts = append(archiveOpts, targz.WithExcluder(cache.Excluder))
+
+	chunked, err := chunkedFormat(executor.env, instruction.CacheName)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to configure format for %s cache: %v", instruction.CacheName, err)))
+		return false
+	}
+	if chunked && executor.cacheEncryptionKey != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nThe chunked format of %s cache is not supported with the encryption "+
+			"when using an external HTTP cache, falling back to the archive format...", instruction.CacheName)))
+		chunked = false
+	}
+
+	// The archive is created in a temporary file (the background uploads also snapshot
+	// the folders beforehand), so check that the uncompressed files would fit there
+	background := cacheOptionBool(executor.env, instruction.CacheName, "BACKGROUND_UPLOAD")
+	var requiredDiskSpace uint64
+	if background {
+		requiredDiskSpace += uncompressedSize(fileHasher)
+	}
+	if !chunked {
+		requiredDiskSpace += uncompressedSize(fileHasher)
+	}
+	if !executor.ensureDiskSpace(logUploader, instruction.CacheName, "archive", os.TempDir(), requiredDiskSpace) {
+		logUploader.Write([]byte(fmt.Sprintf("\nSkipping uploading of %s cache!", instruction.CacheName)))
+		return true
+	}
+
+	// The chunks are compressed individually while uploading and the background uploads
+	// compress the snapshot later on, so only the uncompressed size is known at this point
+	if background || chunked {
+		reportCacheSize(logUploader, instruction.CacheName, fileHasher, 0, "")
+	}
+
+	if background {
+		return executor.uploadCacheInBackground(ctx, logUploader, commandName, cacheHost, cache, fileHasher,
+			foldersToCache, archiveOpts, chunked)
+	}
+
+	if chunked {
+		if executor.uploadChunkedCache(ctx, logUploader, commandName, cacheHost, cache, foldersToCache, archiveOpts) {
+			executor.finishCacheUpload(ctx, logUploader, commandName, cacheHost, cache, fileHasher)
+		}
+		return true
+	}
+
 	cacheFile, err := os.CreateTemp("", "")
 	if err != nil {
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to create temporary cache file: %v", err)))
@@ -408,7 +968,7 @@ func (executor *Executor) UploadCache(
 	defer os.Remove(cacheFile.Name())
 
 	archiveStartTime := time.Now()
-	err = targz.Archive(cache.BaseFolder, foldersToCache, cacheFile.Name())
+	err = targz.Archive(cache.BaseFolder, foldersToCache, cacheFile.Name(), archiveOpts...)
 	if err != nil {
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to tar caches for %s with %s!", commandName, err)))
 		return false
@@ -422,39 +982,23 @@ func (executor *Executor) UploadCache(
 
 	bytesToUpload := fi.Size()
 
-	if bytesToUpload < 1024 {
-		logUploader.Write([]byte(fmt.Sprintf("\n%s cache size is %d bytes.", instruction.CacheName, bytesToUpload)))
-	} else if bytesToUpload < 1024*1024 {
-		logUploader.Write([]byte(fmt.Sprintf("\n%s cache size is %dKb.", instruction.CacheName, bytesToUpload/1024)))
-	} else {
-		logUploader.Write([]byte(fmt.Sprintf("\n%s cache size is %dMb.", instruction.CacheName, bytesToUpload/1024/1024)))
-	}
+	reportCacheSize(logUploader, instruction.CacheName, fileHasher, uint64(bytesToUpload), compression)
 
-	cacheURL := fmt.Sprintf("http://%s/%s", cacheHost, url.PathEscape(cache.Key))
+	cacheURL := cacheEntryURL(cacheHost, cache.Key)
 
-	if !cache.CacheAvailable {
-		// check if some other task has uploaded the cache already
-		req, err := http.NewRequestWithContext(ctx, http.MethodHead, cacheURL, nil)
-		if err != nil {
-			logUploader.Write([]byte(fmt.Sprintf("\nFailed to create cache check request to URL %s!", cacheURL)))
-			return false
-		}
-		response, _ := httpClient.Do(req)
-		if response != nil && response.StatusCode == http.StatusOK {
-			createdByTaskId := response.Header.Get(http_cache.CirrusHeaderCreatedBy)
-			if createdByTaskId != "" {
-				logUploader.Write([]byte(fmt.Sprintf("\nTask '%s' has already uploaded cache entry %s! Skipping upload...", createdByTaskId, cache.Key)))
-			} else {
-				logUploader.Write([]byte(fmt.Sprintf("\nSome other task has already uploaded cache entry %s! Skipping upload...", cache.Key)))
-			}
-			return true
-		}
+	if executor.entryUploadedByOtherTask(ctx, logUploader, cacheURL, cache) {
+		return true
+	}
+
+	if !executor.reserveCacheSize(logUploader, instruction.CacheName, uint64(bytesToUpload)) {
+		return true
 	}
 
 	logUploader.Write([]byte(fmt.Sprintf("\nUploading cache %s...", instruction.CacheName)))
 	uploadStartTime := time.Now()
-	err = UploadCacheFile(ctx, cacheURL, cacheFile)
+	err = UploadCacheFile(ctx, cacheURL, cacheFile, executor.cacheEncryptionKey)
 	if err != nil {
+		executor.cacheSizeBudget.release(uint64(bytesToUpload))
 		logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload cache '%s': %s!", commandName, err)))
 		logUploader.Write([]byte("\nIgnoring the error..."))
 		return true
@@ -462,19 +1006,86 @@ func (executor *Executor) UploadCache(
 
 	executor.cacheAttempts.Miss(cache.Key, uint64(bytesToUpload), archivingDuration, time.Since(uploadStartTime))
 
+	executor.recordFileDigest(ctx, logUploader, commandName, cacheHost, cache.Key, cacheFile.Name())
+	executor.finishCacheUpload(ctx, logUploader, commandName, cacheHost, cache, fileHasher)
+
 	return true
 }
 
-func UploadCacheFile(ctx context.Context, cacheURL string, cacheFile *os.File) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cacheURL, cacheFile)
+// finishCacheUpload uploads the auxiliary entries once the cache entry itself is uploaded.
+func (executor *Executor) finishCacheUpload(
+	ctx context.Context,
+	logUploader io.Writer,
+	commandName string,
+	cacheHost string,
+	cache *Cache,
+	fileHasher *hasher.Hasher,
+) {
+	if err := uploadCacheManifest(ctx, cacheHost, cache.Key, fileHasher.Manifest()); err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload manifest for cache '%s': %v", commandName, err)))
+	}
+
+	if err := updateRestoreKeyPointers(ctx, cacheHost, cache, executor.cacheSigner); err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to update restore keys for cache '%s': %v", commandName, err)))
+	}
+}
+
+// entryUploadedByOtherTask checks if the upload of a cache entry that wasn't available when
+// the cache was downloaded should be skipped because some other task has uploaded it since then.
+// The corrupted entries are replaced even if they still exist.
+func (executor *Executor) entryUploadedByOtherTask(ctx context.Context, logUploader io.Writer, cacheURL string, cache *Cache) bool {
+	if cache.CacheAvailable || executor.corruptedCacheEntries.contains(cache.Key) {
+		return false
+	}
+
+	return cacheUploadedByOtherTask(ctx, logUploader, cacheURL, cache.Key)
+}
+
+// cacheUploadedByOtherTask checks if some other task has uploaded the cache entry already.
+func cacheUploadedByOtherTask(ctx context.Context, logUploader io.Writer, cacheURL string, cacheKey string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, cacheURL, nil)
 	if err != nil {
-		return err
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to create cache check request to URL %s!", cacheURL)))
+		return false
 	}
+	response, _ := httpClient.Do(req)
+	if response == nil {
+		return false
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return false
+	}
+
+	createdByTaskId := response.Header.Get(http_cache.CirrusHeaderCreatedBy)
+	if createdByTaskId != "" {
+		logUploader.Write([]byte(fmt.Sprintf("\nTask '%s' has already uploaded cache entry %s! Skipping upload...", createdByTaskId, cacheKey)))
+	} else {
+		logUploader.Write([]byte(fmt.Sprintf("\nSome other task has already uploaded cache entry %s! Skipping upload...", cacheKey)))
+	}
+
+	return true
+}
+
+func UploadCacheFile(ctx context.Context, cacheURL string, cacheFile *os.File, encryptionKey *cachecrypt.Key) error {
 	fileStat, err := cacheFile.Stat()
 	if err != nil {
 		return err
 	}
-	req.ContentLength = fileStat.Size()
+
+	var body io.Reader = cacheFile
+	contentLength := fileStat.Size()
+
+	if encryptionKey != nil {
+		body = cachecrypt.NewEncryptingReader(cacheFile, encryptionKey)
+		contentLength = cachecrypt.EncryptedSize(contentLength)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cacheURL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = contentLength
 	req.Header.Set("Content-Type", "application/octet-stream")
 	response, err := httpClient.Do(req)
 	if err != nil {
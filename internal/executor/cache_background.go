@@ -0,0 +1,191 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backgroundUploads tracks the cache uploads that continue after their steps have finished.
+type backgroundUploads struct {
+	wg      sync.WaitGroup
+	pending atomic.Int64
+}
+
+func (uploads *backgroundUploads) Go(f func()) {
+	uploads.wg.Add(1)
+	uploads.pending.Add(1)
+
+	go func() {
+		defer uploads.wg.Done()
+		defer uploads.pending.Add(-1)
+
+		f()
+	}()
+}
+
+func (uploads *backgroundUploads) Wait() {
+	if pending := uploads.pending.Load(); pending != 0 {
+		logger.Infof("Waiting for %d background cache upload(s) to finish...", pending)
+	}
+
+	uploads.wg.Wait()
+}
+
+// uploadCacheInBackground snapshots the cache folders into an uncompressed archive,
+// so that the subsequent steps can't affect the uploaded contents, and then
+// compresses and uploads the snapshot in the background (the BACKGROUND_UPLOAD
+// cache option).
+//
+// The step logs are finalized by the time the upload finishes, so its
+// progress is logged to the agent logs and the failures are reported
+// as failed cache attempts.
+func (executor *Executor) uploadCacheInBackground(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cache *Cache,
+	fileHasher *hasher.Hasher,
+	foldersToCache []string,
+	archiveOpts []targz.Option,
+	chunked bool,
+) bool {
+	snapshot, err := os.CreateTemp("", "cirrus-cache-snapshot-")
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to create temporary cache file: %v", err)))
+		return false
+	}
+
+	snapshotStartTime := time.Now()
+	if err := targz.ArchiveUncompressed(cache.BaseFolder, foldersToCache, snapshot, archiveOpts...); err != nil {
+		_ = snapshot.Close()
+		_ = os.Remove(snapshot.Name())
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to snapshot caches for %s with %s!", commandName, err)))
+		return false
+	}
+	snapshotDuration := time.Since(snapshotStartTime)
+
+	logUploader.Write([]byte(fmt.Sprintf("\nSnapshotted %s cache in %f seconds, it will be uploaded in the background...",
+		cache.Name, snapshotDuration.Seconds())))
+
+	executor.backgroundUploads.Go(func() {
+		defer os.Remove(snapshot.Name())
+		defer snapshot.Close()
+
+		uploadLogger := logger.WithField(agentlog.FieldCommand, commandName)
+
+		err := executor.uploadSnapshot(ctx, &logEntryWriter{entry: uploadLogger}, commandName, cacheHost,
+			cache, fileHasher, snapshot, snapshotDuration, archiveOpts, chunked)
+		if err != nil {
+			message := fmt.Sprintf("failed to upload %s cache in the background: %v", commandName, err)
+			uploadLogger.Warn(message)
+			executor.cacheAttempts.Failed(cache.Key, message)
+		}
+	})
+
+	return true
+}
+
+func (executor *Executor) uploadSnapshot(
+	ctx context.Context,
+	out io.Writer,
+	commandName string,
+	cacheHost string,
+	cache *Cache,
+	fileHasher *hasher.Hasher,
+	snapshot *os.File,
+	snapshotDuration time.Duration,
+	archiveOpts []targz.Option,
+	chunked bool,
+) error {
+	if _, err := snapshot.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	cacheURL := cacheEntryURL(cacheHost, cache.Key)
+
+	if executor.entryUploadedByOtherTask(ctx, out, cacheURL, cache) {
+		return nil
+	}
+
+	if chunked {
+		size := executor.newChunkedCacheSize(out, cache.Name)
+
+		stats, err := uploadChunks(ctx, cacheHost, cacheURL, snapshot, executor.transferConcurrency(commandName),
+			size.reserve)
+		if err != nil {
+			size.release()
+			return err
+		}
+
+		_, _ = fmt.Fprintf(out, "Uploaded %d out of %d unique chunks of %s cache in the background",
+			stats.uploadedChunks, stats.uniqueChunks, cache.Name)
+
+		executor.cacheAttempts.Miss(cache.Key, uint64(stats.uploadedBytes), snapshotDuration+stats.archivingDuration,
+			stats.totalDuration)
+
+		executor.recordEntryDigest(ctx, out, commandName, cacheHost, cache.Key, stats.indexDigest, stats.indexSize)
+	} else {
+		compressStartTime := time.Now()
+
+		cacheFile, err := os.CreateTemp("", "")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(cacheFile.Name())
+		defer cacheFile.Close()
+
+		if err := targz.Compress(snapshot, cacheFile.Name(), archiveOpts...); err != nil {
+			return err
+		}
+		archivingDuration := snapshotDuration + time.Since(compressStartTime)
+
+		fi, err := os.Stat(cacheFile.Name())
+		if err != nil {
+			return err
+		}
+
+		if !executor.reserveCacheSize(out, cache.Name, uint64(fi.Size())) {
+			return errCacheSizeExceeded
+		}
+
+		uploadStartTime := time.Now()
+		if err := UploadCacheFile(ctx, cacheURL, cacheFile, executor.cacheEncryptionKey); err != nil {
+			executor.cacheSizeBudget.release(uint64(fi.Size()))
+			return err
+		}
+
+		_, _ = fmt.Fprintf(out, "Uploaded %s cache (%d bytes) in the background", cache.Name, fi.Size())
+
+		executor.cacheAttempts.Miss(cache.Key, uint64(fi.Size()), archivingDuration, time.Since(uploadStartTime))
+
+		executor.recordFileDigest(ctx, out, commandName, cacheHost, cache.Key, cacheFile.Name())
+	}
+
+	executor.finishCacheUpload(ctx, out, commandName, cacheHost, cache, fileHasher)
+
+	return nil
+}
+
+// logEntryWriter forwards the messages meant for the step logs to the agent logs.
+type logEntryWriter struct {
+	entry *logrus.Entry
+}
+
+func (writer *logEntryWriter) Write(p []byte) (int, error) {
+	if message := strings.TrimSpace(string(p)); message != "" {
+		writer.entry.Info(message)
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,145 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackgroundUploadOfSnapshot(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+
+	baseFolder := t.TempDir()
+	cacheFolder := filepath.Join(baseFolder, "cache")
+	require.NoError(t, os.Mkdir(cacheFolder, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(cacheFolder, "file.txt"), []byte("snapshotted"), 0600))
+
+	snapshot, err := os.CreateTemp(t.TempDir(), "")
+	require.NoError(t, err)
+	defer snapshot.Close()
+	require.NoError(t, targz.ArchiveUncompressed(baseFolder, []string{cacheFolder}, snapshot))
+
+	// Changes made by the subsequent steps should not affect the uploaded cache
+	require.NoError(t, os.WriteFile(filepath.Join(cacheFolder, "file.txt"), []byte("modified"), 0600))
+
+	executor := &Executor{
+		env:           environment.New(map[string]string{}),
+		cacheAttempts: NewCacheAttempts(),
+	}
+	uploadedCache := &Cache{Name: "cache", Key: "cache-key", BaseFolder: baseFolder}
+
+	var uploadErr error
+	executor.backgroundUploads.Go(func() {
+		uploadErr = executor.uploadSnapshot(context.Background(), io.Discard, "cache",
+			cache.host, uploadedCache, hasher.New(), snapshot, time.Second, nil, false)
+	})
+	executor.backgroundUploads.Wait()
+	require.NoError(t, uploadErr)
+
+	attempt, ok := executor.cacheAttempts.ToProto()["cache-key"]
+	require.True(t, ok)
+	require.Empty(t, attempt.Error)
+	require.NotNil(t, attempt.GetMiss())
+
+	// The digest of the uploaded archive is recorded to verify the downloads
+	digestBytes, ok := cache.Get(cacheDigestPrefix + "cache-key")
+	require.True(t, ok)
+	var digest cacheDigest
+	require.NoError(t, json.Unmarshal(digestBytes, &digest))
+	archive, ok := cache.Get("cache-key")
+	require.True(t, ok)
+	sum := sha256.Sum256(archive)
+	require.NoError(t, digest.matches(sum[:], int64(len(archive))))
+	require.Empty(t, digest.Signature)
+
+	archivePath := filepath.Join(t.TempDir(), "cache.tar.gz")
+	require.NoError(t, os.WriteFile(archivePath, archive, 0600))
+
+	restoreFolder := t.TempDir()
+	require.NoError(t, targz.Unarchive(archivePath, restoreFolder))
+
+	contents, err := os.ReadFile(filepath.Join(restoreFolder, "cache", "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "snapshotted", string(contents))
+}
+
+func TestBackgroundUploadOfSnapshotExceedingMaxSize(t *testing.T) {
+	var uploads atomic.Int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			uploads.Add(1)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	baseFolder := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(baseFolder, "file.txt"), []byte("contents"), 0600))
+
+	snapshot, err := os.CreateTemp(t.TempDir(), "")
+	require.NoError(t, err)
+	defer snapshot.Close()
+	require.NoError(t, targz.ArchiveUncompressed(baseFolder, []string{baseFolder}, snapshot))
+
+	executor := &Executor{
+		env: environment.New(map[string]string{
+			"CIRRUS_CACHE_MAX_SIZE": "10B",
+		}),
+		cacheAttempts: NewCacheAttempts(),
+	}
+	cache := &Cache{Name: "cache", Key: "cache-key", BaseFolder: baseFolder, CacheAvailable: true}
+
+	for _, chunked := range []bool{false, true} {
+		err = executor.uploadSnapshot(context.Background(), io.Discard, "cache",
+			strings.TrimPrefix(server.URL, "http://"), cache, hasher.New(), snapshot, time.Second, nil, chunked)
+		require.ErrorIs(t, err, errCacheSizeExceeded)
+	}
+	require.Zero(t, uploads.Load())
+	require.Zero(t, executor.cacheSizeBudget.used)
+}
+
+func TestBackgroundUploadOfSnapshotCompressedBelowMaxSize(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+
+	// The limit applies to the compressed size, which is way below the uncompressed one
+	baseFolder := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(baseFolder, "file.txt"), bytes.Repeat([]byte("a"), 64*1024), 0600))
+
+	snapshot, err := os.CreateTemp(t.TempDir(), "")
+	require.NoError(t, err)
+	defer snapshot.Close()
+	require.NoError(t, targz.ArchiveUncompressed(baseFolder, []string{baseFolder}, snapshot))
+
+	executor := &Executor{
+		env: environment.New(map[string]string{
+			"CIRRUS_CACHE_MAX_SIZE": "32KiB",
+		}),
+		cacheAttempts: NewCacheAttempts(),
+	}
+
+	for _, chunked := range []bool{false, true} {
+		uploadedCache := &Cache{Name: "cache", Key: fmt.Sprintf("cache-key-%t", chunked), BaseFolder: baseFolder}
+
+		require.NoError(t, executor.uploadSnapshot(context.Background(), io.Discard, "cache",
+			cache.host, uploadedCache, hasher.New(), snapshot, time.Second, nil, chunked))
+
+		_, ok := cache.Get(uploadedCache.Key)
+		require.True(t, ok)
+	}
+}
@@ -0,0 +1,238 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/dustin/go-humanize"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Number of the largest directories reported for each uploaded cache
+const largestCacheDirectories = 5
+
+// Directories are reported this many levels deep relative to the base
+// folder, which is enough to e.g. tell apart the packages in node_modules
+const cacheDirectoryDepth = 2
+
+var errCacheSizeExceeded = errors.New("cache exceeds the maximum size")
+
+// cacheSizeBudget tracks the size of the caches uploaded by the task so far.
+type cacheSizeBudget struct {
+	mtx  sync.Mutex
+	used uint64
+}
+
+// reserve accounts for the cache that's about to be uploaded, returning
+// the size used so far and false if the cache doesn't fit into the limit.
+func (budget *cacheSizeBudget) reserve(size uint64, limit uint64) (uint64, bool) {
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+
+	if limit != 0 && budget.used+size > limit {
+		return budget.used, false
+	}
+
+	budget.used += size
+
+	return budget.used, true
+}
+
+// release returns the reserved size back to the budget when the upload has failed.
+func (budget *cacheSizeBudget) release(size uint64) {
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+
+	budget.used -= min(size, budget.used)
+}
+
+// parseSizeLimit parses a human-readable size limit (e.g. "500MB"),
+// 0 (which is also returned for invalid values) means no limit.
+func parseSizeLimit(name string, value string, ok bool) uint64 {
+	if !ok || value == "" {
+		return 0
+	}
+
+	limit, err := humanize.ParseBytes(value)
+	if err != nil {
+		logger.Warnf("Ignoring invalid value %q of %s, should be a size like 500MB or 2GiB", value, name)
+
+		return 0
+	}
+
+	return limit
+}
+
+// cacheSizeLimit returns the maximum size of a single cache archive (the MAX_SIZE cache option).
+// Like CIRRUS_TASK_CACHE_MAX_SIZE, it applies to the compressed size that is uploaded, which
+// for the chunked format is the size of the compressed chunks the HTTP cache didn't have yet.
+func cacheSizeLimit(env *environment.Environment, cacheName string) uint64 {
+	value, ok := cacheOption(env, cacheName, "MAX_SIZE")
+
+	return parseSizeLimit("the MAX_SIZE cache option", value, ok)
+}
+
+// taskCacheSizeLimit returns the maximum total size of the caches uploaded by the task.
+func taskCacheSizeLimit(env *environment.Environment) uint64 {
+	value, ok := env.Lookup("CIRRUS_TASK_CACHE_MAX_SIZE")
+
+	return parseSizeLimit("CIRRUS_TASK_CACHE_MAX_SIZE", value, ok)
+}
+
+// reserveCacheSize enforces both the per-cache and the per-task maximum size and returns false
+// with an explanation written to out when the cache should not be uploaded. The reserved size
+// should be released if the upload fails.
+func (executor *Executor) reserveCacheSize(out io.Writer, cacheName string, size uint64) bool {
+	return executor.extendCacheSize(out, cacheName, 0, size)
+}
+
+// extendCacheSize is like reserveCacheSize() for a cache that has already reserved some size.
+func (executor *Executor) extendCacheSize(out io.Writer, cacheName string, reserved uint64, size uint64) bool {
+	if limit := cacheSizeLimit(executor.env, cacheName); limit != 0 && reserved+size > limit {
+		_, _ = fmt.Fprintf(out, "\nSkipping upload of %s cache since its size (%s) exceeds the maximum of %s "+
+			"configured via the MAX_SIZE cache option!", cacheName, humanize.IBytes(reserved+size), humanize.IBytes(limit))
+
+		return false
+	}
+
+	limit := taskCacheSizeLimit(executor.env)
+	if used, ok := executor.cacheSizeBudget.reserve(size, limit); !ok {
+		_, _ = fmt.Fprintf(out, "\nSkipping upload of %s cache since its size (%s) would exceed the maximum of %s "+
+			"for all caches of the task configured via CIRRUS_TASK_CACHE_MAX_SIZE (%s were already uploaded)!",
+			cacheName, humanize.IBytes(reserved+size), humanize.IBytes(limit), humanize.IBytes(used))
+
+		return false
+	}
+
+	return true
+}
+
+// chunkedCacheSize enforces the maximum size while the cache is uploaded in chunks,
+// since the compressed size of the uploaded chunks is not known beforehand.
+type chunkedCacheSize struct {
+	executor  *Executor
+	out       io.Writer
+	cacheName string
+
+	mtx      sync.Mutex
+	reserved uint64
+	exceeded bool
+}
+
+func (executor *Executor) newChunkedCacheSize(out io.Writer, cacheName string) *chunkedCacheSize {
+	return &chunkedCacheSize{
+		executor:  executor,
+		out:       out,
+		cacheName: cacheName,
+	}
+}
+
+// reserve accounts for the chunk that's about to be uploaded,
+// returning errCacheSizeExceeded if it doesn't fit into the limits.
+func (size *chunkedCacheSize) reserve(chunkSize uint64) error {
+	size.mtx.Lock()
+	defer size.mtx.Unlock()
+
+	if size.exceeded {
+		return errCacheSizeExceeded
+	}
+
+	if !size.executor.extendCacheSize(size.out, size.cacheName, size.reserved, chunkSize) {
+		size.exceeded = true
+
+		return errCacheSizeExceeded
+	}
+
+	size.reserved += chunkSize
+
+	return nil
+}
+
+// release returns the reserved size back to the budget when the upload has failed.
+func (size *chunkedCacheSize) release() {
+	size.mtx.Lock()
+	defer size.mtx.Unlock()
+
+	size.executor.cacheSizeBudget.release(size.reserved)
+	size.reserved = 0
+}
+
+type cacheDirectorySize struct {
+	path string
+	size uint64
+}
+
+// reportCacheSize logs the sizes of the cache along with its largest
+// directories, so that it's clear what to exclude from a cache that's too big.
+// The compressed size is 0 when it's not known beforehand (e.g. for the chunked format).
+func reportCacheSize(
+	out io.Writer,
+	cacheName string,
+	fileHasher *hasher.Hasher,
+	compressedSize uint64,
+	compression targz.Compression,
+) {
+	manifest := fileHasher.Manifest()
+
+	var uncompressed uint64
+	directorySizes := map[string]uint64{}
+
+	for _, entry := range manifest {
+		uncompressed += uint64(entry.Size)
+		directorySizes[cacheDirectory(entry.Path)] += uint64(entry.Size)
+	}
+
+	if compressedSize != 0 {
+		_, _ = fmt.Fprintf(out, "\n%s cache size is %s (%s), %s uncompressed (%.1fx compression ratio) in %d files.",
+			cacheName, humanize.IBytes(compressedSize), compression, humanize.IBytes(uncompressed),
+			float64(uncompressed)/float64(compressedSize), len(manifest))
+	} else {
+		_, _ = fmt.Fprintf(out, "\n%s cache size is %s uncompressed in %d files.",
+			cacheName, humanize.IBytes(uncompressed), len(manifest))
+	}
+
+	directories := make([]cacheDirectorySize, 0, len(directorySizes))
+	for directory, size := range directorySizes {
+		directories = append(directories, cacheDirectorySize{path: directory, size: size})
+	}
+
+	sort.Slice(directories, func(i, j int) bool {
+		if directories[i].size != directories[j].size {
+			return directories[i].size > directories[j].size
+		}
+
+		return directories[i].path < directories[j].path
+	})
+
+	if len(directories) > largestCacheDirectories {
+		directories = directories[:largestCacheDirectories]
+	}
+
+	if len(directories) < 2 {
+		return
+	}
+
+	_, _ = fmt.Fprintf(out, "\nLargest directories of %s cache (uncompressed):", cacheName)
+
+	for _, directory := range directories {
+		_, _ = fmt.Fprintf(out, "\n%s: %s", directory.path, humanize.IBytes(directory.size))
+	}
+}
+
+// cacheDirectory returns the directory of the file truncated
+// to cacheDirectoryDepth levels relative to the base folder.
+func cacheDirectory(filePath string) string {
+	components := strings.Split(path.Dir(filePath), "/")
+
+	if len(components) > cacheDirectoryDepth {
+		components = components[:cacheDirectoryDepth]
+	}
+
+	return path.Join(components...)
+}
@@ -0,0 +1,127 @@
+package executor
+
+import (
+	"bytes"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReserveCacheSize(t *testing.T) {
+	executor := &Executor{env: environment.New(map[string]string{
+		"CIRRUS_CACHE_GRADLE_MAX_SIZE": "1KB",
+		"CIRRUS_TASK_CACHE_MAX_SIZE":   "3KB",
+	})}
+
+	var logs bytes.Buffer
+
+	// Per-cache limit
+	require.False(t, executor.reserveCacheSize(&logs, "gradle", 1001))
+	require.Contains(t, logs.String(), "exceeds the maximum of 1000 B configured via the MAX_SIZE cache option")
+	require.True(t, executor.reserveCacheSize(&logs, "gradle", 1000))
+
+	// Per-task limit
+	require.True(t, executor.reserveCacheSize(&logs, "maven", 1500))
+	require.False(t, executor.reserveCacheSize(&logs, "cargo", 1000))
+	require.Contains(t, logs.String(), "(2.4 KiB were already uploaded)")
+
+	// Failed uploads don't count towards the limit
+	executor.cacheSizeBudget.release(1500)
+	require.True(t, executor.reserveCacheSize(&logs, "cargo", 1000))
+}
+
+func TestReserveCacheSizeInvalidLimit(t *testing.T) {
+	executor := &Executor{env: environment.New(map[string]string{
+		"CIRRUS_CACHE_MAX_SIZE": "a lot",
+	})}
+
+	require.True(t, executor.reserveCacheSize(&bytes.Buffer{}, "gradle", 1<<40))
+}
+
+func TestChunkedCacheSize(t *testing.T) {
+	executor := &Executor{env: environment.New(map[string]string{
+		"CIRRUS_CACHE_GRADLE_MAX_SIZE": "1KB",
+		"CIRRUS_TASK_CACHE_MAX_SIZE":   "3KB",
+	})}
+
+	var logs bytes.Buffer
+
+	// The chunks are accounted for as they're uploaded
+	gradle := executor.newChunkedCacheSize(&logs, "gradle")
+	require.NoError(t, gradle.reserve(600))
+	require.NoError(t, gradle.reserve(400))
+	require.ErrorIs(t, gradle.reserve(1), errCacheSizeExceeded)
+	require.Contains(t, logs.String(), "exceeds the maximum of 1000 B configured via the MAX_SIZE cache option")
+
+	// The exceeded limit is only reported once
+	logs.Reset()
+	require.ErrorIs(t, gradle.reserve(1), errCacheSizeExceeded)
+	require.Empty(t, logs.String())
+
+	maven := executor.newChunkedCacheSize(&logs, "maven")
+	require.NoError(t, maven.reserve(1500))
+	require.ErrorIs(t, maven.reserve(1000), errCacheSizeExceeded)
+	require.Contains(t, logs.String(), "CIRRUS_TASK_CACHE_MAX_SIZE")
+
+	// Failed uploads don't count towards the limit
+	gradle.release()
+	maven.release()
+	require.Zero(t, executor.cacheSizeBudget.used)
+}
+
+func TestReportCacheSize(t *testing.T) {
+	baseFolder := t.TempDir()
+
+	files := map[string]int{
+		"node_modules/lodash/lodash.js":          4096,
+		"node_modules/lodash/fp/fp.js":           1024,
+		"node_modules/react/index.js":            2048,
+		"node_modules/.package-lock.json":        512,
+		"node_modules/typescript/lib/tsc.js":     8192,
+		"node_modules/typescript/lib/tsserver":   8192,
+		"node_modules/typescript/package.json":   256,
+		"node_modules/left-pad/index.js":         128,
+		"node_modules/is-odd/index.js":           64,
+		"node_modules/is-even/node_modules/a.js": 32,
+	}
+	for name, size := range files {
+		path := filepath.Join(baseFolder, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, make([]byte, size), 0600))
+	}
+
+	fileHasher := hasher.New()
+	require.NoError(t, fileHasher.AddFolder(baseFolder, filepath.Join(baseFolder, "node_modules")))
+
+	var logs bytes.Buffer
+	reportCacheSize(&logs, "node_modules", fileHasher, 4096, "zstd")
+
+	require.Equal(t, "\nnode_modules cache size is 4.0 KiB (zstd), 24 KiB uncompressed (6.0x compression ratio) in 10 files."+
+		"\nLargest directories of node_modules cache (uncompressed):"+
+		"\nnode_modules/typescript: 16 KiB"+
+		"\nnode_modules/lodash: 5.0 KiB"+
+		"\nnode_modules/react: 2.0 KiB"+
+		"\nnode_modules: 512 B"+
+		"\nnode_modules/left-pad: 128 B", logs.String())
+
+	logs.Reset()
+	reportCacheSize(&logs, "node_modules", fileHasher, 0, "")
+	require.Contains(t, logs.String(), "\nnode_modules cache size is 24 KiB uncompressed in 10 files.")
+}
+
+func TestCacheDirectory(t *testing.T) {
+	testCases := map[string]string{
+		"file.txt":                      ".",
+		"node_modules/file.txt":         "node_modules",
+		"node_modules/lodash/lodash.js": "node_modules/lodash",
+		"node_modules/lodash/fp/fp.js":  "node_modules/lodash",
+		"target/debug/deps/libfoo.rlib": "target/debug",
+	}
+
+	for filePath, expected := range testCases {
+		require.Equal(t, expected, cacheDirectory(filePath), filePath)
+	}
+}
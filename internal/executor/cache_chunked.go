@@ -0,0 +1,534 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/chunker"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// In the chunked format, the uncompressed tar archive is split into content-defined
+// chunks, each of which is compressed and stored as an individual cache entry keyed
+// by the hash of its contents. The cache entry under the cache key then only contains
+// an index of the chunks, thus only the chunks that weren't seen before are uploaded.
+const (
+	cacheFormatArchive = "archive"
+	cacheFormatChunked = "chunked"
+
+	chunkKeyPrefix = "cirrus-chunk-"
+
+	maxChunkedIndexSize = 64 * 1024 * 1024
+)
+
+// Distinguishes the index from the archives, which start with the compression's magic bytes
+var chunkedIndexMagic = []byte("cirrus-chunked-cache\n")
+
+type chunkedIndex struct {
+	Chunks []indexedChunk `json:"chunks"`
+}
+
+type indexedChunk struct {
+	// SHA-256 of the uncompressed chunk
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+var (
+	chunkEncoder, _ = zstd.NewWriter(nil)
+	chunkDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(chunker.DefaultMaxSize))
+)
+
+// chunkedFormat returns true if the chunked format is configured
+// for uploading using the FORMAT ("archive" or "chunked") cache option,
+// the format used to download the cache is always auto-detected.
+func chunkedFormat(env *environment.Environment, cacheName string) (bool, error) {
+	value, ok := cacheOption(env, cacheName, "FORMAT")
+	if !ok {
+		return false, nil
+	}
+
+	switch value {
+	case cacheFormatArchive:
+		return false, nil
+	case cacheFormatChunked:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported cache format %q, supported formats are %q and %q",
+			value, cacheFormatArchive, cacheFormatChunked)
+	}
+}
+
+func isChunkedIndex(reader *bufio.Reader) bool {
+	magic, _ := reader.Peek(len(chunkedIndexMagic))
+
+	return bytes.Equal(magic, chunkedIndexMagic)
+}
+
+func chunkURL(cacheHost string, digest string) string {
+	return cacheEntryURL(cacheHost, chunkKeyPrefix+digest)
+}
+
+// uploadChunkedCache uploads the chunks that the HTTP cache doesn't have yet
+// followed by the index and returns true if the index was uploaded.
+func (executor *Executor) uploadChunkedCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cache *Cache,
+	foldersToCache []string,
+	archiveOpts []targz.Option,
+) bool {
+	cacheURL := cacheEntryURL(cacheHost, cache.Key)
+
+	if executor.entryUploadedByOtherTask(ctx, logUploader, cacheURL, cache) {
+		return false
+	}
+
+	logUploader.Write([]byte(fmt.Sprintf("\nUploading cache %s in chunks...", cache.Name)))
+
+	archiveReader, archiveWriter := io.Pipe()
+	go func() {
+		_ = archiveWriter.CloseWithError(targz.ArchiveUncompressed(cache.BaseFolder, foldersToCache,
+			archiveWriter, archiveOpts...))
+	}()
+	// Stops the archiving prematurely in case of an upload failure
+	defer archiveReader.Close()
+
+	size := executor.newChunkedCacheSize(logUploader, cache.Name)
+	stats, err := uploadChunks(ctx, cacheHost, cacheURL, archiveReader, executor.transferConcurrency(commandName),
+		size.reserve)
+	if err != nil {
+		size.release()
+		if !errors.Is(err, errCacheSizeExceeded) {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload cache '%s': %s!", commandName, err)))
+			logUploader.Write([]byte("\nIgnoring the error..."))
+		}
+		return false
+	}
+
+	logUploader.Write([]byte(fmt.Sprintf("\nUploaded %d out of %d unique chunks (%d compressed bytes out of %d uncompressed bytes), "+
+		"the rest are already present in the cache.", stats.uploadedChunks, stats.uniqueChunks, stats.uploadedBytes, stats.totalBytes)))
+
+	executor.cacheAttempts.Miss(cache.Key, uint64(stats.uploadedBytes), stats.archivingDuration, stats.totalDuration)
+
+	executor.recordEntryDigest(ctx, logUploader, commandName, cacheHost, cache.Key, stats.indexDigest, stats.indexSize)
+
+	return true
+}
+
+type chunkedUploadStats struct {
+	uniqueChunks      int
+	uploadedChunks    int64
+	uploadedBytes     int64
+	totalBytes        int64
+	archivingDuration time.Duration
+	totalDuration     time.Duration
+	// Digest and size of the index, which is the entry stored under the cache key
+	indexDigest []byte
+	indexSize   int64
+}
+
+// uploadChunks splits the uncompressed tar archive into chunks, uploads
+// the chunks that the HTTP cache doesn't have yet and then the index.
+// The compressed size of each chunk is reserved before uploading it.
+func uploadChunks(
+	ctx context.Context,
+	cacheHost string,
+	cacheURL string,
+	archive io.Reader,
+	concurrency int,
+	reserve func(size uint64) error,
+) (*chunkedUploadStats, error) {
+	startTime := time.Now()
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(max(concurrency, 1))
+
+	var index chunkedIndex
+	var totalBytes int64
+	var uploadedChunks, uploadedBytes atomic.Int64
+	var chunkingErr error
+	seen := map[string]struct{}{}
+
+	chunks := chunker.New(archive)
+
+	for groupCtx.Err() == nil {
+		chunk, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			chunkingErr = fmt.Errorf("failed to archive: %w", err)
+			break
+		}
+
+		digestBytes := sha256.Sum256(chunk)
+		digest := hex.EncodeToString(digestBytes[:])
+
+		index.Chunks = append(index.Chunks, indexedChunk{Digest: digest, Size: int64(len(chunk))})
+		totalBytes += int64(len(chunk))
+
+		if _, ok := seen[digest]; ok {
+			continue
+		}
+		seen[digest] = struct{}{}
+
+		group.Go(func() error {
+			compressed := chunkEncoder.EncodeAll(chunk, nil)
+
+			// The existing chunks are only reused when they have the expected size,
+			// so that e.g. a truncated or an unrelated entry gets replaced
+			size, exists, err := chunkEntrySize(groupCtx, chunkURL(cacheHost, digest))
+			if err != nil || (exists && size == int64(len(compressed))) {
+				return err
+			}
+
+			if reserve != nil {
+				if err := reserve(uint64(len(compressed))); err != nil {
+					return err
+				}
+			}
+
+			if err := postCacheEntry(groupCtx, chunkURL(cacheHost, digest), compressed); err != nil {
+				return fmt.Errorf("failed to upload chunk %s: %w", digest, err)
+			}
+
+			uploadedChunks.Add(1)
+			uploadedBytes.Add(int64(len(compressed)))
+
+			return nil
+		})
+	}
+	archivingDuration := time.Since(startTime)
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	if chunkingErr != nil {
+		return nil, chunkingErr
+	}
+
+	indexBytes, err := json.Marshal(&index)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index is uploaded last, so that it only references the chunks that were uploaded
+	indexEntry := append(bytes.Clone(chunkedIndexMagic), indexBytes...)
+	if err := postCacheEntry(ctx, cacheURL, indexEntry); err != nil {
+		return nil, err
+	}
+	indexDigest := sha256.Sum256(indexEntry)
+
+	return &chunkedUploadStats{
+		uniqueChunks:      len(seen),
+		uploadedChunks:    uploadedChunks.Load(),
+		uploadedBytes:     uploadedBytes.Load(),
+		totalBytes:        totalBytes,
+		archivingDuration: archivingDuration,
+		totalDuration:     time.Since(startTime),
+		indexDigest:       indexDigest[:],
+		indexSize:         int64(len(indexEntry)),
+	}, nil
+}
+
+// downloadChunkedCache downloads the chunks referenced by the index and extracts them on the fly.
+func (executor *Executor) downloadChunkedCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	indexReader io.Reader,
+	folderToCache string,
+) (bool, bool) { // successfully populated, available remotely
+	startTime := time.Now()
+
+	index, err := readChunkedIndex(indexReader)
+	if err != nil {
+		message := fmt.Sprintf("failed to read the index of %s cache: %v", commandName, err)
+		executor.cacheAttempts.Failed(cacheKey, message)
+		logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss: %s!", message)))
+		return false, true
+	}
+
+	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nCache hit for %s (%d chunks)!", cacheKey, len(index.Chunks))))
+
+	EnsureFolderExists(folderToCache)
+	downloadedBytes, downloadedAt, err := restoreChunks(ctx, cacheHost, index, folderToCache,
+		executor.transferConcurrency(commandName), metadataOptions(executor.env, commandName)...)
+	var integrityErr *chunkIntegrityError
+	if errors.As(err, &integrityErr) {
+		// The corrupted chunk would break every cache that references it, so delete it as well
+		logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss: %s cache is corrupted: %v! Cleaning up %s...\n",
+			commandName, err, folderToCache)))
+		os.RemoveAll(folderToCache)
+		executor.discardCorruptedEntry(ctx, logUploader, commandName, cacheHost, cacheKey, err)
+		if executor.canReplaceCacheEntries() {
+			if err := deleteCacheEntry(ctx, chunkURL(cacheHost, integrityErr.digest)); err != nil {
+				logUploader.Write([]byte(fmt.Sprintf("\nFailed to delete corrupted chunk %s of %s cache: %v",
+					integrityErr.digest, commandName, err)))
+			}
+		}
+		return false, false
+	}
+	if err != nil {
+		message := fmt.Sprintf("failed to restore chunked %s cache: %v", commandName, err)
+		executor.cacheAttempts.Failed(cacheKey, message)
+		logUploader.Write([]byte(fmt.Sprintf("\nTreating this failure as a cache miss but won't try to re-upload: %s! Cleaning up %s...\n", message, folderToCache)))
+		os.RemoveAll(folderToCache)
+		return false, true
+	}
+
+	// The extraction finishes after all the chunks are written to the pipe
+	unarchiveDuration := time.Since(startTime)
+	downloadDuration := downloadedAt.Sub(startTime)
+
+	logDownloadedBytes(logUploader, downloadedBytes, downloadDuration)
+	if unarchiveDuration > 10*time.Second {
+		logUploader.Write([]byte(fmt.Sprintf("\nUnarchived %s cache entry in %f seconds!\n", commandName, unarchiveDuration.Seconds())))
+	}
+
+	// The chunks are compressed individually with zstd
+	executor.cacheAttempts.Hit(cacheKey, uint64(downloadedBytes), targz.CompressionZstd, downloadDuration,
+		unarchiveDuration)
+
+	return true, true
+}
+
+// restoreChunks extracts the chunks as they're being downloaded and returns
+// the number of compressed bytes downloaded and when the download has finished.
+func restoreChunks(
+	ctx context.Context,
+	cacheHost string,
+	index *chunkedIndex,
+	folderToCache string,
+	concurrency int,
+	opts ...targz.Option,
+) (int64, time.Time, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var downloadedBytes atomic.Int64
+	var downloadedAt time.Time
+
+	var fetchErr error
+	fetched := make(chan struct{})
+
+	archiveReader, archiveWriter := io.Pipe()
+	go func() {
+		defer close(fetched)
+
+		fetchErr = fetchChunks(ctx, cacheHost, index.Chunks, concurrency, archiveWriter, &downloadedBytes)
+		downloadedAt = time.Now()
+		_ = archiveWriter.CloseWithError(fetchErr)
+	}()
+
+	// The archive is consumed until EOF, i.e. until all the chunks are fetched
+	err := targz.UnarchiveUncompressed(archiveReader, folderToCache, opts...)
+	_ = archiveReader.CloseWithError(err)
+	cancel()
+	<-fetched
+
+	// Prefer the download errors, the extraction only fails as a consequence of them
+	var integrityErr *chunkIntegrityError
+	if errors.As(fetchErr, &integrityErr) {
+		return 0, time.Time{}, integrityErr
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return downloadedBytes.Load(), downloadedAt, nil
+}
+
+func readChunkedIndex(reader io.Reader) (*chunkedIndex, error) {
+	magic := make([]byte, len(chunkedIndexMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, chunkedIndexMagic) {
+		return nil, fmt.Errorf("not a chunked cache index")
+	}
+
+	var index chunkedIndex
+
+	if err := json.NewDecoder(io.LimitReader(reader, maxChunkedIndexSize)).Decode(&index); err != nil {
+		return nil, err
+	}
+
+	for _, chunk := range index.Chunks {
+		if chunk.Size < 0 || chunk.Size > chunker.DefaultMaxSize {
+			return nil, fmt.Errorf("chunk %s has invalid size %d", chunk.Digest, chunk.Size)
+		}
+	}
+
+	return &index, nil
+}
+
+// chunkIntegrityError is returned when the downloaded chunk doesn't match its digest.
+type chunkIntegrityError struct {
+	digest string
+	err    error
+}
+
+func (err *chunkIntegrityError) Error() string {
+	if err.err != nil {
+		return fmt.Sprintf("chunk %s is corrupted: %v", err.digest, err.err)
+	}
+
+	return fmt.Sprintf("chunk %s is corrupted", err.digest)
+}
+
+func (err *chunkIntegrityError) Is(target error) bool {
+	return target == errCacheDigestMismatch
+}
+
+type fetchedChunk struct {
+	data []byte
+	err  error
+}
+
+// fetchChunks concurrently downloads the chunks and writes them in order,
+// keeping no more than concurrency chunks in memory.
+func fetchChunks(
+	ctx context.Context,
+	cacheHost string,
+	chunks []indexedChunk,
+	concurrency int,
+	w io.Writer,
+	downloadedBytes *atomic.Int64,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan fetchedChunk, len(chunks))
+	for i := range results {
+		results[i] = make(chan fetchedChunk, 1)
+	}
+
+	slots := make(chan struct{}, max(concurrency, 1))
+
+	go func() {
+		for i, chunk := range chunks {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			go func() {
+				data, err := fetchChunk(ctx, cacheHost, chunk, downloadedBytes)
+				results[i] <- fetchedChunk{data: data, err: err}
+			}()
+		}
+	}()
+
+	for i := range chunks {
+		var result fetchedChunk
+
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-slots
+
+		if result.err != nil {
+			return result.err
+		}
+
+		if _, err := w.Write(result.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fetchChunk(ctx context.Context, cacheHost string, chunk indexedChunk, downloadedBytes *atomic.Int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, chunkURL(cacheHost, chunk.Digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch chunk %s: %s", chunk.Digest, resp.Status)
+	}
+
+	compressed, err := io.ReadAll(io.LimitReader(resp.Body, 2*chunker.DefaultMaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunk %s: %w", chunk.Digest, err)
+	}
+	downloadedBytes.Add(int64(len(compressed)))
+
+	data, err := chunkDecoder.DecodeAll(compressed, make([]byte, 0, chunk.Size))
+	if err != nil {
+		return nil, &chunkIntegrityError{digest: chunk.Digest, err: err}
+	}
+
+	digest := sha256.Sum256(data)
+	if int64(len(data)) != chunk.Size || hex.EncodeToString(digest[:]) != chunk.Digest {
+		return nil, &chunkIntegrityError{digest: chunk.Digest}
+	}
+
+	return data, nil
+}
+
+// chunkEntrySize returns the size of the chunk entry and whether it exists.
+func chunkEntrySize(ctx context.Context, entryURL string) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, entryURL, nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	_ = resp.Body.Close()
+
+	return resp.ContentLength, resp.StatusCode == http.StatusOK, nil
+}
+
+func postCacheEntry(ctx context.Context, entryURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, entryURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad response status from HTTP cache %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkedFormat(t *testing.T) {
+	env := environment.New(map[string]string{
+		"CIRRUS_CACHE_GRADLE_FORMAT": "chunked",
+		"CIRRUS_CACHE_CARGO_FORMAT":  "tarball",
+	})
+
+	chunked, err := chunkedFormat(env, "gradle")
+	require.NoError(t, err)
+	require.True(t, chunked)
+
+	chunked, err = chunkedFormat(env, "node_modules")
+	require.NoError(t, err)
+	require.False(t, chunked)
+
+	_, err = chunkedFormat(env, "cargo")
+	require.Error(t, err)
+}
+
+func TestChunkedUploadAndRestore(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+	cacheHost := cache.host
+	ctx := context.Background()
+
+	// Populate a cache folder with incompressible data that spans multiple chunks
+	baseFolder := t.TempDir()
+	cacheFolder := filepath.Join(baseFolder, "cache")
+	require.NoError(t, os.Mkdir(cacheFolder, 0700))
+	for i := 0; i < 4; i++ {
+		contents := make([]byte, 3*1024*1024)
+		rand.New(rand.NewSource(int64(i))).Read(contents)
+		require.NoError(t, os.WriteFile(filepath.Join(cacheFolder, string(rune('a'+i))+".bin"), contents, 0600))
+	}
+
+	upload := func(key string) *chunkedUploadStats {
+		cache.TakeUploads()
+
+		var archive bytes.Buffer
+		require.NoError(t, targz.ArchiveUncompressed(baseFolder, []string{cacheFolder}, &archive))
+
+		stats, err := uploadChunks(ctx, cacheHost, "http://"+cacheHost+"/"+key, &archive, 4, nil)
+		require.NoError(t, err)
+
+		// The index is always uploaded last
+		uploads := cache.TakeUploads()
+		require.Equal(t, key, uploads[len(uploads)-1])
+
+		return stats
+	}
+
+	firstStats := upload("first")
+	require.Greater(t, firstStats.uniqueChunks, 4)
+	require.EqualValues(t, firstStats.uniqueChunks, firstStats.uploadedChunks)
+
+	// Append to one of the files, which should only result in a few new chunks
+	file, err := os.OpenFile(filepath.Join(cacheFolder, "d.bin"), os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString("appended")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	secondStats := upload("second")
+	require.Less(t, secondStats.uploadedChunks, int64(secondStats.uniqueChunks)/2)
+
+	// Restore the second entry
+	indexBytes, ok := cache.Get("second")
+	require.True(t, ok)
+	indexReader := bufio.NewReader(bytes.NewReader(indexBytes))
+	require.True(t, isChunkedIndex(indexReader))
+	index, err := readChunkedIndex(indexReader)
+	require.NoError(t, err)
+
+	restoreFolder := t.TempDir()
+	downloadedBytes, _, err := restoreChunks(ctx, cacheHost, index, restoreFolder, 4)
+	require.NoError(t, err)
+	require.Greater(t, downloadedBytes, int64(0))
+
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		expected, err := os.ReadFile(filepath.Join(cacheFolder, name))
+		require.NoError(t, err)
+		actual, err := os.ReadFile(filepath.Join(restoreFolder, "cache", name))
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	// A corrupted chunk is reported as such
+	corruptedKey := chunkKeyPrefix + index.Chunks[len(index.Chunks)/2].Digest
+	chunk, ok := cache.Get(corruptedKey)
+	require.True(t, ok)
+	cache.Set(corruptedKey, chunkEncoder.EncodeAll([]byte("corrupted"), nil))
+
+	_, _, err = restoreChunks(ctx, cacheHost, index, t.TempDir(), 4)
+	var integrityErr *chunkIntegrityError
+	require.ErrorAs(t, err, &integrityErr)
+	require.ErrorIs(t, err, errCacheDigestMismatch)
+	require.Equal(t, index.Chunks[len(index.Chunks)/2].Digest, integrityErr.digest)
+
+	// ...and is replaced by the next upload instead of being reused
+	upload("third")
+	replaced, ok := cache.Get(corruptedKey)
+	require.True(t, ok)
+	require.Equal(t, chunk, replaced)
+
+	// A missing chunk fails the restoration
+	cache.Delete(corruptedKey)
+
+	_, _, err = restoreChunks(ctx, cacheHost, index, t.TempDir(), 4)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errCacheDigestMismatch)
+}
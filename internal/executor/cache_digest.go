@@ -0,0 +1,377 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Each cache entry uploaded by the agent is accompanied by a digest entry that records
+// the SHA-256 digest and the size of the entry, which allows to detect the truncated
+// and corrupted downloads. The digest is signed when the task has a signing key.
+const cacheDigestPrefix = "cirrus-digest-"
+
+const maxCacheDigestSize = 64 * 1024
+
+var (
+	errCacheDigestInvalid  = errors.New("cache entry has an invalid digest")
+	errCacheDigestMismatch = errors.New("cache entry doesn't match its digest")
+)
+
+type cacheDigest struct {
+	Key       string `json:"key"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// cacheIntegrityError is returned when the downloaded cache entry
+// doesn't match the digest recorded when it was uploaded.
+type cacheIntegrityError struct {
+	expectedSHA256 string
+	expectedSize   int64
+	actualSHA256   string
+	actualSize     int64
+}
+
+func (err *cacheIntegrityError) Error() string {
+	if err.actualSHA256 == "" {
+		return fmt.Sprintf("expected %d bytes, got more than that", err.expectedSize)
+	}
+
+	return fmt.Sprintf("expected %d bytes with SHA-256 %s, got %d bytes with SHA-256 %s",
+		err.expectedSize, err.expectedSHA256, err.actualSize, err.actualSHA256)
+}
+
+func (err *cacheIntegrityError) Is(target error) bool {
+	return target == errCacheDigestMismatch
+}
+
+// matches checks that the downloaded entry is the one that was uploaded.
+func (digest *cacheDigest) matches(sum []byte, size int64) error {
+	actualSHA256 := hex.EncodeToString(sum)
+
+	if digest.SHA256 != actualSHA256 || digest.Size != size {
+		return &cacheIntegrityError{
+			expectedSHA256: digest.SHA256,
+			expectedSize:   digest.Size,
+			actualSHA256:   actualSHA256,
+			actualSize:     size,
+		}
+	}
+
+	return nil
+}
+
+func cacheDigestURL(cacheHost string, cacheKey string) string {
+	return cacheEntryURL(cacheHost, cacheDigestPrefix+cacheKey)
+}
+
+// fetchCacheDigest returns the digest of the cache entry or nil if the entry
+// has no digest (e.g. it was uploaded by an older agent).
+func fetchCacheDigest(ctx context.Context, cacheHost string, cacheKey string) (*cacheDigest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cacheDigestURL(cacheHost, cacheKey), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	var digest cacheDigest
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxCacheDigestSize)).Decode(&digest); err != nil {
+		return nil, fmt.Errorf("%w: %v", errCacheDigestInvalid, err)
+	}
+
+	return &digest, nil
+}
+
+func uploadCacheDigest(ctx context.Context, cacheHost string, digest *cacheDigest) error {
+	digestBytes, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+
+	return postCacheEntry(ctx, cacheDigestURL(cacheHost, digest.Key), digestBytes)
+}
+
+// entryDigest fetches the digest of the cache entry before it's downloaded and verifies
+// its signature when the signatures are enforced, returning false if the entry should
+// be treated as a cache miss. The digest is nil when there's nothing to verify against.
+func (executor *Executor) entryDigest(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+) (*cacheDigest, bool) {
+	digest, err := fetchCacheDigest(ctx, cacheHost, cacheKey)
+
+	if executor.cacheSigner != nil {
+		if err == nil {
+			err = executor.cacheSigner.verify(cacheKey, digest)
+		}
+		if err != nil {
+			message := fmt.Sprintf("failed to verify the signature of %s cache: %v", commandName, err)
+			executor.cacheAttempts.Failed(cacheKey, message)
+			logUploader.Write([]byte(fmt.Sprintf("\nTreating %s as a cache miss: %s!", cacheKey, message)))
+
+			return nil, false
+		}
+
+		return digest, true
+	}
+
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to fetch the digest of %s cache, won't verify its integrity: %v",
+			commandName, err)))
+
+		return nil, true
+	}
+
+	if digest != nil && digest.Key != cacheKey {
+		return nil, true
+	}
+
+	return digest, true
+}
+
+// recordEntryDigest uploads the digest of the cache entry, signing it if the task has a signing key.
+func (executor *Executor) recordEntryDigest(
+	ctx context.Context,
+	logUploader io.Writer,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	sum []byte,
+	size int64,
+) {
+	digest := &cacheDigest{
+		Key:    cacheKey,
+		SHA256: hex.EncodeToString(sum),
+		Size:   size,
+	}
+
+	if executor.cacheSigner.canSign() {
+		executor.cacheSigner.sign(digest)
+	}
+
+	if err := uploadCacheDigest(ctx, cacheHost, digest); err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to upload the digest of %s cache: %v", commandName, err)))
+	}
+}
+
+// recordFileDigest uploads the digest of the cache archive.
+func (executor *Executor) recordFileDigest(
+	ctx context.Context,
+	logUploader io.Writer,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	cachePath string,
+) {
+	sum, size, err := fileDigest(cachePath)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to calculate the digest of %s cache: %v", commandName, err)))
+		return
+	}
+
+	executor.recordEntryDigest(ctx, logUploader, commandName, cacheHost, cacheKey, sum, size)
+}
+
+// fileDigest returns the SHA-256 digest and the size of the file.
+func fileDigest(path string) ([]byte, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return hash.Sum(nil), size, nil
+}
+
+// verifyingReader verifies the cache entry against its digest while it's being read,
+// the mismatch is reported instead of io.EOF (or as soon as the entry turns out to be
+// larger than expected).
+type verifyingReader struct {
+	r      io.Reader
+	digest *cacheDigest
+	hash   hash.Hash
+	n      int64
+	err    error
+}
+
+func newVerifyingReader(r io.Reader, digest *cacheDigest) *verifyingReader {
+	return &verifyingReader{
+		r:      r,
+		digest: digest,
+		hash:   sha256.New(),
+	}
+}
+
+func (reader *verifyingReader) Read(p []byte) (int, error) {
+	if reader.err != nil {
+		return 0, reader.err
+	}
+
+	n, err := reader.r.Read(p)
+	if reader.digest == nil {
+		return n, err
+	}
+
+	reader.hash.Write(p[:n])
+	reader.n += int64(n)
+
+	if reader.n > reader.digest.Size {
+		reader.err = &cacheIntegrityError{expectedSHA256: reader.digest.SHA256, expectedSize: reader.digest.Size}
+
+		return n, reader.err
+	}
+
+	if errors.Is(err, io.EOF) {
+		if mismatch := reader.digest.matches(reader.hash.Sum(nil), reader.n); mismatch != nil {
+			reader.err = mismatch
+
+			return n, reader.err
+		}
+	}
+
+	return n, err
+}
+
+// integrityError returns the mismatch between the entry and its digest, if any was detected so far.
+func (reader *verifyingReader) integrityError() error {
+	var integrityErr *cacheIntegrityError
+
+	if errors.As(reader.err, &integrityErr) {
+		return integrityErr
+	}
+
+	return nil
+}
+
+// finish reads the rest of the entry (e.g. the padding after the end
+// of the archive) and returns the mismatch, if any.
+func (reader *verifyingReader) finish() error {
+	if reader.digest == nil {
+		return nil
+	}
+
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return err
+	}
+
+	return reader.integrityError()
+}
+
+// corruptedCacheEntries tracks the cache entries that failed the integrity check.
+type corruptedCacheEntries struct {
+	mtx  sync.Mutex
+	keys map[string]struct{}
+}
+
+func (entries *corruptedCacheEntries) add(cacheKey string) {
+	entries.mtx.Lock()
+	defer entries.mtx.Unlock()
+
+	if entries.keys == nil {
+		entries.keys = map[string]struct{}{}
+	}
+
+	entries.keys[cacheKey] = struct{}{}
+}
+
+func (entries *corruptedCacheEntries) contains(cacheKey string) bool {
+	entries.mtx.Lock()
+	defer entries.mtx.Unlock()
+
+	_, ok := entries.keys[cacheKey]
+
+	return ok
+}
+
+// discardCorruptedEntry records the failed integrity check and discards the corrupted cache entry,
+// so that the next tasks don't download the same bytes again.
+func (executor *Executor) discardCorruptedEntry(
+	ctx context.Context,
+	logUploader io.Writer,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	err error,
+) {
+	executor.cacheAttempts.IntegrityFailed(cacheKey, err)
+	executor.discardCacheEntry(ctx, logUploader, commandName, cacheHost, cacheKey)
+}
+
+// discardCacheEntry deletes the unusable cache entry along with its digest. The entry is then
+// re-uploaded by UploadCache() even if it still exists because the deletion has failed.
+func (executor *Executor) discardCacheEntry(
+	ctx context.Context,
+	logUploader io.Writer,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+) {
+	executor.corruptedCacheEntries.add(cacheKey)
+
+	if !executor.canReplaceCacheEntries() {
+		return
+	}
+
+	for _, key := range []string{cacheKey, cacheDigestPrefix + cacheKey} {
+		if err := deleteCacheEntry(ctx, cacheEntryURL(cacheHost, key)); err != nil {
+			logUploader.Write([]byte(fmt.Sprintf("\nFailed to delete unusable entry %s of %s cache: %v",
+				key, commandName, err)))
+		}
+	}
+}
+
+// canReplaceCacheEntries returns whether the task is allowed to upload the caches, only such
+// tasks delete the unusable cache entries, since otherwise nothing would replace them.
+func (executor *Executor) canReplaceCacheEntries() bool {
+	return !executor.httpCacheReadOnly && (executor.cacheSigner == nil || executor.cacheSigner.canSign())
+}
+
+func deleteCacheEntry(ctx context.Context, entryURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, entryURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("bad response status from HTTP cache %d: %s", resp.StatusCode, resp.Status)
+	}
+
+	return nil
+}
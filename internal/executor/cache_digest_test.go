@@ -0,0 +1,111 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	entry := []byte("cache entry contents")
+	sum := sha256.Sum256(entry)
+	digest := &cacheDigest{Key: "key", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(entry))}
+
+	corrupted := bytes.Clone(entry)
+	corrupted[0] = 'C'
+
+	testCases := []struct {
+		Name     string
+		Contents []byte
+		Digest   *cacheDigest
+		Corrupt  bool
+	}{
+		{"intact", entry, digest, false},
+		{"no digest", corrupted, nil, false},
+		{"corrupted", corrupted, digest, true},
+		{"truncated", entry[:len(entry)-1], digest, true},
+		{"oversized", append(bytes.Clone(entry), '!'), digest, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			reader := newVerifyingReader(iotest.OneByteReader(bytes.NewReader(testCase.Contents)), testCase.Digest)
+
+			contents, err := io.ReadAll(reader)
+
+			if !testCase.Corrupt {
+				require.NoError(t, err)
+				require.Equal(t, testCase.Contents, contents)
+				require.NoError(t, reader.integrityError())
+				require.NoError(t, reader.finish())
+
+				return
+			}
+
+			require.ErrorIs(t, err, errCacheDigestMismatch)
+			require.ErrorIs(t, reader.integrityError(), errCacheDigestMismatch)
+			require.ErrorIs(t, reader.finish(), errCacheDigestMismatch)
+		})
+	}
+}
+
+func TestVerifyingReaderFinish(t *testing.T) {
+	entry := []byte("archive and the padding after it")
+	sum := sha256.Sum256(entry)
+	digest := &cacheDigest{Key: "key", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(entry))}
+
+	// The consumer may stop before the end of the entry
+	reader := newVerifyingReader(bytes.NewReader(entry), digest)
+	_, err := io.ReadFull(reader, make([]byte, 7))
+	require.NoError(t, err)
+	require.NoError(t, reader.finish())
+
+	corrupted := bytes.Clone(entry)
+	corrupted[len(corrupted)-1] = '?'
+	reader = newVerifyingReader(bytes.NewReader(corrupted), digest)
+	_, err = io.ReadFull(reader, make([]byte, 7))
+	require.NoError(t, err)
+	require.ErrorIs(t, reader.finish(), errCacheDigestMismatch)
+}
+
+func TestDiscardCorruptedEntry(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+	ctx := context.Background()
+
+	executor := &Executor{
+		env:           environment.New(map[string]string{}),
+		cacheAttempts: NewCacheAttempts(),
+	}
+
+	cache.Set("key", []byte("corrupted"))
+	cache.Set(cacheDigestPrefix+"key", []byte("digest"))
+	cache.Set("other-key", []byte("archive"))
+
+	executor.discardCorruptedEntry(ctx, io.Discard, "cache", cache.host, "key", errors.New("mismatch"))
+
+	_, ok := cache.Get("key")
+	require.False(t, ok)
+	_, ok = cache.Get(cacheDigestPrefix + "key")
+	require.False(t, ok)
+	require.Contains(t, executor.cacheAttempts.ToProto()["key"].Error, "integrity check failed")
+
+	// The corrupted entry is replaced even if some other task has uploaded it in the meantime
+	cache.Set("key", []byte("corrupted"))
+	require.False(t, executor.entryUploadedByOtherTask(ctx, io.Discard, cacheEntryURL(cache.host, "key"),
+		&Cache{Key: "key"}))
+	require.True(t, executor.entryUploadedByOtherTask(ctx, io.Discard, cacheEntryURL(cache.host, "other-key"),
+		&Cache{Key: "other-key"}))
+
+	// The tasks that can't upload the replacement leave the entry be
+	executor.httpCacheReadOnly = true
+	executor.discardCorruptedEntry(ctx, io.Discard, "cache", cache.host, "other-key", errors.New("mismatch"))
+	_, ok = cache.Get("other-key")
+	require.True(t, ok)
+}
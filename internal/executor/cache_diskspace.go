@@ -0,0 +1,164 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bmatcuk/doublestar"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+	"github.com/dustin/go-humanize"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// diskSpaceCheckEnabled returns whether the free disk space should be checked before the cache
+// operations (the DISK_SPACE_CHECK cache option), which is opt-in since the check costs an extra
+// request per download and the extracted size of a cache is not known beforehand anyway.
+func (executor *Executor) diskSpaceCheckEnabled(cacheName string) bool {
+	value, ok := cacheOption(executor.env, cacheName, "DISK_SPACE_CHECK")
+	if !ok {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Warnf("Ignoring invalid value %q of the DISK_SPACE_CHECK cache option, should be either true or false",
+			value)
+
+		return false
+	}
+
+	return enabled
+}
+
+// ensureDiskSpace checks that the file system containing path has the required number of bytes
+// available and evicts the cleanup paths (the CLEANUP_PATHS cache option) if it doesn't. Returns
+// false when there's still not enough free disk space, in which case the operation should be
+// skipped instead of failing midway.
+func (executor *Executor) ensureDiskSpace(
+	logUploader io.Writer,
+	cacheName string,
+	operation string,
+	path string,
+	required uint64,
+) bool {
+	if required == 0 || !executor.diskSpaceCheckEnabled(cacheName) {
+		return true
+	}
+
+	path = existingAncestor(path)
+
+	usage, err := getDiskUsage(path)
+	if err != nil {
+		// Don't get in the way on the platforms where the disk usage is not available
+		return true
+	}
+	if usage.available >= required {
+		return true
+	}
+
+	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nNot enough free disk space on %s to %s %s cache: %s needed, %s!",
+		path, operation, cacheName, humanize.IBytes(required), usage)))
+
+	cleanupPaths := cacheOptionList(executor.env, cacheName, "CLEANUP_PATHS")
+	if len(cleanupPaths) == 0 {
+		return false
+	}
+
+	evictCleanupPaths(logUploader, cleanupPaths)
+
+	usage, err = getDiskUsage(path)
+	if err != nil || usage.available < required {
+		_, _ = logUploader.Write([]byte(fmt.Sprintf("\nStill not enough free disk space after the cleanup: %s needed, %s!",
+			humanize.IBytes(required), usage)))
+
+		return false
+	}
+
+	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nFreed enough disk space: %s.", usage)))
+
+	return true
+}
+
+// evictAfterNoSpaceFailure evicts the cleanup paths (the CLEANUP_PATHS cache option) when
+// the cache operation has failed because the disk is full, so that the retry has a chance
+// to succeed. This happens regardless of the DISK_SPACE_CHECK cache option.
+func (executor *Executor) evictAfterNoSpaceFailure(logUploader io.Writer, cacheName string, err error) {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return
+	}
+
+	cleanupPaths := cacheOptionList(executor.env, cacheName, "CLEANUP_PATHS")
+	if len(cleanupPaths) == 0 {
+		return
+	}
+
+	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nRan out of disk space while restoring %s cache!", cacheName)))
+
+	evictCleanupPaths(logUploader, cleanupPaths)
+}
+
+// skipCacheForDiskSpace treats the cache as a miss that shouldn't be re-uploaded, since the entry exists.
+func (executor *Executor) skipCacheForDiskSpace(logUploader io.Writer, cacheName string, cacheKey string) (bool, bool) {
+	executor.cacheAttempts.Failed(cacheKey, fmt.Sprintf("not enough free disk space for %s cache", cacheName))
+	_, _ = logUploader.Write([]byte(fmt.Sprintf("\nSkipping %s cache and treating it as a cache miss!\n", cacheName)))
+
+	return false, true
+}
+
+// evictCleanupPaths removes the files and folders matching the cleanup paths,
+// which are expected to only contain the data that's safe to lose.
+func evictCleanupPaths(logUploader io.Writer, cleanupPaths []string) {
+	for _, cleanupPath := range cleanupPaths {
+		matches := []string{cleanupPath}
+
+		if pathLooksLikeGlob(cleanupPath) {
+			var err error
+
+			matches, err = doublestar.Glob(cleanupPath)
+			if err != nil {
+				_, _ = logUploader.Write([]byte(fmt.Sprintf("\nCannot expand cleanup path glob '%s': %v", cleanupPath, err)))
+				continue
+			}
+		}
+
+		for _, match := range matches {
+			_, _ = logUploader.Write([]byte(fmt.Sprintf("\nRemoving %s to free up disk space...", match)))
+
+			if err := os.RemoveAll(match); err != nil {
+				_, _ = logUploader.Write([]byte(fmt.Sprintf("\nFailed to remove %s: %v", match, err)))
+			}
+		}
+	}
+}
+
+// existingAncestor returns the path itself or its closest existing ancestor,
+// since the cache folders are only created when the cache is extracted.
+func existingAncestor(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+
+		path = parent
+	}
+}
+
+// uncompressedSize returns the total size of the hashed files,
+// which is the upper bound of the size of the archive made from them.
+func uncompressedSize(fileHasher *hasher.Hasher) uint64 {
+	var result uint64
+
+	for _, entry := range fileHasher.Manifest() {
+		result += uint64(entry.Size)
+	}
+
+	return result
+}
@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestEnsureDiskSpace(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" && runtime.GOOS != "windows" {
+		t.Skip("disk usage is not available on this platform")
+	}
+
+	cacheFolder := filepath.Join(t.TempDir(), "not", "yet", "created")
+
+	executor := &Executor{env: environment.New(map[string]string{
+		"CIRRUS_CACHE_DISK_SPACE_CHECK": "true",
+	})}
+
+	var logs bytes.Buffer
+	require.True(t, executor.ensureDiskSpace(&logs, "cache", "extract", cacheFolder, 1))
+	require.Empty(t, logs.String())
+
+	require.False(t, executor.ensureDiskSpace(&logs, "cache", "extract", cacheFolder, math.MaxUint64))
+	require.Contains(t, logs.String(), "Not enough free disk space")
+	require.Contains(t, logs.String(), "% used")
+
+	// The check can be disabled for a particular cache
+	executor.env = environment.New(map[string]string{
+		"CIRRUS_CACHE_DISK_SPACE_CHECK":       "true",
+		"CIRRUS_CACHE_CACHE_DISK_SPACE_CHECK": "false",
+	})
+	require.True(t, executor.ensureDiskSpace(&logs, "cache", "extract", cacheFolder, math.MaxUint64))
+
+	// ...and is disabled by default
+	executor.env = environment.New(map[string]string{})
+	require.True(t, executor.ensureDiskSpace(&logs, "cache", "extract", cacheFolder, math.MaxUint64))
+}
+
+func TestEnsureDiskSpaceEvictsCleanupPaths(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" && runtime.GOOS != "windows" {
+		t.Skip("disk usage is not available on this platform")
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"first.log", "second.log", "keep.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("contents"), 0600))
+	}
+
+	executor := &Executor{env: environment.New(map[string]string{
+		"CIRRUS_CACHE_DISK_SPACE_CHECK": "true",
+		"CIRRUS_CACHE_CLEANUP_PATHS":    filepath.Join(dir, "*.log"),
+	})}
+
+	var logs bytes.Buffer
+	require.False(t, executor.ensureDiskSpace(&logs, "cache", "archive", dir, math.MaxUint64))
+	require.Contains(t, logs.String(), "Still not enough free disk space after the cleanup")
+
+	require.NoFileExists(t, filepath.Join(dir, "first.log"))
+	require.NoFileExists(t, filepath.Join(dir, "second.log"))
+	require.FileExists(t, filepath.Join(dir, "keep.txt"))
+}
+
+func TestEvictAfterNoSpaceFailure(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "build.log"), []byte("contents"), 0600))
+
+	executor := &Executor{env: environment.New(map[string]string{
+		"CIRRUS_CACHE_CLEANUP_PATHS": filepath.Join(dir, "*.log"),
+	})}
+
+	var logs bytes.Buffer
+
+	// Only the failures caused by the full disk trigger the cleanup
+	executor.evictAfterNoSpaceFailure(&logs, "cache", errors.New("unexpected EOF"))
+	require.FileExists(t, filepath.Join(dir, "build.log"))
+
+	executor.evictAfterNoSpaceFailure(&logs, "cache", fmt.Errorf("file.bin: writing file: %w",
+		&os.PathError{Op: "write", Path: "file.bin", Err: syscall.ENOSPC}))
+	require.NoFileExists(t, filepath.Join(dir, "build.log"))
+	require.Contains(t, logs.String(), "Ran out of disk space while restoring cache cache")
+}
+
+func TestExistingAncestor(t *testing.T) {
+	dir := t.TempDir()
+
+	require.Equal(t, dir, existingAncestor(dir))
+	require.Equal(t, dir, existingAncestor(filepath.Join(dir, "a", "b")))
+}
+
+func TestDiskUsageString(t *testing.T) {
+	usage := diskUsage{available: 256 * 1024 * 1024, total: 1024 * 1024 * 1024}
+
+	require.Equal(t, "256 MiB available out of 1.0 GiB, 75% used", usage.String())
+}
@@ -0,0 +1,63 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/rangedownload"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutReader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+
+		if r.URL.Path == "/stalled" {
+			<-r.Context().Done()
+
+			return
+		}
+
+		// Takes longer than the idle timeout in total, but the data keeps arriving
+		for i := 0; i < 5; i++ {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = w.Write([]byte("-next"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	errStalled := errors.New("stalled")
+
+	open := func(path string) io.ReadCloser {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		body, err := rangedownload.Open(ctx, cacheDownloadHTTPClient, server.URL+path, 1, rangedownload.DefaultPartSize)
+		require.NoError(t, err)
+
+		return newIdleTimeoutReader(body, cancel, 150*time.Millisecond, errStalled)
+	}
+
+	body := open("/slow")
+	first := make([]byte, 5)
+	_, err := io.ReadFull(body, first)
+	require.NoError(t, err)
+
+	// A slow consumer doesn't trip the timeout
+	time.Sleep(300 * time.Millisecond)
+
+	rest, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.Equal(t, "first-next-next-next-next-next", string(first)+string(rest))
+	require.NoError(t, body.Close())
+
+	body = open("/stalled")
+	_, err = io.ReadAll(body)
+	require.ErrorIs(t, err, errStalled)
+	require.NoError(t, body.Close())
+}
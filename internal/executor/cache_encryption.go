@@ -0,0 +1,63 @@
+package executor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"io"
+)
+
+// loadCacheEncryptionKey returns the key used to encrypt the cache entries, which is derived from
+// the CIRRUS_CACHE_ENCRYPTION_KEY secret (that can also be a VAULT[...] value), or nil if the
+// encryption is not enabled.
+//
+// The built-in HTTP cache encrypts all the entries passing through it, including the ones
+// uploaded by the build tools. When using an external HTTP cache, only the cache archives
+// are encrypted by the agent itself.
+func loadCacheEncryptionKey(env *environment.Environment) (*cachecrypt.Key, error) {
+	secret, ok := env.Lookup("CIRRUS_CACHE_ENCRYPTION_KEY")
+	if !ok || secret == "" {
+		return nil, nil
+	}
+
+	// Make sure that the secret never leaks into the logs
+	env.AddSensitiveValues(secret)
+
+	key, err := cachecrypt.NewKey(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIRRUS_CACHE_ENCRYPTION_KEY: %w", err)
+	}
+
+	return key, nil
+}
+
+type decryptedBody struct {
+	*bufio.Reader
+	decrypted io.Closer
+	body      io.Closer
+}
+
+func (body *decryptedBody) Close() error {
+	_ = body.decrypted.Close()
+
+	return body.body.Close()
+}
+
+// decryptCacheBody decrypts the downloaded cache entry, the key is verified
+// upfront, so that nothing gets extracted from the entries encrypted with
+// a different key.
+func decryptCacheBody(body io.ReadCloser, encryptionKey *cachecrypt.Key) (io.ReadCloser, error) {
+	decrypted := cachecrypt.NewDecryptingReader(body, encryptionKey)
+	reader := bufio.NewReader(decrypted)
+
+	if _, err := reader.Peek(1); err != nil && !errors.Is(err, io.EOF) {
+		_ = decrypted.Close()
+		_ = body.Close()
+
+		return nil, err
+	}
+
+	return &decryptedBody{Reader: reader, decrypted: decrypted, body: body}, nil
+}
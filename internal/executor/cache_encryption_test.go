@@ -0,0 +1,71 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCacheEncryptionKey(t *testing.T) {
+	key, err := loadCacheEncryptionKey(environment.New(map[string]string{}))
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	_, err = loadCacheEncryptionKey(environment.New(map[string]string{
+		"CIRRUS_CACHE_ENCRYPTION_KEY": "short",
+	}))
+	require.ErrorIs(t, err, cachecrypt.ErrWeakSecret)
+
+	env := environment.New(map[string]string{
+		"CIRRUS_CACHE_ENCRYPTION_KEY": "0123456789abcdef0123456789abcdef",
+	})
+	key, err = loadCacheEncryptionKey(env)
+	require.NoError(t, err)
+	require.NotNil(t, key)
+	require.Contains(t, env.SensitiveValues(), "0123456789abcdef0123456789abcdef")
+}
+
+func TestEncryptedCacheRoundTrip(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+	cacheHost := cache.host
+	ctx := context.Background()
+
+	key, err := cachecrypt.NewKey("0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+	otherKey, err := cachecrypt.NewKey("fedcba9876543210fedcba9876543210")
+	require.NoError(t, err)
+
+	archive := strings.Repeat("generated credentials\n", 10000)
+	archivePath := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, os.WriteFile(archivePath, []byte(archive), 0600))
+
+	cacheFile, err := os.Open(archivePath)
+	require.NoError(t, err)
+	defer cacheFile.Close()
+
+	require.NoError(t, UploadCacheFile(ctx, "http://"+cacheHost+"/key", cacheFile, key))
+	encrypted, ok := cache.Get("key")
+	require.True(t, ok)
+	require.True(t, cachecrypt.IsEncrypted(encrypted))
+	require.NotContains(t, string(encrypted), "generated credentials")
+
+	body, err := openCache(ctx, logger.WithField("test", t.Name()), "cache", cacheHost, "key", 1, key)
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.Equal(t, archive, string(decrypted))
+
+	_, err = openCache(ctx, logger.WithField("test", t.Name()), "cache", cacheHost, "key", 1, otherKey)
+	require.ErrorIs(t, err, cachecrypt.ErrKeyMismatch)
+
+	cache.Set("plaintext", []byte(archive))
+	_, err = openCache(ctx, logger.WithField("test", t.Name()), "cache", cacheHost, "plaintext", 1, key)
+	require.ErrorIs(t, err, cachecrypt.ErrNotEncrypted)
+}
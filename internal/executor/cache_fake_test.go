@@ -0,0 +1,104 @@
+package executor
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeHTTPCache is an in-memory implementation of the HTTP cache protocol.
+type fakeHTTPCache struct {
+	host string
+
+	mtx     sync.Mutex
+	entries map[string][]byte
+	uploads []string
+}
+
+func newFakeHTTPCache(t *testing.T) *fakeHTTPCache {
+	cache := &fakeHTTPCache{
+		entries: map[string][]byte{},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(cache.serveHTTP))
+	t.Cleanup(server.Close)
+
+	cache.host = strings.TrimPrefix(server.URL, "http://")
+
+	return cache
+}
+
+func (cache *fakeHTTPCache) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		entry, ok := cache.Get(key)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry)))
+		_, _ = w.Write(entry)
+	case http.MethodPost, http.MethodPut:
+		entry, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		cache.mtx.Lock()
+		cache.entries[key] = entry
+		cache.uploads = append(cache.uploads, key)
+		cache.mtx.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		cache.Delete(key)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (cache *fakeHTTPCache) Get(key string) ([]byte, bool) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	entry, ok := cache.entries[key]
+
+	return entry, ok
+}
+
+func (cache *fakeHTTPCache) Set(key string, entry []byte) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	cache.entries[key] = entry
+}
+
+func (cache *fakeHTTPCache) Delete(key string) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	delete(cache.entries, key)
+}
+
+// TakeUploads returns the keys of the entries uploaded since the last call.
+func (cache *fakeHTTPCache) TakeUploads() []string {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	uploads := cache.uploads
+	cache.uploads = nil
+
+	return uploads
+}
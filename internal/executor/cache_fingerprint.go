@@ -0,0 +1,128 @@
+package executor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/bmatcuk/doublestar"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fingerprintFiles hashes the contents of the files matching the FINGERPRINT_FILES
+// cache option globs (in sorted path order) and the FINGERPRINT_EXTRA cache option
+// strings, which is a declarative and OS-independent alternative to the
+// "cat package-lock.json"-style fingerprint scripts.
+//
+// Returns the matched files and false if neither of the options is set. It's an error
+// when the globs don't match any files, since the cache key would otherwise stay the
+// same regardless of the changes to the files that were meant to be fingerprinted.
+func fingerprintFiles(
+	env *environment.Environment,
+	cacheName string,
+	cacheKeyHash hash.Hash,
+) ([]string, bool, error) {
+	globs := cacheOptionList(env, cacheName, "FINGERPRINT_FILES")
+	extras := cacheOptionList(env, cacheName, "FINGERPRINT_EXTRA")
+
+	if len(globs) == 0 && len(extras) == 0 {
+		return nil, false, nil
+	}
+
+	workingDir := env.Get("CIRRUS_WORKING_DIR")
+
+	var matches []string
+
+	for _, glob := range globs {
+		if !filepath.IsAbs(glob) && workingDir != "" {
+			glob = filepath.Join(workingDir, glob)
+		}
+
+		globMatches, err := doublestar.Glob(glob)
+		if err != nil {
+			return nil, false, fmt.Errorf("cannot expand fingerprint glob '%s': %w", glob, err)
+		}
+
+		for _, match := range globMatches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if info.Mode().IsRegular() {
+				matches = append(matches, match)
+			}
+		}
+	}
+
+	if len(globs) != 0 && len(matches) == 0 {
+		return nil, false, fmt.Errorf("none of the fingerprint globs (%s) matched any files",
+			strings.Join(globs, ", "))
+	}
+
+	sort.Strings(matches)
+	matches = dedupSorted(matches)
+
+	for _, match := range matches {
+		// Use a relative path, so that the fingerprint doesn't depend on the working directory location
+		relativePath := match
+		if workingDir != "" {
+			if rel, err := filepath.Rel(workingDir, match); err == nil {
+				relativePath = filepath.ToSlash(rel)
+			}
+		}
+
+		cacheKeyHash.Write([]byte(relativePath))
+		cacheKeyHash.Write([]byte{0})
+
+		if err := hashFile(cacheKeyHash, match); err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, extra := range extras {
+		cacheKeyHash.Write([]byte(extra))
+		cacheKeyHash.Write([]byte{0})
+	}
+
+	return matches, true, nil
+}
+
+// hashFile hashes the file size followed by its contents, so that the boundaries
+// between the consecutive files are unambiguous.
+func hashFile(h hash.Hash, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(h, binary.BigEndian, uint64(info.Size())); err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(h, file, info.Size())
+
+	return err
+}
+
+func dedupSorted(paths []string) []string {
+	var result []string
+
+	for i, path := range paths {
+		if i == 0 || paths[i-1] != path {
+			result = append(result, path)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,97 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprintFiles(t *testing.T) {
+	fingerprint := func(workingDir string, extra string) (string, []string) {
+		env := environment.New(map[string]string{
+			"CIRRUS_WORKING_DIR":                          workingDir,
+			"CIRRUS_CACHE_NODE_MODULES_FINGERPRINT_FILES": "**/package-lock.json, package-lock.json",
+			"CIRRUS_CACHE_NODE_MODULES_FINGERPRINT_EXTRA": extra,
+		})
+
+		h := sha256.New()
+		matches, ok, err := fingerprintFiles(env, "node_modules", h)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		return fmt.Sprintf("%x", h.Sum(nil)), matches
+	}
+
+	populate := func(dir string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "package-lock.json"), []byte("root"), 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "package-lock.json"), []byte("sub"), 0600))
+	}
+
+	firstDir := t.TempDir()
+	populate(firstDir)
+	secondDir := t.TempDir()
+	populate(secondDir)
+
+	firstFingerprint, matches := fingerprint(firstDir, "linux")
+	require.Equal(t, []string{
+		filepath.Join(firstDir, "package-lock.json"),
+		filepath.Join(firstDir, "sub", "package-lock.json"),
+	}, matches)
+
+	// The fingerprint doesn't depend on the working directory location
+	secondFingerprint, _ := fingerprint(secondDir, "linux")
+	require.Equal(t, firstFingerprint, secondFingerprint)
+
+	// ...but depends on the extra strings
+	extraFingerprint, _ := fingerprint(firstDir, "darwin")
+	require.NotEqual(t, firstFingerprint, extraFingerprint)
+
+	// ...and on the file contents
+	require.NoError(t, os.WriteFile(filepath.Join(firstDir, "sub", "package-lock.json"), []byte("changed"), 0600))
+	changedFingerprint, _ := fingerprint(firstDir, "linux")
+	require.NotEqual(t, firstFingerprint, changedFingerprint)
+}
+
+func TestFingerprintFilesBoundaries(t *testing.T) {
+	fingerprint := func(first string, second string) string {
+		workingDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(workingDir, "a"), []byte(first), 0600))
+		require.NoError(t, os.WriteFile(filepath.Join(workingDir, "b"), []byte(second), 0600))
+
+		env := environment.New(map[string]string{
+			"CIRRUS_WORKING_DIR":                  workingDir,
+			"CIRRUS_CACHE_DEPS_FINGERPRINT_FILES": "a, b",
+		})
+
+		h := sha256.New()
+		_, _, err := fingerprintFiles(env, "deps", h)
+		require.NoError(t, err)
+
+		return fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	// Moving the bytes between the files changes the fingerprint,
+	// even when they look like the second file's path
+	require.NotEqual(t, fingerprint("x", "b\x00y"), fingerprint("xb\x00", "y"))
+}
+
+func TestFingerprintFilesNoMatches(t *testing.T) {
+	env := environment.New(map[string]string{
+		"CIRRUS_WORKING_DIR":                          t.TempDir(),
+		"CIRRUS_CACHE_NODE_MODULES_FINGERPRINT_FILES": "**/package-lock.json",
+	})
+
+	_, _, err := fingerprintFiles(env, "node_modules", sha256.New())
+	require.ErrorContains(t, err, "matched any files")
+}
+
+func TestFingerprintFilesNotConfigured(t *testing.T) {
+	_, ok, err := fingerprintFiles(environment.NewEmpty(), "node_modules", sha256.New())
+	require.NoError(t, err)
+	require.False(t, ok)
+}
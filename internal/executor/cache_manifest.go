@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+	"io"
+	"net/http"
+)
+
+// Each uploaded cache entry is accompanied by a manifest entry that records
+// the hashes, sizes and modification times of the cached files. Since the
+// modification times are preserved when unarchiving, the manifest allows to
+// avoid re-hashing the restored files and, subsequently, the files that
+// haven't changed by the time the cache is uploaded.
+const cacheManifestPrefix = "cirrus-manifest-"
+
+const maxCacheManifestSize = 512 * 1024 * 1024
+
+func cacheManifestURL(cacheHost string, cacheKey string) string {
+	return cacheEntryURL(cacheHost, cacheManifestPrefix+cacheKey)
+}
+
+// fetchCacheManifest returns the manifest of the cache entry or nil
+// if the entry has no manifest (e.g. it was uploaded by an older agent).
+func fetchCacheManifest(ctx context.Context, cacheHost string, cacheKey string) (hasher.Manifest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cacheManifestURL(cacheHost, cacheKey), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	manifest, err := hasher.ReadManifest(io.LimitReader(resp.Body, maxCacheManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the manifest of cache entry %s: %w", cacheKey, err)
+	}
+
+	return manifest, nil
+}
+
+func uploadCacheManifest(ctx context.Context, cacheHost string, cacheKey string, manifest hasher.Manifest) error {
+	var buf bytes.Buffer
+
+	if _, err := manifest.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cacheManifestURL(cacheHost, cacheKey), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad response status from HTTP cache when uploading the manifest: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/rangedownload"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"strconv"
+	"strings"
+)
+
+// cacheOption looks up a cache-specific behavioral environment variable
+// (e.g. CIRRUS_CACHE_NODE_MODULES_COMPRESSION for the "node_modules" cache)
+// and falls back to the task-wide one (e.g. CIRRUS_CACHE_COMPRESSION).
+func cacheOption(env *environment.Environment, cacheName string, option string) (string, bool) {
+	if value, ok := env.Lookup(fmt.Sprintf("CIRRUS_CACHE_%s_%s", normalizeCacheName(cacheName), option)); ok {
+		return value, true
+	}
+
+	return env.Lookup(fmt.Sprintf("CIRRUS_CACHE_%s", option))
+}
+
+// cacheOptionList splits the cache option's value by newlines or commas (except for
+// the commas inside the braces, e.g. "**/{build,out}/**") and expands the environment
+// variables in each item.
+func cacheOptionList(env *environment.Environment, cacheName string, option string) []string {
+	value, ok := cacheOption(env, cacheName, option)
+	if !ok {
+		return nil
+	}
+
+	var result []string
+
+	for _, item := range splitCacheOptionList(value) {
+		item = strings.TrimSpace(env.ExpandText(item))
+		if item == "" {
+			continue
+		}
+
+		result = append(result, item)
+	}
+
+	return result
+}
+
+func splitCacheOptionList(value string) []string {
+	var result []string
+	var depth, start int
+
+	for i, r := range value {
+		switch {
+		case r == '{':
+			depth++
+		case r == '}' && depth > 0:
+			depth--
+		case r == '\n':
+			// Unbalanced braces don't affect the next lines
+			depth = 0
+
+			fallthrough
+		case r == ',' && depth == 0:
+			result = append(result, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(result, value[start:])
+}
+
+func normalizeCacheName(cacheName string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, strings.ToUpper(cacheName))
+}
+
+// archiveOptions configures the cache archive compression using the
+// COMPRESSION ("gzip" or "zstd"), COMPRESSION_LEVEL and COMPRESSION_CONCURRENCY
+// cache options, the compression used to download the cache is always
+// auto-detected, so changing these options doesn't invalidate the caches.
+func archiveOptions(env *environment.Environment, cacheName string) ([]targz.Option, targz.Compression, error) {
+	compression := targz.CompressionGzip
+
+	if value, ok := cacheOption(env, cacheName, "COMPRESSION"); ok {
+		var err error
+
+		compression, err = targz.ParseCompression(value)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	opts := []targz.Option{targz.WithCompression(compression)}
+
+	if value, ok := cacheOption(env, cacheName, "COMPRESSION_LEVEL"); ok {
+		level, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid compression level %q: %w", value, err)
+		}
+
+		opts = append(opts, targz.WithLevel(level))
+	}
+
+	if value, ok := cacheOption(env, cacheName, "COMPRESSION_CONCURRENCY"); ok {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			return nil, "", fmt.Errorf("invalid compression concurrency %q, should be a positive integer", value)
+		}
+
+		opts = append(opts, targz.WithConcurrency(concurrency))
+	}
+
+	opts = append(opts, metadataOptions(env, cacheName)...)
+
+	return opts, compression, nil
+}
+
+// metadataOptions configures whether the extended attributes and the ownership of the
+// cached files are preserved using the PRESERVE_XATTRS and PRESERVE_OWNERSHIP cache options,
+// the modification times and permissions are always preserved.
+func metadataOptions(env *environment.Environment, cacheName string) []targz.Option {
+	var opts []targz.Option
+
+	if cacheOptionBool(env, cacheName, "PRESERVE_XATTRS") {
+		opts = append(opts, targz.WithXattrs())
+	}
+
+	if cacheOptionBool(env, cacheName, "PRESERVE_OWNERSHIP") {
+		opts = append(opts, targz.WithOwnership())
+	}
+
+	return opts
+}
+
+func cacheOptionBool(env *environment.Environment, cacheName string, option string) bool {
+	value, ok := cacheOption(env, cacheName, option)
+	if !ok {
+		return false
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Warnf("Ignoring invalid value %q of the %s cache option, should be either true or false",
+			value, option)
+
+		return false
+	}
+
+	return result
+}
+
+// transferConcurrency returns the number of concurrent requests used to transfer
+// a single cache entry (the TRANSFER_CONCURRENCY cache option), 1 disables
+// the concurrent transfers altogether.
+func (executor *Executor) transferConcurrency(cacheName string) int {
+	return parseTransferConcurrency(cacheOption(executor.env, cacheName, "TRANSFER_CONCURRENCY"))
+}
+
+func parseTransferConcurrency(value string, ok bool) int {
+	if !ok {
+		return rangedownload.DefaultConcurrency
+	}
+
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		logger.Warnf("Ignoring invalid cache transfer concurrency %q, should be a positive integer", value)
+
+		return rangedownload.DefaultConcurrency
+	}
+
+	return concurrency
+}
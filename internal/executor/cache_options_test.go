@@ -0,0 +1,31 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCacheOptionList(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Value    string
+		Expected []string
+	}{
+		{"commas", "*.log, tmp/**", []string{"*.log", "tmp/**"}},
+		{"newlines", "*.log\ntmp/**\n", []string{"*.log", "tmp/**"}},
+		{"braces", "**/{build,out}/**,*.log", []string{"**/{build,out}/**", "*.log"}},
+		{"nested braces", "{a,{b,c}}/**", []string{"{a,{b,c}}/**"}},
+		{"unbalanced braces", "{a,b\nc,d", []string{"{a,b", "c", "d"}},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			env := environment.New(map[string]string{"CIRRUS_CACHE_EXCLUDE": testCase.Value})
+
+			require.Equal(t, testCase.Expected, cacheOptionList(env, "cache", "EXCLUDE"))
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
+	"golang.org/x/sync/semaphore"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPrefetchConcurrency = 2
+
+	// Prefetching is skipped when it would leave less free disk space
+	// than needed to extract the prefetched archives at a 2:1 ratio
+	prefetchFreeSpaceRatio = 3
+)
+
+// prefetchedCache is a cache entry downloaded ahead of its step.
+type prefetchedCache struct {
+	done          chan struct{}
+	path          string
+	size          int64
+	fetchDuration time.Duration
+}
+
+// cachePrefetcher downloads the caches with keys that are known at the task start
+// into temporary files, so that the cache steps only need to extract them.
+type cachePrefetcher struct {
+	mtx      sync.Mutex
+	caches   map[string]*prefetchedCache
+	reserved int64
+	cancel   context.CancelFunc
+}
+
+// prefetchCaches starts downloading the caches with a static fingerprint key,
+// unless disabled with CIRRUS_CACHE_PREFETCH=false (either task-wide or for
+// a specific cache). The number of concurrent downloads is controlled by
+// CIRRUS_CACHE_PREFETCH_CONCURRENCY.
+//
+// Only the index is prefetched for the caches in the chunked format.
+func (executor *Executor) prefetchCaches(ctx context.Context, commands []*api.Command) {
+	if value, ok := executor.env.Lookup("CIRRUS_CACHE_PREFETCH"); ok {
+		if enabled, err := strconv.ParseBool(value); err == nil && !enabled {
+			return
+		}
+	}
+
+	concurrency := defaultPrefetchConcurrency
+	if value, ok := executor.env.Lookup("CIRRUS_CACHE_PREFETCH_CONCURRENCY"); ok {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			concurrency = parsed
+		} else {
+			logger.Warnf("Ignoring invalid cache prefetch concurrency %q, should be a positive integer", value)
+		}
+	}
+
+	prefetchCtx, cancel := context.WithCancel(ctx)
+	prefetcher := &cachePrefetcher{
+		caches: map[string]*prefetchedCache{},
+		cancel: cancel,
+	}
+	sem := semaphore.NewWeighted(int64(concurrency))
+
+	for _, command := range commands {
+		instruction, ok := command.Instruction.(*api.Command_CacheInstruction)
+		if !ok || instruction.CacheInstruction.FingerprintKey == "" {
+			continue
+		}
+
+		// Caches in the steps that only run on failure or timeout are unlikely to be needed
+		if command.ExecutionBehaviour != api.Command_ON_SUCCESS && command.ExecutionBehaviour != api.Command_ALWAYS {
+			continue
+		}
+
+		if value, ok := cacheOption(executor.env, command.Name, "PREFETCH"); ok {
+			if enabled, err := strconv.ParseBool(value); err == nil && !enabled {
+				continue
+			}
+		}
+
+		// Lookup-only caches are never downloaded
+		if cacheOptionBool(executor.env, command.Name, "LOOKUP_ONLY") {
+			continue
+		}
+
+		// Only the cache of the current scope is prefetched, not the fallback ones. The key is
+		// computed the same way as in DownloadCache(), which uses the environment at the time
+		// of the step, so the prefetched cache is simply not used if the scope has changed since.
+		scopes, err := cacheScopes(executor.env, command.Name)
+		if err != nil {
+			// DownloadCache() doesn't download anything in this case either
+			continue
+		}
+		cacheKey := instruction.CacheInstruction.FingerprintKey
+		if len(scopes) != 0 {
+			cacheKey = scopes[0].key(cacheKey)
+		}
+		if _, ok := prefetcher.caches[cacheKey]; ok {
+			continue
+		}
+
+		prefetched := &prefetchedCache{done: make(chan struct{})}
+		prefetcher.caches[cacheKey] = prefetched
+
+		go func(commandName string) {
+			defer close(prefetched.done)
+
+			if err := sem.Acquire(prefetchCtx, 1); err != nil {
+				return
+			}
+			defer sem.Release(1)
+
+			prefetcher.prefetch(prefetchCtx, commandName, executor.httpCacheHost, cacheKey, prefetched,
+				executor.transferConcurrency(commandName), executor.cacheEncryptionKey)
+		}(command.Name)
+	}
+
+	if len(prefetcher.caches) == 0 {
+		cancel()
+
+		return
+	}
+
+	logger.Infof("Prefetching %d cache(s)...", len(prefetcher.caches))
+
+	executor.prefetcher = prefetcher
+}
+
+func (prefetcher *cachePrefetcher) prefetch(
+	ctx context.Context,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	prefetched *prefetchedCache,
+	concurrency int,
+	encryptionKey *cachecrypt.Key,
+) {
+	prefetchLogger := logger.WithField(agentlog.FieldCommand, commandName)
+
+	size, exists, err := cacheEntrySize(ctx, cacheHost, cacheKey)
+	if err != nil {
+		prefetchLogger.Warnf("Failed to look up %s cache for prefetching: %v", commandName, err)
+		return
+	}
+	if !exists {
+		prefetchLogger.Infof("Not prefetching %s cache since there's no entry for %s", commandName, cacheKey)
+		return
+	}
+
+	if !prefetcher.reserve(size) {
+		prefetchLogger.Warnf("Not prefetching %s cache since there's not enough free disk space for %d bytes",
+			commandName, size)
+		return
+	}
+	defer prefetcher.release(size)
+
+	cacheFile, err := os.CreateTemp(os.TempDir(), commandName)
+	if err != nil {
+		prefetchLogger.Warnf("Failed to create a temp file to prefetch %s cache: %v", commandName, err)
+		return
+	}
+	defer cacheFile.Close()
+
+	downloadStartTime := time.Now()
+
+	respBody, err := openCache(ctx, prefetchLogger, commandName, cacheHost, cacheKey, concurrency, encryptionKey)
+	if err != nil || respBody == nil {
+		_ = os.Remove(cacheFile.Name())
+		return
+	}
+	defer respBody.Close()
+
+	bufferedFileWriter := bufio.NewWriter(cacheFile)
+	bytesDownloaded, err := bufferedFileWriter.ReadFrom(respBody)
+	if err == nil {
+		err = bufferedFileWriter.Flush()
+	}
+	if err != nil {
+		prefetchLogger.Warnf("Failed to prefetch %s cache: %v", commandName, err)
+		_ = os.Remove(cacheFile.Name())
+		return
+	}
+
+	prefetched.path = cacheFile.Name()
+	prefetched.size = bytesDownloaded
+	prefetched.fetchDuration = time.Since(downloadStartTime)
+
+	prefetchLogger.Infof("Prefetched %s cache (%d bytes) in %fs", commandName, bytesDownloaded,
+		prefetched.fetchDuration.Seconds())
+}
+
+// reserve accounts for the disk space needed by a prefetched archive,
+// returning false when there's not enough free disk space left.
+func (prefetcher *cachePrefetcher) reserve(size int64) bool {
+	prefetcher.mtx.Lock()
+	defer prefetcher.mtx.Unlock()
+
+	available, err := availableDiskSpace(os.TempDir())
+	if err == nil && uint64(prefetcher.reserved+size)*prefetchFreeSpaceRatio > available {
+		return false
+	}
+
+	prefetcher.reserved += size
+
+	return true
+}
+
+func (prefetcher *cachePrefetcher) release(size int64) {
+	prefetcher.mtx.Lock()
+	defer prefetcher.mtx.Unlock()
+
+	prefetcher.reserved -= size
+}
+
+// take waits for the cache entry to be prefetched and hands it over to the caller,
+// who becomes responsible for removing the file. Returns nil if the entry wasn't
+// prefetched.
+func (prefetcher *cachePrefetcher) take(ctx context.Context, cacheKey string) *prefetchedCache {
+	if prefetcher == nil {
+		return nil
+	}
+
+	prefetcher.mtx.Lock()
+	prefetched, ok := prefetcher.caches[cacheKey]
+	delete(prefetcher.caches, cacheKey)
+	prefetcher.mtx.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-prefetched.done:
+	case <-ctx.Done():
+		// Let the prefetching goroutine finish in the background, the file
+		// will be cleaned up by Close() since we've failed to take it
+		prefetcher.mtx.Lock()
+		prefetcher.caches[cacheKey] = prefetched
+		prefetcher.mtx.Unlock()
+
+		return nil
+	}
+
+	if prefetched.path == "" {
+		return nil
+	}
+
+	return prefetched
+}
+
+// Close cancels the pending downloads and removes the prefetched caches that were never used.
+func (prefetcher *cachePrefetcher) Close() {
+	if prefetcher == nil {
+		return
+	}
+
+	prefetcher.cancel()
+
+	prefetcher.mtx.Lock()
+	caches := prefetcher.caches
+	prefetcher.caches = map[string]*prefetchedCache{}
+	prefetcher.mtx.Unlock()
+
+	for _, prefetched := range caches {
+		<-prefetched.done
+
+		if prefetched.path != "" {
+			_ = os.Remove(prefetched.path)
+		}
+	}
+}
+
+// cacheEntrySize returns the size of the cache entry (or 0 when unknown) and whether it exists.
+func cacheEntrySize(ctx context.Context, cacheHost string, cacheKey string) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, cacheEntryURL(cacheHost, cacheKey), nil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return max(resp.ContentLength, 0), true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("bad response status from HTTP cache %d: %s", resp.StatusCode, resp.Status)
+	}
+}
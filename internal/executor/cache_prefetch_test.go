@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func cacheCommand(name string, fingerprintKey string, behaviour api.Command_CommandExecutionBehavior) *api.Command {
+	return &api.Command{
+		Name:               name,
+		ExecutionBehaviour: behaviour,
+		Instruction: &api.Command_CacheInstruction{
+			CacheInstruction: &api.CacheInstruction{FingerprintKey: fingerprintKey},
+		},
+	}
+}
+
+func TestPrefetchCaches(t *testing.T) {
+	entries := map[string]string{
+		"gradle-key":  "gradle contents",
+		"cargo-key":   "cargo contents",
+		"unused-key":  "unused contents",
+		"failure-key": "failure contents",
+		"npm-key?#%":  "npm contents",
+		"lookup-key":  "lookup contents",
+	}
+	var downloads atomic.Int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := entries[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			downloads.Add(1)
+		}
+		_, _ = w.Write([]byte(entry))
+	}))
+	defer server.Close()
+
+	executor := &Executor{
+		env: environment.New(map[string]string{
+			"CIRRUS_CACHE_CARGO_PREFETCH":     "false",
+			"CIRRUS_CACHE_LOOKUP_LOOKUP_ONLY": "true",
+		}),
+		cacheAttempts: NewCacheAttempts(),
+		httpCacheHost: strings.TrimPrefix(server.URL, "http://"),
+	}
+
+	executor.prefetchCaches(context.Background(), []*api.Command{
+		cacheCommand("gradle", "gradle-key", api.Command_ON_SUCCESS),
+		cacheCommand("cargo", "cargo-key", api.Command_ON_SUCCESS),
+		cacheCommand("unused", "unused-key", api.Command_ALWAYS),
+		cacheCommand("failure", "failure-key", api.Command_ON_FAILURE),
+		cacheCommand("missing", "missing-key", api.Command_ON_SUCCESS),
+		cacheCommand("dynamic", "", api.Command_ON_SUCCESS),
+		cacheCommand("npm", "npm-key?#%", api.Command_ON_SUCCESS),
+		cacheCommand("lookup", "lookup-key", api.Command_ON_SUCCESS),
+	})
+	require.NotNil(t, executor.prefetcher)
+
+	// The keys are escaped the same way as when downloading them in the cache step
+	prefetched := executor.prefetcher.take(context.Background(), "npm-key?#%")
+	require.NotNil(t, prefetched)
+	require.EqualValues(t, len("npm contents"), prefetched.size)
+	require.NoError(t, os.Remove(prefetched.path))
+
+	prefetched = executor.prefetcher.take(context.Background(), "gradle-key")
+	require.NotNil(t, prefetched)
+	contents, err := os.ReadFile(prefetched.path)
+	require.NoError(t, err)
+	require.Equal(t, "gradle contents", string(contents))
+	require.EqualValues(t, len(contents), prefetched.size)
+	require.NoError(t, os.Remove(prefetched.path))
+
+	// Disabled, lookup-only, not statically known or missing caches are not prefetched
+	for _, cacheKey := range []string{"cargo-key", "lookup-key", "failure-key", "missing-key"} {
+		require.Nil(t, executor.prefetcher.take(context.Background(), cacheKey))
+	}
+
+	// The caches that were never used are cleaned up
+	unused := executor.prefetcher.caches["unused-key"]
+	<-unused.done
+	require.FileExists(t, unused.path)
+	executor.prefetcher.Close()
+	require.NoFileExists(t, unused.path)
+
+	require.EqualValues(t, 3, downloads.Load())
+}
+
+func TestPrefetchCachesDisabled(t *testing.T) {
+	executor := &Executor{
+		env: environment.New(map[string]string{
+			"CIRRUS_CACHE_PREFETCH": "false",
+		}),
+	}
+
+	executor.prefetchCaches(context.Background(), []*api.Command{
+		cacheCommand("gradle", "gradle-key", api.Command_ON_SUCCESS),
+	})
+	require.Nil(t, executor.prefetcher)
+	require.Nil(t, executor.prefetcher.take(context.Background(), "gradle-key"))
+}
@@ -0,0 +1,161 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The HTTP cache protocol has no way to look up the entries by prefix, so each
+// time a cache entry is uploaded, we also upload a small pointer entry for each
+// of the cache's restore keys that the entry's key starts with. The pointer is
+// overwritten by each subsequent upload, thus always pointing to the most
+// recent matching entry.
+const restoreKeyPointerPrefix = "cirrus-restore-key-"
+
+const maxRestoreKeyPointerSize = 64 * 1024
+
+type restoreKeyPointer struct {
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// restoreKeys returns an ordered list of fallback key prefixes
+// configured using the RESTORE_KEYS cache option.
+func restoreKeys(env *environment.Environment, cacheName string) []string {
+	return cacheOptionList(env, cacheName, "RESTORE_KEYS")
+}
+
+// restoreKeyPointerName returns the name of the restore key's pointer within the scope (nil when the
+// caches are not scoped). The pointers are scoped like the cache keys, so that e.g. the caches uploaded
+// by a pull request are only restored by that pull request.
+func restoreKeyPointerName(restoreKey string, scope *cacheScope) string {
+	if scope == nil {
+		return restoreKey
+	}
+
+	return scope.key(restoreKey)
+}
+
+// restoreKeyScopes returns the scopes to resolve the restore keys in, in order of preference,
+// or a single nil scope when the caches are not scoped.
+func restoreKeyScopes(scopes []cacheScope) []*cacheScope {
+	if len(scopes) == 0 {
+		return []*cacheScope{nil}
+	}
+
+	result := make([]*cacheScope, 0, len(scopes))
+	for i := range scopes {
+		result = append(result, &scopes[i])
+	}
+
+	return result
+}
+
+func restoreKeyPointerURL(cacheHost string, pointerName string) string {
+	return cacheEntryURL(cacheHost, restoreKeyPointerPrefix+pointerName)
+}
+
+// resolveRestoreKey returns the key of the most recent cache entry that was uploaded to the scope
+// with the specified restore key, if any. The pointer's signature is verified when the signer
+// is configured.
+func resolveRestoreKey(
+	ctx context.Context,
+	cacheHost string,
+	restoreKey string,
+	scope *cacheScope,
+	signer *cacheSigner,
+) (string, error) {
+	pointerName := restoreKeyPointerName(restoreKey, scope)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, restoreKeyPointerURL(cacheHost, pointerName), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	var pointer restoreKeyPointer
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRestoreKeyPointerSize)).Decode(&pointer); err != nil {
+		return "", fmt.Errorf("failed to parse the pointer for restore key %s: %w", pointerName, err)
+	}
+
+	// Make sure that the pointer wasn't tampered with
+	if !strings.HasPrefix(pointer.Key, restoreKey) {
+		return "", fmt.Errorf("pointer for restore key %s points to a non-matching key %s", pointerName, pointer.Key)
+	}
+	if scope != nil && !scope.contains(pointer.Key) {
+		return "", fmt.Errorf("pointer for restore key %s points to key %s outside of the scope of %s",
+			pointerName, pointer.Key, scope.description)
+	}
+	if signer != nil {
+		if err := signer.verifyPointer(pointerName, &pointer); err != nil {
+			return "", fmt.Errorf("pointer for restore key %s: %w", pointerName, err)
+		}
+	}
+
+	return pointer.Key, nil
+}
+
+// updateRestoreKeyPointers makes the restore keys matching the cache's key point to it within
+// the cache's scope, the pointers are signed when the signer is able to.
+func updateRestoreKeyPointers(ctx context.Context, cacheHost string, cache *Cache, signer *cacheSigner) error {
+	createdAt := time.Now().UTC()
+
+	for _, restoreKey := range cache.RestoreKeys {
+		if !strings.HasPrefix(cache.Key, restoreKey) {
+			continue
+		}
+
+		pointerName := restoreKeyPointerName(restoreKey, cache.Scope)
+
+		pointer := &restoreKeyPointer{
+			Key:       cache.Key,
+			CreatedAt: createdAt,
+		}
+		if signer.canSign() {
+			signer.signPointer(pointerName, pointer)
+		}
+
+		pointerBytes, err := json.Marshal(pointer)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, restoreKeyPointerURL(cacheHost, pointerName),
+			bytes.NewReader(pointerBytes))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("bad response status from HTTP cache when updating restore key %s: %s",
+				pointerName, resp.Status)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRestoreKeys(t *testing.T) {
+	env := environment.New(map[string]string{
+		"CIRRUS_CACHE_RESTORE_KEYS":              "global-",
+		"CIRRUS_CACHE_NODE_MODULES_RESTORE_KEYS": "node-modules-${CIRRUS_OS}-\n, node-modules-",
+		"CIRRUS_OS":                              "linux",
+	})
+
+	require.Equal(t, []string{"node-modules-linux-", "node-modules-"}, restoreKeys(env, "node_modules"))
+	require.Equal(t, []string{"global-"}, restoreKeys(env, "gradle"))
+	require.Empty(t, restoreKeys(environment.NewEmpty(), "gradle"))
+}
+
+func TestRestoreKeyPointers(t *testing.T) {
+	cacheHost := newFakeHTTPCache(t).host
+	ctx := context.Background()
+
+	key, err := resolveRestoreKey(ctx, cacheHost, "node-modules-", nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, key)
+
+	for _, exactKey := range []string{"node-modules-1", "node-modules-2"} {
+		require.NoError(t, updateRestoreKeyPointers(ctx, cacheHost, &Cache{
+			Key:         exactKey,
+			RestoreKeys: []string{"node-modules-", "gradle-"},
+		}, nil))
+	}
+
+	key, err = resolveRestoreKey(ctx, cacheHost, "node-modules-", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "node-modules-2", key)
+
+	// Restore keys that are not a prefix of the uploaded key are left intact
+	key, err = resolveRestoreKey(ctx, cacheHost, "gradle-", nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, key)
+}
+
+func TestScopedRestoreKeyPointers(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+	ctx := context.Background()
+
+	scopes, err := cacheScopes(environment.New(map[string]string{
+		"CIRRUS_CACHE_SCOPE":    "branch",
+		"CIRRUS_PR":             "42",
+		"CIRRUS_DEFAULT_BRANCH": "main",
+	}), "gradle")
+	require.NoError(t, err)
+	pullRequest, defaultBranch := scopes[0], scopes[1]
+
+	require.NoError(t, updateRestoreKeyPointers(ctx, cache.host, &Cache{
+		Key:         defaultBranch.key("gradle-1"),
+		RestoreKeys: []string{"gradle-"},
+		Scope:       &defaultBranch,
+	}, nil))
+
+	// The pull request falls back to the pointers of the default branch
+	key, err := resolveRestoreKey(ctx, cache.host, "gradle-", &pullRequest, nil)
+	require.NoError(t, err)
+	require.Empty(t, key)
+	key, err = lookUpCacheKey(ctx, cache.host, nil, []string{"gradle-"}, scopes, nil)
+	require.NoError(t, err)
+	require.Empty(t, key)
+
+	cache.Set(defaultBranch.key("gradle-1"), []byte("archive"))
+	key, err = lookUpCacheKey(ctx, cache.host, nil, []string{"gradle-"}, scopes, nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultBranch.key("gradle-1"), key)
+
+	// ...and prefers its own ones
+	require.NoError(t, updateRestoreKeyPointers(ctx, cache.host, &Cache{
+		Key:         pullRequest.key("gradle-2"),
+		RestoreKeys: []string{"gradle-"},
+		Scope:       &pullRequest,
+	}, nil))
+	cache.Set(pullRequest.key("gradle-2"), []byte("archive"))
+	key, err = lookUpCacheKey(ctx, cache.host, nil, []string{"gradle-"}, scopes, nil)
+	require.NoError(t, err)
+	require.Equal(t, pullRequest.key("gradle-2"), key)
+
+	// The pointers of the pull request don't affect the default branch nor the unscoped caches
+	key, err = resolveRestoreKey(ctx, cache.host, "gradle-", &defaultBranch, nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultBranch.key("gradle-1"), key)
+	key, err = resolveRestoreKey(ctx, cache.host, "gradle-", nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, key)
+
+	// The pointers can't point outside of their scope
+	pointer, ok := cache.Get(restoreKeyPointerPrefix + restoreKeyPointerName("gradle-", &pullRequest))
+	require.True(t, ok)
+	cache.Set(restoreKeyPointerPrefix+restoreKeyPointerName("gradle-", &defaultBranch), pointer)
+	_, err = resolveRestoreKey(ctx, cache.host, "gradle-", &defaultBranch, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"strings"
+)
+
+// With the branch scope, the caches are uploaded under keys specific to the branch
+// or the pull request, so that they can't replace the caches of the other branches,
+// and the downloads fall back to the caches of the default branch.
+const (
+	cacheScopeGlobal = "global"
+	cacheScopeBranch = "branch"
+)
+
+type cacheScope struct {
+	// Human-readable description, e.g. "branch main" or "pull request #42"
+	description string
+	suffix      string
+}
+
+// key returns the cache key within the scope, the scope is appended to the key
+// so that the restore keys matching the key itself keep matching it.
+func (scope cacheScope) key(cacheKey string) string {
+	return cacheKey + "-" + scope.suffix
+}
+
+// contains returns whether the cache key was scoped to the scope.
+func (scope cacheScope) contains(cacheKey string) bool {
+	return strings.HasSuffix(cacheKey, "-"+scope.suffix)
+}
+
+// cacheScopes returns the scope that the cache is uploaded to followed by the scope of the
+// default branch to fall back to when downloading (the SCOPE cache option, either "global"
+// or "branch"). Returns nil when the caches are not scoped.
+func cacheScopes(env *environment.Environment, cacheName string) ([]cacheScope, error) {
+	value, ok := cacheOption(env, cacheName, "SCOPE")
+	if !ok {
+		return nil, nil
+	}
+
+	switch value {
+	case cacheScopeGlobal:
+		return nil, nil
+	case cacheScopeBranch:
+	default:
+		return nil, fmt.Errorf("unsupported cache scope %q, supported scopes are %q and %q",
+			value, cacheScopeGlobal, cacheScopeBranch)
+	}
+
+	var scopes []cacheScope
+
+	defaultBranch := env.Get("CIRRUS_DEFAULT_BRANCH")
+
+	if pr := env.Get("CIRRUS_PR"); pr != "" {
+		scopes = append(scopes, cacheScope{
+			description: fmt.Sprintf("pull request #%s", pr),
+			suffix:      "pr-" + sanitizeScopeName(pr),
+		})
+	} else if branch := env.Get("CIRRUS_BRANCH"); branch != "" {
+		scopes = append(scopes, branchScope(branch))
+
+		if branch == defaultBranch {
+			return scopes, nil
+		}
+	} else {
+		// Nothing to scope the caches to (e.g. when building a tag)
+		return nil, nil
+	}
+
+	if defaultBranch != "" {
+		scopes = append(scopes, branchScope(defaultBranch))
+	}
+
+	return scopes, nil
+}
+
+func branchScope(branch string) cacheScope {
+	return cacheScope{
+		description: fmt.Sprintf("branch %s", branch),
+		suffix:      "branch-" + sanitizeScopeName(branch),
+	}
+}
+
+// sanitizeScopeName makes the name safe to use in a cache key, the names that had
+// to be changed are suffixed with their hash to avoid collisions (e.g. between
+// the "feature/x" and "feature-x" branches).
+func sanitizeScopeName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+
+		return '-'
+	}, name)
+
+	if sanitized == name {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+
+	return sanitized + "-" + hex.EncodeToString(sum[:4])
+}
@@ -0,0 +1,102 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCacheScopes(t *testing.T) {
+	testCases := []struct {
+		Name         string
+		Env          map[string]string
+		ExpectedKeys []string
+	}{
+		{
+			Name: "not scoped",
+			Env: map[string]string{
+				"CIRRUS_BRANCH":         "feature",
+				"CIRRUS_DEFAULT_BRANCH": "main",
+			},
+		},
+		{
+			Name: "global scope",
+			Env: map[string]string{
+				"CIRRUS_CACHE_SCOPE":    "global",
+				"CIRRUS_BRANCH":         "feature",
+				"CIRRUS_DEFAULT_BRANCH": "main",
+			},
+		},
+		{
+			Name: "feature branch",
+			Env: map[string]string{
+				"CIRRUS_CACHE_SCOPE":    "branch",
+				"CIRRUS_BRANCH":         "feature",
+				"CIRRUS_DEFAULT_BRANCH": "main",
+			},
+			ExpectedKeys: []string{"key-branch-feature", "key-branch-main"},
+		},
+		{
+			Name: "default branch",
+			Env: map[string]string{
+				"CIRRUS_CACHE_GRADLE_SCOPE": "branch",
+				"CIRRUS_BRANCH":             "main",
+				"CIRRUS_DEFAULT_BRANCH":     "main",
+			},
+			ExpectedKeys: []string{"key-branch-main"},
+		},
+		{
+			Name: "pull request",
+			Env: map[string]string{
+				"CIRRUS_CACHE_SCOPE":    "branch",
+				"CIRRUS_BRANCH":         "pull/42",
+				"CIRRUS_PR":             "42",
+				"CIRRUS_DEFAULT_BRANCH": "main",
+			},
+			ExpectedKeys: []string{"key-pr-42", "key-branch-main"},
+		},
+		{
+			Name: "unsafe branch name",
+			Env: map[string]string{
+				"CIRRUS_CACHE_SCOPE": "branch",
+				"CIRRUS_BRANCH":      "feature/x",
+			},
+			ExpectedKeys: []string{"key-branch-feature-x-217d2bf5"},
+		},
+		{
+			Name: "tag",
+			Env: map[string]string{
+				"CIRRUS_CACHE_SCOPE":    "branch",
+				"CIRRUS_TAG":            "v1.0.0",
+				"CIRRUS_DEFAULT_BRANCH": "main",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			scopes, err := cacheScopes(environment.New(testCase.Env), "gradle")
+			require.NoError(t, err)
+
+			var keys []string
+			for _, scope := range scopes {
+				keys = append(keys, scope.key("key"))
+			}
+
+			require.Equal(t, testCase.ExpectedKeys, keys)
+		})
+	}
+}
+
+func TestCacheScopesInvalid(t *testing.T) {
+	_, err := cacheScopes(environment.New(map[string]string{
+		"CIRRUS_CACHE_SCOPE": "repository",
+	}), "gradle")
+	require.Error(t, err)
+}
+
+func TestSanitizeScopeName(t *testing.T) {
+	require.Equal(t, "release-1.x", sanitizeScopeName("release-1.x"))
+	require.NotEqual(t, sanitizeScopeName("feature/x"), sanitizeScopeName("feature-x"))
+	require.NotEqual(t, sanitizeScopeName("feature/x"), sanitizeScopeName("feature:x"))
+}
@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"time"
+)
+
+// Any task can upload to the HTTP cache, so to prevent the untrusted tasks (e.g. the ones
+// running for the pull requests) from poisoning the caches of the trusted ones, the digests
+// of the entries uploaded by the agent can be signed using an Ed25519 key that is only
+// provided to the trusted tasks.
+var (
+	errCacheSignatureMissing = errors.New("cache entry is not signed")
+	errCacheSignatureInvalid = errors.New("cache entry has an invalid signature")
+)
+
+func signedMessage(digest *cacheDigest) []byte {
+	return []byte(fmt.Sprintf("cirrus-cache-signature-v1\n%s\n%s\n%d", digest.Key, digest.SHA256, digest.Size))
+}
+
+// The restore key pointers are signed too, otherwise they could be
+// redirected to an older (albeit signed) entry matching the restore key
+func signedPointerMessage(pointerName string, pointer *restoreKeyPointer) []byte {
+	return []byte(fmt.Sprintf("cirrus-restore-key-signature-v1\n%s\n%s\n%s", pointerName, pointer.Key,
+		pointer.CreatedAt.UTC().Format(time.RFC3339Nano)))
+}
+
+// cacheSigner signs the cache entries uploaded by the agent and verifies the downloaded ones.
+type cacheSigner struct {
+	// Only provided to the trusted tasks, nil when the task can only verify the signatures
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// loadCacheSigner configures the signing of the cache entries using the base64-encoded
+// Ed25519 private key (or seed) in CIRRUS_CACHE_SIGNING_KEY and the verification using
+// the base64-encoded public key in CIRRUS_CACHE_VERIFICATION_KEY (which defaults to the
+// public part of the signing key). Returns nil if neither is set.
+func loadCacheSigner(env *environment.Environment) (*cacheSigner, error) {
+	signer := &cacheSigner{}
+
+	if value, ok := env.Lookup("CIRRUS_CACHE_SIGNING_KEY"); ok && value != "" {
+		env.AddSensitiveValues(value)
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIRRUS_CACHE_SIGNING_KEY: %w", err)
+		}
+
+		switch len(decoded) {
+		case ed25519.SeedSize:
+			signer.privateKey = ed25519.NewKeyFromSeed(decoded)
+		case ed25519.PrivateKeySize:
+			signer.privateKey = ed25519.PrivateKey(decoded)
+		default:
+			return nil, fmt.Errorf("invalid CIRRUS_CACHE_SIGNING_KEY: expected an Ed25519 seed or a private key, "+
+				"got %d bytes", len(decoded))
+		}
+
+		signer.publicKey = signer.privateKey.Public().(ed25519.PublicKey)
+	}
+
+	if value, ok := env.Lookup("CIRRUS_CACHE_VERIFICATION_KEY"); ok && value != "" {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIRRUS_CACHE_VERIFICATION_KEY: %w", err)
+		}
+
+		if len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid CIRRUS_CACHE_VERIFICATION_KEY: expected an Ed25519 public key, "+
+				"got %d bytes", len(decoded))
+		}
+
+		signer.publicKey = decoded
+	}
+
+	if signer.publicKey == nil {
+		return nil, nil
+	}
+
+	return signer, nil
+}
+
+func (signer *cacheSigner) canSign() bool {
+	return signer != nil && signer.privateKey != nil
+}
+
+func (signer *cacheSigner) sign(digest *cacheDigest) {
+	digest.Signature = ed25519.Sign(signer.privateKey, signedMessage(digest))
+}
+
+func (signer *cacheSigner) verify(cacheKey string, digest *cacheDigest) error {
+	if digest == nil || len(digest.Signature) == 0 {
+		return errCacheSignatureMissing
+	}
+
+	if digest.Key != cacheKey || !ed25519.Verify(signer.publicKey, signedMessage(digest), digest.Signature) {
+		return errCacheSignatureInvalid
+	}
+
+	return nil
+}
+
+func (signer *cacheSigner) signPointer(pointerName string, pointer *restoreKeyPointer) {
+	pointer.Signature = ed25519.Sign(signer.privateKey, signedPointerMessage(pointerName, pointer))
+}
+
+func (signer *cacheSigner) verifyPointer(pointerName string, pointer *restoreKeyPointer) error {
+	if len(pointer.Signature) == 0 {
+		return errCacheSignatureMissing
+	}
+
+	if !ed25519.Verify(signer.publicKey, signedPointerMessage(pointerName, pointer), pointer.Signature) {
+		return errCacheSignatureInvalid
+	}
+
+	return nil
+}
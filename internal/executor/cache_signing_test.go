@@ -0,0 +1,186 @@
+package executor
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLoadCacheSigner(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	signer, err := loadCacheSigner(environment.New(map[string]string{}))
+	require.NoError(t, err)
+	require.Nil(t, signer)
+	require.False(t, signer.canSign())
+
+	env := environment.New(map[string]string{
+		"CIRRUS_CACHE_SIGNING_KEY": base64.StdEncoding.EncodeToString(privateKey.Seed()),
+	})
+	signer, err = loadCacheSigner(env)
+	require.NoError(t, err)
+	require.True(t, signer.canSign())
+	require.Equal(t, publicKey, signer.publicKey)
+	require.Contains(t, env.SensitiveValues(), base64.StdEncoding.EncodeToString(privateKey.Seed()))
+
+	signer, err = loadCacheSigner(environment.New(map[string]string{
+		"CIRRUS_CACHE_VERIFICATION_KEY": base64.StdEncoding.EncodeToString(publicKey),
+	}))
+	require.NoError(t, err)
+	require.False(t, signer.canSign())
+
+	_, err = loadCacheSigner(environment.New(map[string]string{
+		"CIRRUS_CACHE_SIGNING_KEY": base64.StdEncoding.EncodeToString([]byte("too short")),
+	}))
+	require.Error(t, err)
+
+	_, err = loadCacheSigner(environment.New(map[string]string{
+		"CIRRUS_CACHE_VERIFICATION_KEY": "not base64",
+	}))
+	require.Error(t, err)
+}
+
+func TestCacheSignatures(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+	cacheHost := cache.host
+	ctx := context.Background()
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	trusted := &cacheSigner{privateKey: privateKey, publicKey: privateKey.Public().(ed25519.PublicKey)}
+
+	_, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	untrusted := &cacheSigner{privateKey: otherPrivateKey, publicKey: otherPrivateKey.Public().(ed25519.PublicKey)}
+
+	archive := []byte("archive")
+	sum := sha256.Sum256(archive)
+	digest := &cacheDigest{Key: "key", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(archive))}
+
+	// Unsigned entries are rejected
+	fetched, err := fetchCacheDigest(ctx, cacheHost, "key")
+	require.NoError(t, err)
+	require.ErrorIs(t, trusted.verify("key", fetched), errCacheSignatureMissing)
+
+	require.NoError(t, uploadCacheDigest(ctx, cacheHost, digest))
+	fetched, err = fetchCacheDigest(ctx, cacheHost, "key")
+	require.NoError(t, err)
+	require.ErrorIs(t, trusted.verify("key", fetched), errCacheSignatureMissing)
+
+	trusted.sign(digest)
+	require.NoError(t, uploadCacheDigest(ctx, cacheHost, digest))
+
+	fetched, err = fetchCacheDigest(ctx, cacheHost, "key")
+	require.NoError(t, err)
+	require.NoError(t, trusted.verify("key", fetched))
+	require.NoError(t, fetched.matches(sum[:], int64(len(archive))))
+
+	// The signature only covers the signed contents
+	poisonedSum := sha256.Sum256([]byte("poisoned"))
+	require.ErrorIs(t, fetched.matches(poisonedSum[:], int64(len(archive))), errCacheDigestMismatch)
+
+	// The signature can't be reused for a different key
+	require.ErrorIs(t, trusted.verify("other-key", fetched), errCacheSignatureInvalid)
+
+	// The signatures made with a different key are rejected
+	poisoned := &cacheDigest{Key: "key", SHA256: hex.EncodeToString(poisonedSum[:]), Size: 8}
+	untrusted.sign(poisoned)
+	require.NoError(t, uploadCacheDigest(ctx, cacheHost, poisoned))
+	fetched, err = fetchCacheDigest(ctx, cacheHost, "key")
+	require.NoError(t, err)
+	require.ErrorIs(t, trusted.verify("key", fetched), errCacheSignatureInvalid)
+
+	// Malformed digests are rejected too
+	cache.Set(cacheDigestPrefix+"key", []byte("garbage"))
+	_, err = fetchCacheDigest(ctx, cacheHost, "key")
+	require.ErrorIs(t, err, errCacheDigestInvalid)
+}
+
+func TestRestoreKeyPointerSignatures(t *testing.T) {
+	cache := newFakeHTTPCache(t)
+	ctx := context.Background()
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	trusted := &cacheSigner{privateKey: privateKey, publicKey: privateKey.Public().(ed25519.PublicKey)}
+	verifier := &cacheSigner{publicKey: trusted.publicKey}
+
+	_, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	untrusted := &cacheSigner{privateKey: otherPrivateKey, publicKey: otherPrivateKey.Public().(ed25519.PublicKey)}
+
+	update := func(key string, signer *cacheSigner) {
+		require.NoError(t, updateRestoreKeyPointers(ctx, cache.host, &Cache{
+			Key:         key,
+			RestoreKeys: []string{"gradle-"},
+		}, signer))
+	}
+
+	// Signed pointers are accepted
+	update("gradle-1", trusted)
+	key, err := resolveRestoreKey(ctx, cache.host, "gradle-", nil, verifier)
+	require.NoError(t, err)
+	require.Equal(t, "gradle-1", key)
+
+	// Unsigned pointers and the ones signed with a different key are rejected
+	update("gradle-2", nil)
+	_, err = resolveRestoreKey(ctx, cache.host, "gradle-", nil, verifier)
+	require.ErrorIs(t, err, errCacheSignatureMissing)
+
+	update("gradle-3", untrusted)
+	_, err = resolveRestoreKey(ctx, cache.host, "gradle-", nil, verifier)
+	require.ErrorIs(t, err, errCacheSignatureInvalid)
+
+	// ...but still work when the signatures are not verified
+	key, err = resolveRestoreKey(ctx, cache.host, "gradle-", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "gradle-3", key)
+
+	// The signature can't be reused for a different restore key
+	update("gradle-4", trusted)
+	pointer, ok := cache.Get(restoreKeyPointerPrefix + "gradle-")
+	require.True(t, ok)
+	cache.Set(restoreKeyPointerPrefix+"gradle", pointer)
+	_, err = resolveRestoreKey(ctx, cache.host, "gradle", nil, verifier)
+	require.ErrorIs(t, err, errCacheSignatureInvalid)
+
+	upload := func(key string, signer *cacheSigner) {
+		archive := []byte("archive")
+		sum := sha256.Sum256(archive)
+		digest := &cacheDigest{Key: key, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(archive))}
+		if signer != nil {
+			signer.sign(digest)
+		}
+
+		cache.Set(key, archive)
+		require.NoError(t, uploadCacheDigest(ctx, cache.host, digest))
+	}
+
+	// Forged pointers are skipped when looking up the cache
+	upload("gradle-4", trusted)
+	key, err = lookUpCacheKey(ctx, cache.host, []string{"gradle-5"}, []string{"gradle", "gradle-"}, nil, verifier)
+	require.NoError(t, err)
+	require.Equal(t, "gradle-4", key)
+
+	// ...and so are the entries that would be rejected when downloading them
+	upload("gradle-5", nil)
+	upload("gradle-6", untrusted)
+	key, err = lookUpCacheKey(ctx, cache.host, []string{"gradle-5", "gradle-6"}, nil, nil, verifier)
+	require.NoError(t, err)
+	require.Empty(t, key)
+
+	key, err = lookUpCacheKey(ctx, cache.host, []string{"gradle-5", "gradle-6"}, nil, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "gradle-5", key)
+
+	update("gradle-6", trusted)
+	key, err = lookUpCacheKey(ctx, cache.host, nil, []string{"gradle-"}, nil, verifier)
+	require.NoError(t, err)
+	require.Empty(t, key)
+}
@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
+	"strconv"
+)
+
+// exportCacheStatus makes the outcome of the cache restoration available to the subsequent
+// scripts as CIRRUS_CACHE_<NAME>_HIT ("true" or "false") and CIRRUS_CACHE_<NAME>_RESTORED_KEY
+// (the key of the restored cache entry, empty on a cache miss).
+func exportCacheStatus(env *environment.Environment, cacheName string, restoredKey string) {
+	prefix := fmt.Sprintf("CIRRUS_CACHE_%s_", normalizeCacheName(cacheName))
+
+	env.Set(prefix+"HIT", strconv.FormatBool(restoredKey != ""))
+	env.Set(prefix+"RESTORED_KEY", restoredKey)
+}
+
+// lookUpCache only checks whether the cache entry, its fallback entries (e.g. the ones
+// of the default branch) or one of its restore keys exists without downloading anything
+// (the LOOKUP_ONLY cache option), since nothing is restored, the cache is never uploaded either.
+func (executor *Executor) lookUpCache(
+	ctx context.Context,
+	logUploader *LogUploader,
+	commandName string,
+	cacheHost string,
+	cacheKey string,
+	fallbackKeys []string,
+	scopes []cacheScope,
+	custom_env *environment.Environment,
+) bool {
+	foundKey, err := lookUpCacheKey(ctx, cacheHost, append([]string{cacheKey}, fallbackKeys...),
+		restoreKeys(custom_env, commandName), scopes, executor.cacheSigner)
+	if err != nil {
+		logUploader.Write([]byte(fmt.Sprintf("\nFailed to look up %s cache: %v!", commandName, err)))
+	}
+
+	if foundKey != "" {
+		logUploader.Write([]byte(fmt.Sprintf("\nCache hit for %s! Not downloading since the cache is lookup-only.", foundKey)))
+	} else {
+		logUploader.Write([]byte(fmt.Sprintf("\nCache miss for %s!", cacheKey)))
+	}
+
+	exportCacheStatus(custom_env, commandName, foundKey)
+
+	caches = append(caches, Cache{
+		Name:       commandName,
+		Key:        cacheKey,
+		FileHasher: hasher.New(),
+		SkipUpload: true,
+	})
+
+	return true
+}
+
+// lookUpCacheKey returns the key of the cache entry that would've been restored
+// (either the first of the exact keys that exists or the entry matching one of
+// the restore keys, within the cache's own scope first) or an empty string if
+// there's no such entry.
+func lookUpCacheKey(
+	ctx context.Context,
+	cacheHost string,
+	cacheKeys []string,
+	restoreKeys []string,
+	scopes []cacheScope,
+	signer *cacheSigner,
+) (string, error) {
+	for _, cacheKey := range cacheKeys {
+		exists, err := cacheEntryRestorable(ctx, cacheHost, cacheKey, signer)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return cacheKey, nil
+		}
+	}
+
+	for _, scope := range restoreKeyScopes(scopes) {
+		for _, restoreKey := range restoreKeys {
+			matchingKey, err := resolveRestoreKey(ctx, cacheHost, restoreKey, scope, signer)
+			if errors.Is(err, errCacheSignatureMissing) || errors.Is(err, errCacheSignatureInvalid) {
+				// Such pointers are ignored when restoring the cache too
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			if matchingKey == "" {
+				continue
+			}
+
+			exists, err := cacheEntryRestorable(ctx, cacheHost, matchingKey, signer)
+			if err != nil {
+				return "", err
+			}
+			if exists {
+				return matchingKey, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// cacheEntryRestorable checks that the cache entry exists and, when the signatures are verified,
+// that its digest is signed, since otherwise the entry would be treated as a miss when downloading.
+func cacheEntryRestorable(ctx context.Context, cacheHost string, cacheKey string, signer *cacheSigner) (bool, error) {
+	_, exists, err := cacheEntrySize(ctx, cacheHost, cacheKey)
+	if err != nil || !exists || signer == nil {
+		return exists, err
+	}
+
+	digest, err := fetchCacheDigest(ctx, cacheHost, cacheKey)
+	if err == nil {
+		err = signer.verify(cacheKey, digest)
+	}
+
+	return err == nil, nil
+}
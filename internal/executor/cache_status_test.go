@@ -0,0 +1,76 @@
+package executor
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestExportCacheStatus(t *testing.T) {
+	env := environment.New(map[string]string{})
+
+	exportCacheStatus(env, "node_modules", "node_modules-abc")
+	require.Equal(t, "true", env.Get("CIRRUS_CACHE_NODE_MODULES_HIT"))
+	require.Equal(t, "node_modules-abc", env.Get("CIRRUS_CACHE_NODE_MODULES_RESTORED_KEY"))
+
+	exportCacheStatus(env, "node_modules", "")
+	require.Equal(t, "false", env.Get("CIRRUS_CACHE_NODE_MODULES_HIT"))
+	require.Equal(t, "", env.Get("CIRRUS_CACHE_NODE_MODULES_RESTORED_KEY"))
+}
+
+func TestLookUpCacheKey(t *testing.T) {
+	entries := map[string]string{
+		"gradle-exact":                      "archive",
+		"gradle-older":                      "archive",
+		restoreKeyPointerPrefix + "gradle-": `{"key": "gradle-older"}`,
+		restoreKeyPointerPrefix + "stale-":  `{"key": "stale-evicted"}`,
+		restoreKeyPointerPrefix + "broken-": `{"key": "unrelated"}`,
+	}
+	var downloads int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _ := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/"))
+
+		entry, ok := entries[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet && !strings.HasPrefix(key, restoreKeyPointerPrefix) {
+			downloads++
+		}
+		_, _ = w.Write([]byte(entry))
+	}))
+	defer server.Close()
+
+	cacheHost := strings.TrimPrefix(server.URL, "http://")
+	ctx := context.Background()
+
+	foundKey, err := lookUpCacheKey(ctx, cacheHost, []string{"gradle-exact"}, []string{"gradle-"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "gradle-exact", foundKey)
+
+	foundKey, err = lookUpCacheKey(ctx, cacheHost, []string{"gradle-newer"}, []string{"stale-", "gradle-"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "gradle-older", foundKey)
+
+	foundKey, err = lookUpCacheKey(ctx, cacheHost, []string{"gradle-newer"}, nil, nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, foundKey)
+
+	// The exact keys are tried in order before the restore keys
+	foundKey, err = lookUpCacheKey(ctx, cacheHost, []string{"gradle-newer", "gradle-exact"}, []string{"gradle-"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "gradle-exact", foundKey)
+
+	_, err = lookUpCacheKey(ctx, cacheHost, []string{"broken-key"}, []string{"broken-"}, nil, nil)
+	require.Error(t, err)
+
+	// Lookups never download the cache entries themselves
+	require.Zero(t, downloads)
+}
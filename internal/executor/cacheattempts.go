@@ -1,11 +1,22 @@
 package executor
 
 import (
+	"fmt"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"sync"
 	"time"
 )
 
+// The compression of the cache archive is reported as this field of the CacheRetrievalAttempt.Hit
+// message, which is not present in the generated API code yet, hence it's encoded by hand
+const hitCompressionField protowire.Number = 4
+
+// CacheAttempts is safe for concurrent use, since the caches can be uploaded in the background.
 type CacheAttempts struct {
+	mtx                    sync.Mutex
 	cacheRetrievalAttempts map[string]*api.CacheRetrievalAttempt
 }
 
@@ -16,22 +27,86 @@ func NewCacheAttempts() *CacheAttempts {
 }
 
 func (ca *CacheAttempts) Failed(key string, error string) {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
 	ca.cacheRetrievalAttempts[key] = &api.CacheRetrievalAttempt{Error: error}
 }
 
-func (ca *CacheAttempts) Hit(key string, size uint64, downloadedIn, extractedIn time.Duration) {
+// IntegrityFailed records a cache entry that doesn't match the digest recorded when it was uploaded,
+// which is reported separately from the other failures since it points to a corrupted cache entry.
+func (ca *CacheAttempts) IntegrityFailed(key string, err error) {
+	ca.Failed(key, fmt.Sprintf("integrity check failed: %v", err))
+}
+
+func (ca *CacheAttempts) Hit(
+	key string,
+	size uint64,
+	compression targz.Compression,
+	downloadedIn, extractedIn time.Duration,
+) {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
+	hit := &api.CacheRetrievalAttempt_Hit{
+		SizeBytes:         size,
+		DownloadedInNanos: uint64(downloadedIn.Nanoseconds()),
+		ExtractedInNanos:  uint64(extractedIn.Nanoseconds()),
+	}
+
+	if compression != "" {
+		unknown := protowire.AppendTag(nil, hitCompressionField, protowire.BytesType)
+		unknown = protowire.AppendString(unknown, string(compression))
+		hit.ProtoReflect().SetUnknown(unknown)
+	}
+
 	ca.cacheRetrievalAttempts[key] = &api.CacheRetrievalAttempt{
 		Result: &api.CacheRetrievalAttempt_Hit_{
-			Hit: &api.CacheRetrievalAttempt_Hit{
-				SizeBytes:         size,
-				DownloadedInNanos: uint64(downloadedIn.Nanoseconds()),
-				ExtractedInNanos:  uint64(extractedIn.Nanoseconds()),
-			},
+			Hit: hit,
 		},
 	}
 }
 
+// HitCompression returns the compression of the cache archive reported by Hit(),
+// or an empty string if the attempt is not a hit or the compression is unknown.
+func HitCompression(attempt *api.CacheRetrievalAttempt) targz.Compression {
+	hit := attempt.GetHit()
+	if hit == nil {
+		return ""
+	}
+
+	unknown := hit.ProtoReflect().GetUnknown()
+
+	for len(unknown) > 0 {
+		number, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return ""
+		}
+		unknown = unknown[n:]
+
+		if number == hitCompressionField && typ == protowire.BytesType {
+			value, n := protowire.ConsumeString(unknown)
+			if n < 0 {
+				return ""
+			}
+
+			return targz.Compression(value)
+		}
+
+		n = protowire.ConsumeFieldValue(number, typ, unknown)
+		if n < 0 {
+			return ""
+		}
+		unknown = unknown[n:]
+	}
+
+	return ""
+}
+
 func (ca *CacheAttempts) PopulatedIn(key string, populatedIn time.Duration) {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
 	ca.cacheRetrievalAttempts[key] = &api.CacheRetrievalAttempt{
 		Result: &api.CacheRetrievalAttempt_Miss_{
 			Miss: &api.CacheRetrievalAttempt_Miss{
@@ -42,6 +117,9 @@ func (ca *CacheAttempts) PopulatedIn(key string, populatedIn time.Duration) {
 }
 
 func (ca *CacheAttempts) Miss(key string, size uint64, archivedIn, uploadedIn time.Duration) {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
 	if attempt, ok := ca.cacheRetrievalAttempts[key]; ok {
 		if miss, ok := attempt.Result.(*api.CacheRetrievalAttempt_Miss_); ok {
 			miss.Miss.SizeBytes = size
@@ -62,6 +140,16 @@ func (ca *CacheAttempts) Miss(key string, size uint64, archivedIn, uploadedIn ti
 	}
 }
 
+// ToProto returns a copy of the attempts, since the background uploads might still update them.
 func (ca *CacheAttempts) ToProto() map[string]*api.CacheRetrievalAttempt {
-	return ca.cacheRetrievalAttempts
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
+	result := make(map[string]*api.CacheRetrievalAttempt, len(ca.cacheRetrievalAttempts))
+
+	for key, attempt := range ca.cacheRetrievalAttempts {
+		result[key] = proto.Clone(attempt).(*api.CacheRetrievalAttempt)
+	}
+
+	return result
 }
@@ -0,0 +1,46 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"testing"
+	"time"
+)
+
+func TestCacheAttemptsHitCompression(t *testing.T) {
+	cacheAttempts := NewCacheAttempts()
+	cacheAttempts.Hit("zstd-key", 42, targz.CompressionZstd, time.Second, time.Second)
+	cacheAttempts.Hit("unknown-key", 42, "", time.Second, time.Second)
+	cacheAttempts.Failed("failed-key", "failure")
+
+	attempts := cacheAttempts.ToProto()
+	require.Equal(t, targz.CompressionZstd, HitCompression(attempts["zstd-key"]))
+	require.Equal(t, targz.Compression(""), HitCompression(attempts["unknown-key"]))
+	require.Equal(t, targz.Compression(""), HitCompression(attempts["failed-key"]))
+
+	// The compression survives the round-trip over the wire
+	marshalled, err := proto.Marshal(attempts["zstd-key"])
+	require.NoError(t, err)
+
+	var unmarshalled api.CacheRetrievalAttempt
+	require.NoError(t, proto.Unmarshal(marshalled, &unmarshalled))
+	require.Equal(t, targz.CompressionZstd, HitCompression(&unmarshalled))
+	require.EqualValues(t, 42, unmarshalled.GetHit().SizeBytes)
+}
+
+func TestCacheAttemptsToProtoReturnsCopy(t *testing.T) {
+	cacheAttempts := NewCacheAttempts()
+	cacheAttempts.PopulatedIn("key", time.Second)
+
+	attempts := cacheAttempts.ToProto()
+	attempts["other-key"] = &api.CacheRetrievalAttempt{}
+
+	// Updates made after the attempts were reported don't affect the reported ones
+	cacheAttempts.Miss("key", 42, time.Second, time.Second)
+	require.Zero(t, attempts["key"].GetMiss().SizeBytes)
+
+	require.Len(t, cacheAttempts.ToProto(), 1)
+	require.EqualValues(t, 42, cacheAttempts.ToProto()["key"].GetMiss().SizeBytes)
+}
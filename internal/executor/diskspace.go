@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package executor
+
+import "golang.org/x/sys/unix"
+
+// getDiskUsage returns the number of bytes available to an unprivileged
+// user and the total size of the file system containing path.
+func getDiskUsage(path string) (diskUsage, error) {
+	var stat unix.Statfs_t
+
+	if err := unix.Statfs(path, &stat); err != nil {
+		return diskUsage{}, err
+	}
+
+	// The types of these fields differ between the platforms
+	return diskUsage{
+		available: uint64(stat.Bavail) * uint64(stat.Bsize),
+		total:     uint64(stat.Blocks) * uint64(stat.Bsize),
+	}, nil
+}
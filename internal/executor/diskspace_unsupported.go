@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package executor
+
+import "errors"
+
+func getDiskUsage(path string) (diskUsage, error) {
+	return diskUsage{}, errors.ErrUnsupported
+}
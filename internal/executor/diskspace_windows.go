@@ -0,0 +1,20 @@
+package executor
+
+import "golang.org/x/sys/windows"
+
+// getDiskUsage returns the number of bytes available to the
+// current user and the total size of the volume containing path.
+func getDiskUsage(path string) (diskUsage, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return diskUsage{}, err
+	}
+
+	var usage diskUsage
+
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &usage.available, &usage.total, nil); err != nil {
+		return diskUsage{}, err
+	}
+
+	return usage, nil
+}
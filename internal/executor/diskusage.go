@@ -0,0 +1,32 @@
+package executor
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+)
+
+type diskUsage struct {
+	available uint64
+	total     uint64
+}
+
+func (usage diskUsage) String() string {
+	var usedPercent uint64
+	if usage.total != 0 && usage.available <= usage.total {
+		usedPercent = (usage.total - usage.available) * 100 / usage.total
+	}
+
+	return fmt.Sprintf("%s available out of %s, %d%% used", humanize.IBytes(usage.available),
+		humanize.IBytes(usage.total), usedPercent)
+}
+
+// availableDiskSpace returns the number of bytes available
+// to the current user on the file system containing path.
+func availableDiskSpace(path string) (uint64, error) {
+	usage, err := getDiskUsage(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return usage.available, nil
+}
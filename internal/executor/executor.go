@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"github.com/avast/retry-go/v4"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/cirrusenv"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
@@ -14,7 +16,8 @@ import (
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/updatebatcher"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/vaultunboxer"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache"
-	"log"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/localcache"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/steplogs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -32,16 +35,26 @@ type CommandAndLogs struct {
 }
 
 type Executor struct {
-	taskIdentification   *api.TaskIdentification
-	serverToken          string
-	backgroundCommands   []CommandAndLogs
-	httpCacheHost        string
-	commandFrom          string
-	commandTo            string
-	preCreatedWorkingDir string
-	cacheAttempts        *CacheAttempts
-	env                  *environment.Environment
-	terminalWrapper      *terminalwrapper.Wrapper
+	taskIdentification    *api.TaskIdentification
+	serverToken           string
+	backgroundCommands    []CommandAndLogs
+	httpCacheHost         string
+	commandFrom           string
+	commandTo             string
+	preCreatedWorkingDir  string
+	cacheAttempts         *CacheAttempts
+	env                   *environment.Environment
+	terminalWrapper       *terminalwrapper.Wrapper
+	stepLogs              *steplogs.StepLogs
+	logMux                *LogMultiplexer
+	localCache            *localcache.LocalCache
+	backgroundUploads     backgroundUploads
+	prefetcher            *cachePrefetcher
+	cacheEncryptionKey    *cachecrypt.Key
+	cacheSigner           *cacheSigner
+	httpCacheReadOnly     bool
+	cacheSizeBudget       cacheSizeBudget
+	corruptedCacheEntries corruptedCacheEntries
 }
 
 type StepResult struct {
@@ -55,6 +68,8 @@ var (
 	ErrTimedOut = errors.New("timed out")
 )
 
+var logger = agentlog.WithSubsystem("executor")
+
 func NewExecutor(
 	taskId int64,
 	clientToken,
@@ -62,12 +77,13 @@ func NewExecutor(
 	commandFrom string,
 	commandTo string,
 	preCreatedWorkingDir string,
+	opts ...Option,
 ) *Executor {
 	taskIdentification := &api.TaskIdentification{
 		TaskId: taskId,
 		Secret: clientToken,
 	}
-	return &Executor{
+	executor := &Executor{
 		taskIdentification:   taskIdentification,
 		serverToken:          serverToken,
 		backgroundCommands:   make([]CommandAndLogs, 0),
@@ -78,6 +94,12 @@ func NewExecutor(
 		cacheAttempts:        NewCacheAttempts(),
 		env:                  environment.NewEmpty(),
 	}
+
+	for _, opt := range opts {
+		opt(executor)
+	}
+
+	return executor
 }
 
 func (executor *Executor) RunBuild(ctx context.Context) {
@@ -86,7 +108,7 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 	defer metricsCancel()
 	metricsResultChan := metrics.Run(metricsCtx, nil)
 
-	log.Println("Getting initial commands...")
+	logger.Info("Getting initial commands...")
 
 	var response *api.CommandsResponse
 	var err error
@@ -103,7 +125,7 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 			return err
 		}, retry.OnRetry(func(n uint, err error) {
 			numRetries++
-			log.Printf("Failed to get initial commands: %v", err)
+			logger.Warnf("Failed to get initial commands: %v", err)
 		}),
 		retry.Delay(5*time.Second),
 		retry.Attempts(0), retry.LastErrorOnly(true),
@@ -115,7 +137,7 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 	}
 
 	if response.ServerToken != executor.serverToken {
-		log.Panic("Server token is incorrect!")
+		logger.Panic("Server token is incorrect!")
 		return
 	}
 
@@ -136,7 +158,7 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 	// "PASSWORD: VAULT[$PATH $ARGS]" would work.
 	vaultUnboxerEnv := environment.New(scriptEnvironment)
 
-	log.Println("Unboxing VAULT[...] environment variables, if any")
+	logger.Info("Unboxing VAULT[...] environment variables, if any")
 
 	var vaultUnboxer *vaultunboxer.VaultUnboxer
 
@@ -148,31 +170,31 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 			}
 
 			message := fmt.Sprintf("failed to parse a Vault-boxed value %s: %v", value, err)
-			log.Println(message)
+			logger.Error(message)
 			executor.reportError(message)
 
 			return
 		}
 
 		if vaultUnboxer == nil {
-			log.Println("Found at least one VAULT[...] environment variable, initializing Vault client")
+			logger.Info("Found at least one VAULT[...] environment variable, initializing Vault client")
 
 			vaultUnboxer, err = vaultunboxer.NewFromEnvironment(ctx, vaultUnboxerEnv)
 			if err != nil {
 				message := fmt.Sprintf("failed to initialize a Vault client: %v", err)
-				log.Println(message)
+				logger.Error(message)
 				executor.reportError(message)
 
 				return
 			}
 
-			log.Println("Vault client successfully initialized")
+			logger.Info("Vault client successfully initialized")
 		}
 
 		unboxedValue, err := vaultUnboxer.Unbox(ctx, boxedValue)
 		if err != nil {
 			message := fmt.Sprintf("failed to unbox a Vault-boxed value %s: %v", value, err)
-			log.Println(message)
+			logger.Error(message)
 			executor.reportError(message)
 
 			return
@@ -186,19 +208,19 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 
 	workingDir, ok := executor.env.Lookup("CIRRUS_WORKING_DIR")
 	if ok {
-		log.Printf("Changing current working directory to %s", workingDir)
+		logger.Infof("Changing current working directory to %s", workingDir)
 
 		EnsureFolderExists(workingDir)
 
 		if err := os.Chdir(workingDir); err != nil {
 			message := fmt.Sprintf("Failed to change current working directory to '%s': %v", workingDir, err)
-			log.Println(message)
+			logger.Error(message)
 			executor.reportError(message)
 
 			return
 		}
 	} else {
-		log.Printf("Not changing current working directory because CIRRUS_WORKING_DIR is not set")
+		logger.Info("Not changing current working directory because CIRRUS_WORKING_DIR is not set")
 	}
 
 	commands := response.Commands
@@ -207,8 +229,46 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		executor.env.Set("CIRRUS_HTTP_CACHE_HOST", cacheHost)
 	}
 
+	encryptionKey, err := loadCacheEncryptionKey(executor.env)
+	if err != nil {
+		message := fmt.Sprintf("failed to configure cache encryption: %v", err)
+		logger.Error(message)
+		executor.reportError(message)
+
+		return
+	}
+
+	executor.cacheSigner, err = loadCacheSigner(executor.env)
+	if err != nil {
+		message := fmt.Sprintf("failed to configure cache signing: %v", err)
+		logger.Error(message)
+		executor.reportError(message)
+
+		return
+	}
+
+	// Prevents the untrusted tasks from overwriting the cache entries
+	if value, ok := executor.env.Lookup("CIRRUS_HTTP_CACHE_READ_ONLY"); ok {
+		executor.httpCacheReadOnly, _ = strconv.ParseBool(value)
+	}
+
 	if _, ok := executor.env.Lookup("CIRRUS_HTTP_CACHE_HOST"); !ok {
-		executor.env.Set("CIRRUS_HTTP_CACHE_HOST", http_cache.Start(executor.taskIdentification))
+		transferConcurrency := parseTransferConcurrency(executor.env.Lookup("CIRRUS_CACHE_TRANSFER_CONCURRENCY"))
+		httpCacheOpts := []http_cache.Option{http_cache.WithDownloadConcurrency(transferConcurrency)}
+		if executor.localCache != nil {
+			httpCacheOpts = append(httpCacheOpts, http_cache.WithLocalCache(executor.localCache))
+		}
+		if encryptionKey != nil {
+			httpCacheOpts = append(httpCacheOpts, http_cache.WithEncryption(encryptionKey))
+		}
+		if executor.httpCacheReadOnly {
+			httpCacheOpts = append(httpCacheOpts, http_cache.WithReadOnly())
+		}
+		executor.env.Set("CIRRUS_HTTP_CACHE_HOST", http_cache.Start(executor.taskIdentification, httpCacheOpts...))
+	} else if encryptionKey != nil {
+		// The external HTTP cache knows nothing about our key,
+		// so encrypt the cache archives ourselves
+		executor.cacheEncryptionKey = encryptionKey
 	}
 
 	executor.httpCacheHost = executor.env.Get("CIRRUS_HTTP_CACHE_HOST")
@@ -226,12 +286,25 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 
 	executor.env.AddSensitiveValues(response.SecretsToMask...)
 
+	// CIRRUS_LOG_MULTIPLEXING (experimental) schedules the log streams of all commands
+	// from a single goroutine with per-command flow control and a shared circuit breaker
+	// instead of retrying and reporting the failures for each command separately
+	if executor.env.Get("CIRRUS_LOG_MULTIPLEXING") == "true" {
+		executor.logMux = NewLogMultiplexer(ctx, executor.taskIdentification)
+		defer executor.logMux.Close()
+	}
+
 	if len(commands) == 0 {
-		log.Printf("No commands to run, exiting!")
+		logger.Info("No commands to run, exiting!")
 
 		return
 	}
 
+	// Start downloading the caches with statically known keys,
+	// so that the cache steps would only need to extract them
+	executor.prefetchCaches(timeoutCtx, BoundedCommands(commands, executor.commandFrom, executor.commandTo))
+	defer executor.prefetcher.Close()
+
 	// Launch terminal session for remote access (in case requested by the user)
 	var hasWaitForTerminalInstruction bool
 	var terminalServerAddress string
@@ -286,7 +359,8 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		})
 		ub.Flush(ctx, executor.taskIdentification)
 
-		log.Printf("Executing %s...", command.Name)
+		commandLogger := logger.WithField(agentlog.FieldCommand, command.Name)
+		commandLogger.Infof("Executing %s...", command.Name)
 
 		var stepCtx context.Context
 
@@ -305,7 +379,7 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 			failedAtLeastOnce = true
 		}
 
-		log.Printf("%s finished!", command.Name)
+		commandLogger.Infof("%s finished!", command.Name)
 
 		var currentCommandStatus api.Status
 		if stepResult.Success {
@@ -323,10 +397,11 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 
 	ub.Flush(ctx, executor.taskIdentification)
 
-	log.Printf("Background commands to clean up after: %d!\n", len(executor.backgroundCommands))
+	logger.Infof("Background commands to clean up after: %d!", len(executor.backgroundCommands))
 	for i := 0; i < len(executor.backgroundCommands); i++ {
 		backgroundCommand := executor.backgroundCommands[i]
-		log.Printf("Cleaning up after background command %s...\n", backgroundCommand.Name)
+		logger.WithField(agentlog.FieldCommand, backgroundCommand.Name).
+			Infof("Cleaning up after background command %s...", backgroundCommand.Name)
 		err := backgroundCommand.Cmd.Process.Kill()
 		if err != nil {
 			backgroundCommand.Logs.Write([]byte(fmt.Sprintf("\nFailed to stop background script %s: %s!", backgroundCommand.Name, err)))
@@ -334,8 +409,15 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		backgroundCommand.Logs.Finalize()
 	}
 
+	if executor.logMux != nil {
+		executor.logMux.Close()
+	}
+
+	// The outcome of the background cache uploads is reported along with the other cache attempts
+	executor.backgroundUploads.Wait()
+
 	// Retrieve resource utilization metrics
-	log.Println("Retrieving resource utilization metrics...")
+	logger.Info("Retrieving resource utilization metrics...")
 
 	metricsCancel()
 
@@ -344,15 +426,15 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 	select {
 	case metricsResult := <-metricsResultChan:
 		if resourceUtilization := metricsResult.ResourceUtilization; resourceUtilization != nil {
-			log.Printf("Received metrics: %d CPU points, %d memory points and %d errors\n",
+			logger.Infof("Received metrics: %d CPU points, %d memory points and %d errors",
 				len(metricsResult.ResourceUtilization.CpuChart), len(metricsResult.ResourceUtilization.MemoryChart),
 				len(metricsResult.Errors()))
 		} else {
-			log.Println("Received no metrics (this OS/architecture likely doesn't support metric gathering)")
+			logger.Info("Received no metrics (this OS/architecture likely doesn't support metric gathering)")
 		}
 		for _, err := range metricsResult.Errors() {
 			message := fmt.Sprintf("Encountered an error while gathering resource utilization metrics: %v", err)
-			log.Println(message)
+			logger.Warn(message)
 			_, _ = client.CirrusClient.ReportAgentWarning(ctx, &api.ReportAgentProblemRequest{
 				TaskIdentification: executor.taskIdentification,
 				Message:            message,
@@ -365,14 +447,14 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 		//
 		// [1]: https://github.com/shirou/gopsutil/issues/724
 		message := "Failed to retrieve resource utilization metrics in time"
-		log.Println(message)
+		logger.Warn(message)
 		_, _ = client.CirrusClient.ReportAgentWarning(ctx, &api.ReportAgentProblemRequest{
 			TaskIdentification: executor.taskIdentification,
 			Message:            message,
 		})
 	}
 
-	log.Println("Reporting that the agent has finished...")
+	logger.Info("Reporting that the agent has finished...")
 
 	if err = retry.Do(
 		func() error {
@@ -385,13 +467,13 @@ func (executor *Executor) RunBuild(ctx context.Context) {
 				})
 			return err
 		}, retry.OnRetry(func(n uint, err error) {
-			log.Printf("Failed to report that the agent has finished: %v\nRetrying...\n", err)
+			logger.Warnf("Failed to report that the agent has finished: %v, retrying...", err)
 		}),
 		retry.Delay(10*time.Second),
 		retry.Attempts(2),
 		retry.Context(context.WithoutCancel(ctx)),
 	); err != nil {
-		log.Printf("Failed to report that the agent has finished: %v\n", err)
+		logger.Errorf("Failed to report that the agent has finished: %v", err)
 	}
 }
 
@@ -452,6 +534,7 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 	success := false
 	signaledToExit := false
 	start := time.Now()
+	stepLogger := logger.WithField(agentlog.FieldCommand, currentStep.Name)
 
 	logUploader, err := NewLogUploader(ctx, executor, currentStep.Name)
 	if err != nil {
@@ -475,7 +558,7 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 	cirrusEnv, err := cirrusenv.New(executor.taskIdentification.TaskId)
 	if err != nil {
 		message := fmt.Sprintf("Failed initialize CIRRUS_ENV subsystem: %v", err)
-		log.Print(message)
+		stepLogger.Warn(message)
 		fmt.Fprintln(logUploader, message)
 		return &StepResult{
 			Success:  false,
@@ -513,10 +596,10 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 				Cmd:  cmd,
 				Logs: logUploader,
 			})
-			log.Printf("Started execution of #%d background command %s\n", len(executor.backgroundCommands), currentStep.Name)
+			stepLogger.Infof("Started execution of #%d background command %s", len(executor.backgroundCommands), currentStep.Name)
 			success = true
 		} else {
-			log.Printf("Failed to create command line for background command %s: %s\n", currentStep.Name, err)
+			stepLogger.Warnf("Failed to create command line for background command %s: %s", currentStep.Name, err)
 			_, _ = logUploader.Write([]byte(fmt.Sprintf("Failed to create command line: %s", err)))
 			logUploader.Finalize()
 			success = false
@@ -537,7 +620,7 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 		for {
 			switch operation := (<-operationChan).(type) {
 			case *terminalwrapper.LogOperation:
-				log.Println(operation.Message)
+				stepLogger.WithField(agentlog.FieldSubsystem, "terminalwrapper").Info(operation.Message)
 				_, _ = fmt.Fprintln(logUploader, operation.Message)
 			case *terminalwrapper.ExitOperation:
 				success = operation.Success
@@ -545,14 +628,14 @@ func (executor *Executor) performStep(ctx context.Context, currentStep *api.Comm
 			}
 		}
 	default:
-		log.Printf("Unsupported instruction %T", instruction)
+		stepLogger.Warnf("Unsupported instruction %T", instruction)
 		success = false
 	}
 
 	cirrusEnvVariables, err := cirrusEnv.Consume()
 	if err != nil {
 		message := fmt.Sprintf("Failed collect CIRRUS_ENV subsystem results: %v", err)
-		log.Print(message)
+		stepLogger.Warn(message)
 		fmt.Fprintln(logUploader, message)
 	}
 
@@ -624,7 +707,7 @@ func (executor *Executor) CreateFile(
 	case *api.FileInstruction_FromContents:
 		content = source.FromContents
 	default:
-		log.Printf("Unsupported source %T", source)
+		logger.Warnf("Unsupported source %T", source)
 
 		return false
 	}
@@ -7,60 +7,133 @@ import (
 	"fmt"
 	"github.com/avast/retry-go/v4"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/encoding/gzip"
 	"io"
-	"log"
 	"os"
 	"sync"
 	"time"
 )
 
+type logChunk struct {
+	data      []byte
+	timestamp time.Time
+}
+
 type LogUploader struct {
 	taskIdentification *api.TaskIdentification
 	commandName        string
 	client             api.CirrusCIService_StreamLogsClient
+	mux                *LogMultiplexer
 	storedOutput       *os.File
+	storedOutputSize   int64
+	localOutput        *os.File
 	erroredChunks      int
-	logsChannel        chan []byte
+	buffer             *logBuffer
 	doneLogUpload      chan bool
 	env                *environment.Environment
 	closed             bool
+	logger             *logrus.Entry
 
 	// Fields related to the CIRRUS_LOG_TIMESTAMP behavioral environment variable
-	LogTimestamps bool
-	GetTimestamp  func() time.Time
-	OweTimestamp  bool
+	LogTimestamps  bool
+	GetTimestamp   func() time.Time
+	OweTimestamp   bool
+	TimestampIndex *TimestampIndex
+
+	// Fields related to the CIRRUS_LOG_RATE_LIMIT behavioral environment variable
+	limiter      *rate.Limiter
+	coalescer    *repeatCoalescer
+	coalescerMtx sync.Mutex
 
 	mutex sync.RWMutex
 }
 
 func NewLogUploader(ctx context.Context, executor *Executor, commandName string) (*LogUploader, error) {
-	logClient, err := InitializeLogStreamClient(ctx, executor.taskIdentification, commandName, false)
-	if err != nil {
-		return nil, err
+	// With the (experimental) multiplexing, the logs are streamed by the multiplexer,
+	// unless the latter kept failing, in which case each command streams its logs on its own
+	mux := executor.logMux
+	if mux != nil && mux.Disabled() {
+		mux = nil
+	}
+
+	var logClient api.CirrusCIService_StreamLogsClient
+	if mux == nil {
+		var err error
+
+		logClient, err = InitializeLogStreamClient(ctx, executor.taskIdentification, commandName, false)
+		if err != nil {
+			return nil, err
+		}
 	}
 	EnsureFolderExists(os.TempDir())
 	file, err := os.CreateTemp(os.TempDir(), commandName)
 	if err != nil {
 		return nil, err
 	}
+
+	var localOutput *os.File
+	if executor.stepLogs != nil {
+		localOutput, err = executor.stepLogs.Create(commandName)
+		if err != nil {
+			logger.WithField(agentlog.FieldCommand, commandName).
+				Warnf("Failed to create a local log file for %s: %v", commandName, err)
+		}
+	}
+
+	// CIRRUS_LOG_TIMESTAMP=true splices the timestamps into the log itself,
+	// while CIRRUS_LOG_TIMESTAMP=metadata keeps the log intact and stores
+	// the timestamps in a separate index keyed by byte offset
+	logTimestampMode := executor.env.Get("CIRRUS_LOG_TIMESTAMP")
+
+	var timestampIndex *TimestampIndex
+	if logTimestampMode == "metadata" {
+		timestampIndex = NewTimestampIndex(time.Now())
+	}
+
+	// CIRRUS_LOG_RATE_LIMIT limits the rate (in bytes per second) at which the logs
+	// are streamed, with the excess being buffered, and coalesces repetitive lines
+	var limiter *rate.Limiter
+	var coalescer *repeatCoalescer
+	if rateLimit, ok := executor.env.Lookup("CIRRUS_LOG_RATE_LIMIT"); ok {
+		bytesPerSecond, err := humanize.ParseBytes(rateLimit)
+		if err == nil && bytesPerSecond != 0 {
+			burst := int(min(bytesPerSecond, maxBytesPerInvocation))
+			limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+			coalescer = &repeatCoalescer{}
+		} else {
+			logger.WithField(agentlog.FieldCommand, commandName).
+				Warnf("Ignoring invalid CIRRUS_LOG_RATE_LIMIT value %q", rateLimit)
+		}
+	}
+
 	logUploader := LogUploader{
 		taskIdentification: executor.taskIdentification,
 		commandName:        commandName,
 		client:             logClient,
+		mux:                mux,
 		storedOutput:       file,
+		localOutput:        localOutput,
 		erroredChunks:      0,
-		logsChannel:        make(chan []byte, 128),
+		buffer:             newLogBuffer(defaultMaxMemoryBytes, defaultMaxSpillBytes),
 		doneLogUpload:      make(chan bool),
 		env:                executor.env,
 		closed:             false,
+		logger:             logger.WithField(agentlog.FieldCommand, commandName),
 
-		LogTimestamps: executor.env.Get("CIRRUS_LOG_TIMESTAMP") == "true",
-		GetTimestamp:  time.Now,
-		OweTimestamp:  true,
+		LogTimestamps:  logTimestampMode == "true",
+		GetTimestamp:   time.Now,
+		OweTimestamp:   true,
+		TimestampIndex: timestampIndex,
+
+		limiter:   limiter,
+		coalescer: coalescer,
 	}
 	go logUploader.StreamLogs()
 	return &logUploader, nil
@@ -69,7 +142,7 @@ func NewLogUploader(ctx context.Context, executor *Executor, commandName string)
 func (uploader *LogUploader) reInitializeClient(ctx context.Context) error {
 	err := uploader.client.CloseSend()
 	if err != nil {
-		log.Printf("Failed to close log for %s for reinitialization: %s\n", uploader.commandName, err.Error())
+		uploader.logger.Warnf("Failed to close log for %s for reinitialization: %s", uploader.commandName, err.Error())
 	}
 	logClient, err := InitializeLogStreamClient(ctx, uploader.taskIdentification, uploader.commandName, false)
 	if err != nil {
@@ -118,6 +191,22 @@ func (uploader *LogUploader) Write(bytes []byte) (int, error) {
 	// Make potential bytes expansion below transparent to the caller
 	originalLen := len(bytes)
 
+	timestamp := uploader.GetTimestamp()
+
+	// Mask the sensitive values before the logs are buffered,
+	// since the buffer might spill them to the disk
+	bytes = maskSensitiveValues(bytes, uploader.env.SensitiveValues(), nil)
+
+	if uploader.coalescer != nil {
+		uploader.coalescerMtx.Lock()
+		bytes = uploader.coalescer.Process(bytes)
+		uploader.coalescerMtx.Unlock()
+
+		if len(bytes) == 0 {
+			return originalLen, nil
+		}
+	}
+
 	if uploader.LogTimestamps {
 		bytes = uploader.WithTimestamps(bytes)
 	}
@@ -127,7 +216,7 @@ func (uploader *LogUploader) Write(bytes []byte) (int, error) {
 	if !uploader.closed {
 		bytesCopy := make([]byte, len(bytes))
 		copy(bytesCopy, bytes)
-		uploader.logsChannel <- bytesCopy
+		uploader.buffer.Push(logChunk{data: bytesCopy, timestamp: timestamp})
 	}
 	return originalLen, nil
 }
@@ -136,89 +225,207 @@ func (uploader *LogUploader) StreamLogs() {
 	ctx := context.Background()
 
 	for {
-		logs, finished := uploader.ReadAvailableChunks()
-		_, err := uploader.WriteChunk(logs)
+		logs, offsets, finished := uploader.ReadAvailableChunks()
+		// The chunks are already masked by Write(), but a sensitive value might have been split
+		// between the chunks. Masking changes the length of the logs, so keep the offsets
+		// pointing to the same bytes.
+		offsetsToMask := make([]int, len(offsets))
+		for i, offset := range offsets {
+			offsetsToMask[i] = offset.offset
+		}
+		logs = maskSensitiveValues(logs, uploader.env.SensitiveValues(), offsetsToMask)
+		if uploader.TimestampIndex != nil {
+			for i, offset := range offsets {
+				uploader.TimestampIndex.Add(uploader.storedOutputSize+int64(offsetsToMask[i]), offset.timestamp)
+			}
+		}
+		if uploader.limiter != nil {
+			uploader.waitForRateLimit(ctx, len(logs))
+		}
+		_, err := uploader.writeMaskedChunk(logs)
 		if finished {
-			log.Printf("Finished streaming logs for %s!\n", uploader.commandName)
+			uploader.logger.Infof("Finished streaming logs for %s!", uploader.commandName)
 			break
 		}
-		if err == io.EOF {
-			log.Printf("Got EOF while streaming logs for %s! Trying to reinitilize logs uploader...\n", uploader.commandName)
+		if err == io.EOF && uploader.mux == nil {
+			uploader.logger.Infof("Got EOF while streaming logs for %s! Trying to reinitilize logs uploader...", uploader.commandName)
 			err := uploader.reInitializeClient(ctx)
 			if err == nil {
-				log.Printf("Successfully reinitilized log uploader for %s!\n", uploader.commandName)
+				uploader.logger.Infof("Successfully reinitilized log uploader for %s!", uploader.commandName)
 			} else {
-				log.Printf("Failed to reinitilized log uploader for %s: %s\n", uploader.commandName, err.Error())
+				uploader.logger.Warnf("Failed to reinitilized log uploader for %s: %s", uploader.commandName, err.Error())
 			}
 		}
 	}
-	uploader.client.CloseAndRecv()
+	if uploader.mux != nil {
+		uploader.mux.Flush(uploader.commandName)
+	} else if uploader.client != nil {
+		uploader.client.CloseAndRecv()
+	}
 
 	err := uploader.UploadStoredOutput(ctx)
 	if err != nil {
-		log.Printf("Failed to upload stored logs for %s: %s", uploader.commandName, err.Error())
+		uploader.logger.Warnf("Failed to upload stored logs for %s: %s", uploader.commandName, err.Error())
 	} else {
-		log.Printf("Uploaded stored logs for %s!", uploader.commandName)
+		uploader.logger.Infof("Uploaded stored logs for %s!", uploader.commandName)
+	}
+
+	if uploader.TimestampIndex != nil {
+		if err := uploader.UploadTimestampIndex(ctx); err != nil {
+			uploader.logger.Warnf("Failed to upload timestamp index for %s: %v", uploader.commandName, err)
+		}
 	}
 
+	uploader.buffer.Discard()
+
 	uploader.storedOutput.Close()
 	os.Remove(uploader.storedOutput.Name())
 
+	if uploader.localOutput != nil {
+		uploader.localOutput.Close()
+	}
+
 	uploader.doneLogUpload <- true
 }
 
-func (uploader *LogUploader) ReadAvailableChunks() ([]byte, bool) {
-	const maxBytesPerInvocation = 1 * 1024 * 1024
+const maxBytesPerInvocation = 1 * 1024 * 1024
 
-	// Make sure we wait first to avoid busy loop in StreamLogs()
-	result := <-uploader.logsChannel
+func (uploader *LogUploader) ReadAvailableChunks() ([]byte, []logChunkOffset, bool) {
+	// Pop() waits for at least one chunk, which avoids a busy loop in StreamLogs()
+	result, offsets, finished := uploader.buffer.Pop(maxBytesPerInvocation)
+	if finished {
+		uploader.logger.Infof("No more log chunks for %s", uploader.commandName)
+	}
 
-	// Read log chunks from the channel, but no more than maxBytesPerInvocation bytes
-	//
-	// This assumes that log chunks are small by themselves (e.g. 32,000 bytes).
-	for {
-		select {
-		case nextChunk, more := <-uploader.logsChannel:
-			result = append(result, nextChunk...)
-			if !more {
-				log.Printf("No more log chunks for %s\n", uploader.commandName)
-				return result, true
-			}
-		default:
-			return result, false
-		}
+	return result, offsets, finished
+}
+
+// waitForRateLimit throttles the streaming according to CIRRUS_LOG_RATE_LIMIT,
+// the logs that are produced in the meantime are accumulated in the buffer.
+//
+// Once the command has finished, the remaining logs are streamed at full speed.
+func (uploader *LogUploader) waitForRateLimit(ctx context.Context, n int) {
+	for n > 0 && !uploader.buffer.Closed() {
+		tokens := min(n, uploader.limiter.Burst())
 
-		if len(result) > maxBytesPerInvocation {
-			return result, false
+		if err := uploader.limiter.WaitN(ctx, tokens); err != nil {
+			return
 		}
+
+		n -= tokens
 	}
 }
 
 func (uploader *LogUploader) WriteChunk(bytesToWrite []byte) (int, error) {
+	return uploader.writeMaskedChunk(maskSensitiveValues(bytesToWrite, uploader.env.SensitiveValues(), nil))
+}
+
+func (uploader *LogUploader) writeMaskedChunk(bytesToWrite []byte) (int, error) {
 	if len(bytesToWrite) == 0 {
 		return 0, nil
 	}
-	for _, valueToMask := range uploader.env.SensitiveValues() {
-		bytesToWrite = bytes.Replace(bytesToWrite, []byte(valueToMask), []byte("HIDDEN-BY-CIRRUS-CI"), -1)
+
+	n, _ := uploader.storedOutput.Write(bytesToWrite)
+	uploader.storedOutputSize += int64(n)
+	if uploader.localOutput != nil {
+		uploader.localOutput.Write(bytesToWrite)
+	}
+	if uploader.mux != nil {
+		if uploader.mux.Send(uploader.commandName, bytesToWrite) {
+			return len(bytesToWrite), nil
+		}
+
+		// The multiplexing was given up, fall back to streaming the logs of this command separately
+		uploader.mux = nil
+	}
+	if uploader.client == nil {
+		logClient, err := InitializeLogStreamClient(context.Background(), uploader.taskIdentification,
+			uploader.commandName, false)
+		if err != nil {
+			uploader.logger.Warnf("Failed to fall back to streaming the logs for %s separately: %v",
+				uploader.commandName, err)
+			uploader.erroredChunks++
+			return 0, err
+		}
+		uploader.client = logClient
 	}
 
-	uploader.storedOutput.Write(bytesToWrite)
 	dataChunk := api.DataChunk{Data: bytesToWrite}
 	logEntry := api.LogEntry_Chunk{Chunk: &dataChunk}
 	err := uploader.client.Send(&api.LogEntry{Value: &logEntry})
 	if err != nil {
-		log.Printf("Failed to send logs! %s For %s", err.Error(), string(bytesToWrite))
+		uploader.logger.Warnf("Failed to send logs! %s For %s", err.Error(), string(bytesToWrite))
 		uploader.erroredChunks++
 		return 0, err
 	}
 	return len(bytesToWrite), nil
 }
 
+// maskSensitiveValues replaces the sensitive values in data and adjusts the ascending offsets
+// into data, so that they point to the same bytes in the result (or to the start of the mask
+// if they were pointing inside a sensitive value).
+func maskSensitiveValues(data []byte, sensitiveValues []string, offsets []int) []byte {
+	mask := []byte("HIDDEN-BY-CIRRUS-CI")
+
+	for _, sensitiveValue := range sensitiveValues {
+		needle := []byte(sensitiveValue)
+		if len(needle) == 0 || !bytes.Contains(data, needle) {
+			continue
+		}
+
+		var result []byte
+		var delta, position, nextOffset int
+
+		for {
+			index := bytes.Index(data[position:], needle)
+			if index < 0 {
+				break
+			}
+
+			start := position + index
+			end := start + len(needle)
+
+			for ; nextOffset < len(offsets) && offsets[nextOffset] <= start; nextOffset++ {
+				offsets[nextOffset] += delta
+			}
+			for ; nextOffset < len(offsets) && offsets[nextOffset] < end; nextOffset++ {
+				offsets[nextOffset] = start + delta
+			}
+
+			result = append(result, data[position:start]...)
+			result = append(result, mask...)
+			delta += len(mask) - len(needle)
+			position = end
+		}
+
+		for ; nextOffset < len(offsets); nextOffset++ {
+			offsets[nextOffset] += delta
+		}
+
+		data = append(result, data[position:]...)
+	}
+
+	return data
+}
+
 func (uploader *LogUploader) Finalize() {
-	log.Printf("Finalizing log uploading for %s!\n", uploader.commandName)
+	uploader.logger.Infof("Finalizing log uploading for %s!", uploader.commandName)
+	if uploader.coalescer != nil {
+		uploader.coalescerMtx.Lock()
+		notice := uploader.coalescer.Flush()
+		uploader.coalescerMtx.Unlock()
+
+		if len(notice) != 0 {
+			if uploader.LogTimestamps {
+				notice = uploader.WithTimestamps(notice)
+			}
+			uploader.buffer.Push(logChunk{data: notice, timestamp: uploader.GetTimestamp()})
+		}
+	}
+
 	uploader.mutex.Lock()
 	uploader.closed = true
-	close(uploader.logsChannel)
+	uploader.buffer.Close()
 	uploader.mutex.Unlock()
 	<-uploader.doneLogUpload
 }
@@ -263,6 +470,31 @@ func (uploader *LogUploader) UploadStoredOutput(ctx context.Context) error {
 	return nil
 }
 
+func (uploader *LogUploader) UploadTimestampIndex(ctx context.Context) error {
+	logClient, err := InitializeLogSaveClient(ctx, uploader.taskIdentification,
+		uploader.commandName+TimestampIndexSuffix, true)
+	if err != nil {
+		return err
+	}
+	defer logClient.CloseAndRecv()
+
+	var buf bytes.Buffer
+
+	if _, err := uploader.TimestampIndex.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	for buf.Len() > 0 {
+		dataChunk := api.DataChunk{Data: buf.Next(1024 * 1024)}
+		logEntry := api.LogEntry_Chunk{Chunk: &dataChunk}
+		if err := logClient.Send(&api.LogEntry{Value: &logEntry}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func InitializeLogStreamClient(ctx context.Context, taskIdentification *api.TaskIdentification, commandName string, raw bool) (api.CirrusCIService_StreamLogsClient, error) {
 	var streamLogClient api.CirrusCIService_StreamLogsClient
 	var err error
@@ -272,7 +504,8 @@ func InitializeLogStreamClient(ctx context.Context, taskIdentification *api.Task
 		return err
 	}, retry.Delay(5*time.Second), retry.Attempts(3), retry.Context(ctx))
 	if err != nil {
-		log.Printf("Failed to start streaming logs for %s! %s", commandName, err.Error())
+		logger.WithField(agentlog.FieldCommand, commandName).
+			Warnf("Failed to start streaming logs for %s! %s", commandName, err.Error())
 		request := api.ReportAgentProblemRequest{
 			TaskIdentification: taskIdentification,
 			Message:            fmt.Sprintf("Failed to start streaming logs for command %v: %v", commandName, err),
@@ -304,7 +537,8 @@ func InitializeLogSaveClient(
 		retry.Attempts(3),
 	)
 	if err != nil {
-		log.Printf("Failed to start saving logs for %s! %s", commandName, err.Error())
+		logger.WithField(agentlog.FieldCommand, commandName).
+			Warnf("Failed to start saving logs for %s! %s", commandName, err.Error())
 		request := api.ReportAgentProblemRequest{
 			TaskIdentification: taskIdentification,
 			Message:            fmt.Sprintf("Failed to start saving logs for command %v: %v", commandName, err),
@@ -0,0 +1,243 @@
+package executor
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// How many bytes of logs to keep in memory before spilling them to disk
+	defaultMaxMemoryBytes = 4 * 1024 * 1024
+
+	// How many bytes of logs to keep on disk before blocking the producer
+	defaultMaxSpillBytes = 1024 * 1024 * 1024
+
+	// Size of a spilled chunk header: data length and a timestamp
+	spillHeaderSize = 16
+)
+
+// logBuffer is an unbounded FIFO for log chunks with a bounded memory footprint:
+// once the in-memory part overflows, the subsequent chunks are spilled to disk,
+// so that a slow network doesn't block the producer (e.g. a script's output pipe).
+//
+// The producer is only blocked when both in-memory and on-disk parts overflow
+// or when the spill file cannot be written.
+type logBuffer struct {
+	maxMemoryBytes int
+	maxSpillBytes  int64
+
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	closed bool
+
+	memory      []logChunk
+	memoryBytes int
+
+	spill            *os.File
+	spillWriteOffset int64
+	spillReadOffset  int64
+	spillFailed      bool
+}
+
+func newLogBuffer(maxMemoryBytes int, maxSpillBytes int64) *logBuffer {
+	buffer := &logBuffer{
+		maxMemoryBytes: maxMemoryBytes,
+		maxSpillBytes:  maxSpillBytes,
+	}
+	buffer.cond = sync.NewCond(&buffer.mtx)
+
+	return buffer
+}
+
+// Push appends a chunk to the buffer, it's a no-op once the buffer is closed.
+func (buffer *logBuffer) Push(chunk logChunk) {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+
+	for !buffer.closed {
+		// Keep the order: once we've started spilling,
+		// everything goes to disk until it's drained
+		if !buffer.spilling() && buffer.memoryBytes+len(chunk.data) <= buffer.maxMemoryBytes {
+			buffer.memory = append(buffer.memory, chunk)
+			buffer.memoryBytes += len(chunk.data)
+			buffer.cond.Broadcast()
+
+			return
+		}
+
+		if !buffer.spillFailed && buffer.spillBacklog() < buffer.maxSpillBytes {
+			if err := buffer.writeSpill(chunk); err == nil {
+				buffer.cond.Broadcast()
+
+				return
+			}
+
+			logger.Warnf("Failed to spill logs to disk, falling back to blocking the producer")
+			buffer.spillFailed = true
+		}
+
+		// Nowhere to put the chunk, wait for the consumer
+		if len(buffer.memory) == 0 && !buffer.spilling() {
+			// Always accept at least one chunk to avoid a deadlock
+			// when a single chunk is larger than the memory limit
+			buffer.memory = append(buffer.memory, chunk)
+			buffer.memoryBytes += len(chunk.data)
+			buffer.cond.Broadcast()
+
+			return
+		}
+
+		buffer.cond.Wait()
+	}
+}
+
+// logChunkOffset records where a chunk starts within the concatenation returned by Pop.
+type logChunkOffset struct {
+	offset    int
+	timestamp time.Time
+}
+
+// Pop waits for at least one chunk and returns the concatenation of the available
+// chunks (no more than maxBytes, unless the first chunk is larger), the offsets and
+// timestamps of these chunks and whether the buffer is closed and fully drained.
+func (buffer *logBuffer) Pop(maxBytes int) ([]byte, []logChunkOffset, bool) {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+
+	for len(buffer.memory) == 0 && !buffer.spilling() && !buffer.closed {
+		buffer.cond.Wait()
+	}
+
+	var result []byte
+	var offsets []logChunkOffset
+
+	for len(result) < maxBytes {
+		var chunk logChunk
+
+		if len(buffer.memory) != 0 {
+			chunk = buffer.memory[0]
+			buffer.memory = buffer.memory[1:]
+			buffer.memoryBytes -= len(chunk.data)
+		} else if buffer.spilling() {
+			var err error
+
+			chunk, err = buffer.readSpill()
+			if err != nil {
+				logger.Warnf("Failed to read spilled logs: %v", err)
+				buffer.resetSpill()
+
+				break
+			}
+		} else {
+			break
+		}
+
+		offsets = append(offsets, logChunkOffset{offset: len(result), timestamp: chunk.timestamp})
+		result = append(result, chunk.data...)
+	}
+
+	if buffer.spill != nil && !buffer.spilling() {
+		buffer.resetSpill()
+	}
+
+	buffer.cond.Broadcast()
+
+	finished := buffer.closed && len(buffer.memory) == 0 && !buffer.spilling()
+
+	return result, offsets, finished
+}
+
+// Close prevents further pushes, the chunks that are already buffered can still be popped.
+func (buffer *logBuffer) Close() {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+
+	buffer.closed = true
+	buffer.cond.Broadcast()
+}
+
+func (buffer *logBuffer) Closed() bool {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+
+	return buffer.closed
+}
+
+// Discard releases the resources held by the buffer.
+func (buffer *logBuffer) Discard() {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+
+	buffer.memory = nil
+	buffer.memoryBytes = 0
+
+	if buffer.spill != nil {
+		buffer.resetSpill()
+	}
+}
+
+func (buffer *logBuffer) spilling() bool {
+	return buffer.spillBacklog() != 0
+}
+
+func (buffer *logBuffer) spillBacklog() int64 {
+	return buffer.spillWriteOffset - buffer.spillReadOffset
+}
+
+func (buffer *logBuffer) writeSpill(chunk logChunk) error {
+	if buffer.spill == nil {
+		spill, err := os.CreateTemp(os.TempDir(), "cirrus-logs-spill-")
+		if err != nil {
+			return err
+		}
+
+		buffer.spill = spill
+	}
+
+	var header [spillHeaderSize]byte
+	binary.LittleEndian.PutUint64(header[0:8], uint64(len(chunk.data)))
+	binary.LittleEndian.PutUint64(header[8:16], uint64(chunk.timestamp.UnixNano()))
+
+	if _, err := buffer.spill.WriteAt(header[:], buffer.spillWriteOffset); err != nil {
+		return err
+	}
+	if _, err := buffer.spill.WriteAt(chunk.data, buffer.spillWriteOffset+spillHeaderSize); err != nil {
+		return err
+	}
+
+	buffer.spillWriteOffset += spillHeaderSize + int64(len(chunk.data))
+
+	return nil
+}
+
+func (buffer *logBuffer) readSpill() (logChunk, error) {
+	var header [spillHeaderSize]byte
+
+	if _, err := buffer.spill.ReadAt(header[:], buffer.spillReadOffset); err != nil {
+		return logChunk{}, err
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint64(header[0:8]))
+
+	if _, err := buffer.spill.ReadAt(data, buffer.spillReadOffset+spillHeaderSize); err != nil {
+		return logChunk{}, err
+	}
+
+	buffer.spillReadOffset += spillHeaderSize + int64(len(data))
+
+	return logChunk{
+		data:      data,
+		timestamp: time.Unix(0, int64(binary.LittleEndian.Uint64(header[8:16]))),
+	}, nil
+}
+
+func (buffer *logBuffer) resetSpill() {
+	_ = buffer.spill.Close()
+	_ = os.Remove(buffer.spill.Name())
+
+	buffer.spill = nil
+	buffer.spillWriteOffset = 0
+	buffer.spillReadOffset = 0
+}
@@ -0,0 +1,57 @@
+package executor
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLogBufferSpill(t *testing.T) {
+	buffer := newLogBuffer(8, defaultMaxSpillBytes)
+
+	var expected []byte
+
+	start := time.Now()
+
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte('a' + i%26)}, 5)
+		expected = append(expected, chunk...)
+		buffer.Push(logChunk{data: chunk, timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	require.NotNil(t, buffer.spill, "the buffer should spill to disk once the memory limit is reached")
+	spillPath := buffer.spill.Name()
+
+	buffer.Close()
+
+	var actual []byte
+
+	data, offsets, finished := buffer.Pop(12)
+	require.False(t, finished)
+	require.Len(t, offsets, 3)
+	for i, offset := range offsets {
+		require.Equal(t, i*5, offset.offset)
+		require.True(t, offset.timestamp.Equal(start.Add(time.Duration(i)*time.Second)))
+	}
+	actual = append(actual, data...)
+
+	for !finished {
+		data, _, finished = buffer.Pop(12)
+		actual = append(actual, data...)
+	}
+
+	require.Equal(t, expected, actual)
+	require.NoFileExists(t, spillPath)
+}
+
+func TestLogBufferOversizedChunk(t *testing.T) {
+	buffer := newLogBuffer(1, 0)
+
+	buffer.Push(logChunk{data: []byte("larger than the limit")})
+	buffer.Close()
+
+	data, _, finished := buffer.Pop(maxBytesPerInvocation)
+	require.Equal(t, "larger than the limit", string(data))
+	require.True(t, finished)
+}
@@ -0,0 +1,74 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// repeatCoalescer replaces consecutive repetitions of the same line
+// with a single "previous line repeated N times" notice.
+//
+// Only complete lines are coalesced, incomplete lines (e.g. prompts
+// and progress bars) are passed through as is.
+type repeatCoalescer struct {
+	lastLine []byte
+	repeats  int
+	midLine  bool
+}
+
+func (coalescer *repeatCoalescer) Process(input []byte) []byte {
+	var result []byte
+
+	for len(input) > 0 {
+		idx := bytes.IndexByte(input, '\n')
+		if idx == -1 {
+			result = append(result, coalescer.Flush()...)
+			result = append(result, input...)
+			coalescer.lastLine = nil
+			coalescer.midLine = true
+
+			break
+		}
+
+		line := input[:idx+1]
+		input = input[idx+1:]
+
+		if !coalescer.midLine && coalescer.lastLine != nil && bytes.Equal(line, coalescer.lastLine) {
+			coalescer.repeats++
+
+			continue
+		}
+
+		result = append(result, coalescer.Flush()...)
+		result = append(result, line...)
+
+		if coalescer.midLine {
+			// We've only seen the tail of this line
+			coalescer.lastLine = nil
+		} else {
+			coalescer.lastLine = append(coalescer.lastLine[:0], line...)
+		}
+		coalescer.midLine = false
+	}
+
+	return result
+}
+
+// Flush returns the notice about the pending repetitions, if any.
+func (coalescer *repeatCoalescer) Flush() []byte {
+	if coalescer.repeats == 0 {
+		return nil
+	}
+
+	var notice string
+
+	if coalescer.repeats == 1 {
+		notice = "previous line repeated 1 time\n"
+	} else {
+		notice = fmt.Sprintf("previous line repeated %d times\n", coalescer.repeats)
+	}
+
+	coalescer.repeats = 0
+
+	return []byte(notice)
+}
@@ -0,0 +1,55 @@
+package executor
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRepeatCoalescer(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Inputs   []string
+		Expected string
+	}{
+		{
+			Name:     "no repetitions",
+			Inputs:   []string{"a\nb\n", "c\n"},
+			Expected: "a\nb\nc\n",
+		},
+		{
+			Name:     "single repetition",
+			Inputs:   []string{"a\na\nb\n"},
+			Expected: "a\nprevious line repeated 1 time\nb\n",
+		},
+		{
+			Name:     "repetitions across writes",
+			Inputs:   []string{"a\n", "a\na\n", "a\n", "b\n"},
+			Expected: "a\nprevious line repeated 3 times\nb\n",
+		},
+		{
+			Name:     "repetitions at the end",
+			Inputs:   []string{"a\na\na\n"},
+			Expected: "a\nprevious line repeated 2 times\n",
+		},
+		{
+			Name:     "incomplete lines",
+			Inputs:   []string{"50%\r", "50%\r", "100%\n", "100%\n"},
+			Expected: "50%\r50%\r100%\n100%\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			coalescer := &repeatCoalescer{}
+
+			var actual []byte
+
+			for _, input := range testCase.Inputs {
+				actual = append(actual, coalescer.Process([]byte(input))...)
+			}
+			actual = append(actual, coalescer.Flush()...)
+
+			require.Equal(t, testCase.Expected, string(actual))
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/environment"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMaskSensitiveValues(t *testing.T) {
+	data := []byte("first: secret\nsecond: secret\nthird\n")
+
+	// Offsets of the chunks that start with the lines and inside the second secret
+	offsets := []int{0, 14, 25, 29}
+
+	masked := maskSensitiveValues(data, []string{"", "secret"}, offsets)
+	require.Equal(t, "first: HIDDEN-BY-CIRRUS-CI\nsecond: HIDDEN-BY-CIRRUS-CI\nthird\n", string(masked))
+
+	require.Equal(t, []int{0, 27, 35, 55}, offsets)
+	require.Equal(t, "second: ", string(masked[offsets[1]:offsets[1]+8]))
+	require.Equal(t, "HIDDEN-BY-CIRRUS-CI", string(masked[offsets[2]:offsets[2]+19]))
+	require.Equal(t, "third\n", string(masked[offsets[3]:]))
+}
+
+func TestSpilledLogsAreMasked(t *testing.T) {
+	env := environment.New(map[string]string{})
+	env.AddSensitiveValues("secret")
+
+	uploader := LogUploader{
+		env:          env,
+		buffer:       newLogBuffer(1, 1024*1024),
+		GetTimestamp: time.Now,
+	}
+	defer uploader.buffer.Discard()
+
+	_, err := uploader.Write([]byte("first\n"))
+	require.NoError(t, err)
+	_, err = uploader.Write([]byte("password is secret\n"))
+	require.NoError(t, err)
+
+	require.NotNil(t, uploader.buffer.spill)
+
+	spilled, err := os.ReadFile(uploader.buffer.spill.Name())
+	require.NoError(t, err)
+	require.Contains(t, string(spilled), "password is HIDDEN-BY-CIRRUS-CI")
+	require.NotContains(t, string(spilled), "secret")
+}
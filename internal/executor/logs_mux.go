@@ -0,0 +1,359 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+	"sync"
+	"time"
+)
+
+const (
+	// How many bytes a single command can have queued before its producer blocks
+	maxQueuedBytesPerCommand = 1 * 1024 * 1024
+
+	// How many bytes of a single command to send before switching to the next one
+	maxBytesPerTurn = 64 * 1024
+
+	// How many consecutive failures to tolerate before giving up on the multiplexing
+	// and letting the commands fall back to streaming their logs on their own
+	maxMuxFailures = 3
+
+	// Initial delay before re-opening a failed stream, doubled after each failure
+	muxRetryDelay = 500 * time.Millisecond
+)
+
+// LogMultiplexer streams the logs of all commands from a single goroutine.
+//
+// Each command still gets its own StreamLogs RPC, which only ever carries
+// that command's log key followed by its chunks and is closed once the command
+// is flushed, so the server can finalize the command's log as usual. What is
+// shared is the scheduling: each command has its own bounded queue and the
+// commands are served in a round-robin fashion, so a noisy command can neither
+// starve the others nor consume unbounded memory, and the failures are handled
+// by a single circuit breaker instead of retrying for each command.
+//
+// This is experimental and only enabled with CIRRUS_LOG_MULTIPLEXING=true.
+type LogMultiplexer struct {
+	ctx                context.Context
+	taskIdentification *api.TaskIdentification
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	queues   map[string]*muxQueue
+	order    []string
+	cursor   int
+	inFlight string
+	closed   bool
+
+	// Per-command streams, opened when the first chunk of
+	// a command is sent and closed when that command is flushed
+	clients map[string]api.CirrusCIService_StreamLogsClient
+	done    chan struct{}
+
+	// Circuit breaker: the chunks are dropped instead of opening
+	// a new stream until retryAt and the multiplexing is disabled
+	// altogether after maxMuxFailures consecutive failures
+	failures int
+	retryAt  time.Time
+	disabled bool
+}
+
+type muxQueue struct {
+	chunks [][]byte
+	size   int
+}
+
+func NewLogMultiplexer(ctx context.Context, taskIdentification *api.TaskIdentification) *LogMultiplexer {
+	mux := &LogMultiplexer{
+		ctx:                ctx,
+		taskIdentification: taskIdentification,
+		queues:             map[string]*muxQueue{},
+		clients:            map[string]api.CirrusCIService_StreamLogsClient{},
+		done:               make(chan struct{}),
+	}
+	mux.cond = sync.NewCond(&mux.mtx)
+
+	go mux.run()
+
+	return mux
+}
+
+// Send queues the data for the specified command, blocking if the command already
+// has too many bytes queued. Returns false if the multiplexing was disabled due to
+// the repeated failures, in which case the caller should stream the data on its own.
+func (mux *LogMultiplexer) Send(commandName string, data []byte) bool {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+
+	if mux.disabled {
+		return false
+	}
+
+	queue, ok := mux.queues[commandName]
+	if !ok {
+		queue = &muxQueue{}
+		mux.queues[commandName] = queue
+		mux.order = append(mux.order, commandName)
+	}
+
+	for queue.size >= maxQueuedBytesPerCommand && !mux.closed && !mux.disabled {
+		mux.cond.Wait()
+	}
+
+	if mux.closed || mux.disabled {
+		return !mux.disabled
+	}
+
+	queue.chunks = append(queue.chunks, data)
+	queue.size += len(data)
+
+	mux.cond.Broadcast()
+
+	return true
+}
+
+// Disabled returns true once the multiplexing was given up due to the repeated failures.
+func (mux *LogMultiplexer) Disabled() bool {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+
+	return mux.disabled
+}
+
+// Flush waits until all the data queued for the specified command
+// is sent, closes the command's stream and forgets about the command.
+func (mux *LogMultiplexer) Flush(commandName string) {
+	mux.mtx.Lock()
+
+	for {
+		queue, ok := mux.queues[commandName]
+		if mux.closed || mux.disabled || !ok || (queue.size == 0 && mux.inFlight != commandName) {
+			break
+		}
+
+		mux.cond.Wait()
+	}
+
+	delete(mux.queues, commandName)
+
+	for i, name := range mux.order {
+		if name == commandName {
+			mux.order = append(mux.order[:i], mux.order[i+1:]...)
+
+			break
+		}
+	}
+
+	// Once closed, the remaining data is still being sent
+	// and the streams are closed by the run() goroutine
+	var streamLogClient api.CirrusCIService_StreamLogsClient
+	if !mux.closed {
+		streamLogClient = mux.takeClient(commandName)
+	}
+
+	mux.mtx.Unlock()
+
+	if streamLogClient != nil {
+		_, _ = streamLogClient.CloseAndRecv()
+	}
+}
+
+// Close sends the remaining data and terminates the stream, it is safe to call Close multiple times.
+func (mux *LogMultiplexer) Close() {
+	mux.mtx.Lock()
+	mux.closed = true
+	mux.cond.Broadcast()
+	mux.mtx.Unlock()
+
+	<-mux.done
+}
+
+func (mux *LogMultiplexer) run() {
+	for {
+		commandName, data, ok := mux.next()
+		if !ok {
+			break
+		}
+
+		mux.send(commandName, data)
+
+		mux.mtx.Lock()
+		mux.inFlight = ""
+		mux.cond.Broadcast()
+		mux.mtx.Unlock()
+	}
+
+	mux.mtx.Lock()
+	clients := mux.clients
+	mux.clients = map[string]api.CirrusCIService_StreamLogsClient{}
+	mux.mtx.Unlock()
+
+	for _, streamLogClient := range clients {
+		_, _ = streamLogClient.CloseAndRecv()
+	}
+
+	close(mux.done)
+}
+
+func (mux *LogMultiplexer) next() (string, []byte, bool) {
+	mux.mtx.Lock()
+	defer mux.mtx.Unlock()
+
+	for {
+		for i := 0; i < len(mux.order); i++ {
+			position := (mux.cursor + i) % len(mux.order)
+			commandName := mux.order[position]
+			queue := mux.queues[commandName]
+
+			if queue.size == 0 {
+				continue
+			}
+
+			var result []byte
+
+			for len(queue.chunks) > 0 && len(result) < maxBytesPerTurn {
+				result = append(result, queue.chunks[0]...)
+				queue.chunks = queue.chunks[1:]
+			}
+			queue.size -= len(result)
+
+			mux.cursor = position + 1
+			mux.inFlight = commandName
+			mux.cond.Broadcast()
+
+			return commandName, result, true
+		}
+
+		if mux.closed {
+			return "", nil, false
+		}
+
+		mux.cond.Wait()
+	}
+}
+
+func (mux *LogMultiplexer) send(commandName string, data []byte) {
+	if mux.Disabled() {
+		return
+	}
+
+	mux.mtx.Lock()
+	streamLogClient := mux.clients[commandName]
+	mux.mtx.Unlock()
+
+	if streamLogClient == nil {
+		// Don't hammer the server that keeps failing, the dropped
+		// logs will still be available thanks to the SaveLogs RPC
+		if time.Now().Before(mux.retryAt) {
+			return
+		}
+
+		var err error
+
+		streamLogClient, err = mux.connect(commandName)
+		if err != nil {
+			mux.fail(fmt.Sprintf("dropping %d bytes of %s logs", len(data), commandName), err)
+
+			return
+		}
+	}
+
+	dataChunk := api.DataChunk{Data: data}
+	logEntry := api.LogEntry_Chunk{Chunk: &dataChunk}
+	if err := streamLogClient.Send(&api.LogEntry{Value: &logEntry}); err != nil {
+		mux.reset(commandName, err)
+
+		return
+	}
+
+	mux.failures = 0
+}
+
+// connect opens a new stream for the specified command
+// and sends the command's log key as its first entry.
+func (mux *LogMultiplexer) connect(commandName string) (api.CirrusCIService_StreamLogsClient, error) {
+	streamLogClient, err := client.CirrusClient.StreamLogs(mux.ctx, grpc.UseCompressor(gzip.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	logEntryKey := api.LogEntry_LogKey{TaskIdentification: mux.taskIdentification, CommandName: commandName}
+	logEntry := api.LogEntry_Key{Key: &logEntryKey}
+	if err := streamLogClient.Send(&api.LogEntry{Value: &logEntry}); err != nil {
+		_ = streamLogClient.CloseSend()
+
+		return nil, err
+	}
+
+	mux.mtx.Lock()
+	mux.clients[commandName] = streamLogClient
+	mux.mtx.Unlock()
+
+	return streamLogClient, nil
+}
+
+// takeClient removes the stream of the specified command, if any, so that
+// only the caller closes it. Must be called with the mutex held.
+func (mux *LogMultiplexer) takeClient(commandName string) api.CirrusCIService_StreamLogsClient {
+	streamLogClient, ok := mux.clients[commandName]
+	if !ok {
+		return nil
+	}
+
+	delete(mux.clients, commandName)
+
+	return streamLogClient
+}
+
+// reset drops the broken stream, the next send for this command will open a new one. The logs
+// that weren't streamed will still be available thanks to the SaveLogs RPC.
+func (mux *LogMultiplexer) reset(commandName string, err error) {
+	mux.mtx.Lock()
+	streamLogClient := mux.takeClient(commandName)
+	mux.mtx.Unlock()
+
+	if streamLogClient != nil {
+		_ = streamLogClient.CloseSend()
+	}
+
+	mux.fail(fmt.Sprintf("failed to send %s logs", commandName), err)
+}
+
+// fail backs off exponentially before the next attempt to open the stream
+// and disables the multiplexing after too many consecutive failures.
+func (mux *LogMultiplexer) fail(action string, err error) {
+	mux.failures++
+
+	if mux.failures < maxMuxFailures {
+		delay := muxRetryDelay << (mux.failures - 1)
+		mux.retryAt = time.Now().Add(delay)
+
+		logger.Warnf("Multiplexed log streaming failed (%s), re-opening the stream in %v: %v", action, delay, err)
+
+		return
+	}
+
+	logger.Warnf("Multiplexed log streaming failed %d times in a row (%s), falling back to streaming "+
+		"the logs of each command separately: %v", mux.failures, action, err)
+
+	request := api.ReportAgentProblemRequest{
+		TaskIdentification: mux.taskIdentification,
+		Message:            fmt.Sprintf("Failed to stream multiplexed logs, falling back to streaming the logs of each command separately: %v", err),
+	}
+	_, _ = client.CirrusClient.ReportAgentWarning(mux.ctx, &request)
+
+	mux.mtx.Lock()
+	mux.disabled = true
+	// The queued logs are dropped (they are still available thanks to the SaveLogs RPC),
+	// this also unblocks the producers waiting for their queues to drain
+	for _, queue := range mux.queues {
+		queue.chunks = nil
+		queue.size = 0
+	}
+	mux.cond.Broadcast()
+	mux.mtx.Unlock()
+}
@@ -0,0 +1,145 @@
+package executor_test
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/executor"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type logRecorder struct {
+	mtx      sync.Mutex
+	streams  int
+	logs     map[string]string
+	finished []string
+	errors   []string
+
+	api.UnimplementedCirrusCIServiceServer
+}
+
+func (recorder *logRecorder) StreamLogs(server api.CirrusCIService_StreamLogsServer) error {
+	recorder.mtx.Lock()
+	recorder.streams++
+	recorder.mtx.Unlock()
+
+	var currentCommand string
+
+	for {
+		entry, err := server.Recv()
+		if err != nil {
+			recorder.mtx.Lock()
+			recorder.finished = append(recorder.finished, currentCommand)
+			recorder.mtx.Unlock()
+
+			return server.SendAndClose(&api.UploadLogsResponse{})
+		}
+
+		recorder.mtx.Lock()
+		switch value := entry.Value.(type) {
+		case *api.LogEntry_Key:
+			// Each stream is expected to carry the logs of a single command
+			if currentCommand != "" {
+				recorder.errors = append(recorder.errors, "key re-sent in the "+currentCommand+" stream")
+			}
+			currentCommand = value.Key.CommandName
+		case *api.LogEntry_Chunk:
+			if currentCommand == "" {
+				recorder.errors = append(recorder.errors, "chunk sent before the key")
+			}
+			recorder.logs[currentCommand] += string(value.Chunk.Data)
+		}
+		recorder.mtx.Unlock()
+	}
+}
+
+func TestLogMultiplexer(t *testing.T) {
+	recorder := &logRecorder{logs: map[string]string{}}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	api.RegisterCirrusCIServiceServer(server, recorder)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	client.InitClient(conn)
+
+	mux := executor.NewLogMultiplexer(context.Background(), &api.TaskIdentification{})
+
+	var wg sync.WaitGroup
+
+	for _, commandName := range []string{"first", "second"} {
+		commandName := commandName
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				mux.Send(commandName, []byte(commandName[:1]))
+			}
+
+			mux.Flush(commandName)
+		}()
+	}
+
+	wg.Wait()
+
+	// Flush closes the command's stream, so the server
+	// can finalize its log without waiting for Close
+	require.Eventually(t, func() bool {
+		recorder.mtx.Lock()
+		defer recorder.mtx.Unlock()
+
+		return len(recorder.finished) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	mux.Close()
+
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+
+	require.Empty(t, recorder.errors)
+	require.Equal(t, 2, recorder.streams)
+	require.ElementsMatch(t, []string{"first", "second"}, recorder.finished)
+	require.Len(t, recorder.logs["first"], 1000)
+	require.NotContains(t, recorder.logs["first"], "s")
+	require.Len(t, recorder.logs["second"], 1000)
+	require.NotContains(t, recorder.logs["second"], "f")
+}
+
+func TestLogMultiplexerDisablesItselfOnRepeatedFailures(t *testing.T) {
+	// Nothing listens on this address anymore, so opening the stream fails
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, lis.Close())
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	client.InitClient(conn)
+
+	mux := executor.NewLogMultiplexer(context.Background(), &api.TaskIdentification{})
+	defer mux.Close()
+
+	// The chunks sent during the backoff are dropped without
+	// re-opening the stream, so only a few attempts are made
+	require.Eventually(t, func() bool {
+		return !mux.Send("main", []byte("log"))
+	}, 10*time.Second, 10*time.Millisecond)
+	require.True(t, mux.Disabled())
+
+	// Flush doesn't block on the dropped logs
+	mux.Flush("main")
+}
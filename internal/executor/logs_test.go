@@ -1,8 +1,10 @@
 package executor_test
 
 import (
+	"bytes"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testing"
 	"time"
 )
@@ -63,3 +65,19 @@ func TestWithTimestamps(t *testing.T) {
 		})
 	}
 }
+
+func TestTimestampIndex(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("UTC+3", 3*60*60))
+
+	index := executor.NewTimestampIndex(start)
+	index.Add(0, start.Add(1500*time.Millisecond))
+	index.Add(42, start.Add(3*time.Second))
+
+	var buf bytes.Buffer
+	_, err := index.WriteTo(&buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, `{"offset":0,"timestamp":"2024-01-01T09:00:01.5Z","since_start_ns":1500000000}
+{"offset":42,"timestamp":"2024-01-01T09:00:03Z","since_start_ns":3000000000}
+`, buf.String())
+}
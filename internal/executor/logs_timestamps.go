@@ -0,0 +1,72 @@
+package executor
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// TimestampIndexSuffix is appended to the command name when saving the timestamp index,
+// so that it's stored alongside the command's log and not as a part of it.
+const TimestampIndexSuffix = ".timestamps"
+
+// TimestampIndex maps byte offsets in the command's log to the moments
+// these bytes were produced, which allows rendering absolute or relative
+// timestamps without splicing them into the log itself.
+type TimestampIndex struct {
+	start   time.Time
+	entries []TimestampIndexEntry
+}
+
+type TimestampIndexEntry struct {
+	Offset     int64         `json:"offset"`
+	Timestamp  time.Time     `json:"timestamp"`
+	SinceStart time.Duration `json:"since_start_ns"`
+}
+
+func NewTimestampIndex(start time.Time) *TimestampIndex {
+	return &TimestampIndex{
+		start: start,
+	}
+}
+
+func (index *TimestampIndex) Add(offset int64, timestamp time.Time) {
+	// Calculate the duration first, since UTC() strips the monotonic clock reading
+	sinceStart := timestamp.Sub(index.start)
+
+	index.entries = append(index.entries, TimestampIndexEntry{
+		Offset:     offset,
+		Timestamp:  timestamp.UTC(),
+		SinceStart: sinceStart,
+	})
+}
+
+func (index *TimestampIndex) Entries() []TimestampIndexEntry {
+	return index.entries
+}
+
+// WriteTo serializes the index as JSON lines, one entry per line.
+func (index *TimestampIndex) WriteTo(w io.Writer) (int64, error) {
+	countingWriter := &countingWriter{w: w}
+	encoder := json.NewEncoder(countingWriter)
+
+	for _, entry := range index.entries {
+		if err := encoder.Encode(&entry); err != nil {
+			return countingWriter.n, err
+		}
+	}
+
+	return countingWriter.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+
+	return n, err
+}
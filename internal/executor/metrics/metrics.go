@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/metrics/source"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/metrics/source/cgroup/cpu"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/metrics/source/cgroup/memory"
@@ -16,7 +17,6 @@ import (
 	gopsutilcpu "github.com/shirou/gopsutil/v3/cpu"
 	gopsutilmem "github.com/shirou/gopsutil/v3/mem"
 	"github.com/sirupsen/logrus"
-	"log"
 	"runtime"
 	"time"
 )
@@ -55,7 +55,7 @@ func Run(ctx context.Context, logger logrus.FieldLogger) chan *Result {
 	resolver, err := resolver.New()
 	if err != nil {
 		if runtime.GOOS == "linux" {
-			log.Printf("cgroup resolver initialization failed (%v), falling back to system-wide metrics collection",
+			agentlog.WithSubsystem("metrics").Warnf("cgroup resolver initialization failed (%v), falling back to system-wide metrics collection",
 				err)
 		}
 	} else {
@@ -0,0 +1,23 @@
+package executor
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/localcache"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/steplogs"
+)
+
+type Option func(executor *Executor)
+
+// WithStepLogs additionally stores each step's masked output in a local file.
+func WithStepLogs(stepLogs *steplogs.StepLogs) Option {
+	return func(executor *Executor) {
+		executor.stepLogs = stepLogs
+	}
+}
+
+// WithLocalCache makes the built-in HTTP cache keep the cache entries on disk
+// and serve them locally, which is useful for persistent workers.
+func WithLocalCache(localCache *localcache.LocalCache) Option {
+	return func(executor *Executor) {
+		executor.localCache = localCache
+	}
+}
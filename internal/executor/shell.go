@@ -8,7 +8,6 @@ import (
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/piper"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/executor/processdumper"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -93,7 +92,7 @@ func ShellCommandsAndWait(
 				handler([]byte(fmt.Sprintf("\nExit status: %d", exitStatus)))
 			}
 		} else {
-			log.Printf("Failed to get wait status: %v", cmd.ProcessState.Sys())
+			logger.Warnf("Failed to get wait status: %v", cmd.ProcessState.Sys())
 		}
 		return cmd, nil
 	}
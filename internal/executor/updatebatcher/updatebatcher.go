@@ -3,10 +3,12 @@ package updatebatcher
 import (
 	"context"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
-	"log"
 )
 
+var logger = agentlog.WithSubsystem("updatebatcher")
+
 type UpdateBatcher struct {
 	updateHistory    []*api.CommandResult
 	unflushedUpdates []*api.CommandResult
@@ -34,7 +36,7 @@ func (ub *UpdateBatcher) Flush(ctx context.Context, taskIdentification *api.Task
 		Updates:            ub.unflushedUpdates,
 	})
 	if err != nil {
-		log.Printf("Failed to report command updates: %v\n", err)
+		logger.Warnf("Failed to report command updates: %v", err)
 		return
 	}
 	ub.unflushedUpdates = ub.unflushedUpdates[:0]
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
 	"github.com/cirruslabs/cirrus-ci-annotations/model"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -30,7 +29,7 @@ func EnsureFolderExists(path string) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		err = os.MkdirAll(path, 0755)
 		if err != nil {
-			log.Printf("Failed to mkdir %s: %s", path, err)
+			logger.Warnf("Failed to mkdir %s: %s", path, err)
 		}
 	}
 }
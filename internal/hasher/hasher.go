@@ -2,11 +2,14 @@ package hasher
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"hash"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/excluder"
+	"golang.org/x/sync/errgroup"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 )
 
@@ -37,40 +40,90 @@ func (det DiffEntryType) String() string {
 }
 
 type Hasher struct {
-	globalHash hash.Hash
-	fileHashes map[string]string
+	// Relative paths in the order they were hashed, used to calculate the global hash
+	order       []string
+	files       map[string]ManifestEntry
+	excluder    *excluder.Excluder
+	manifest    map[string]ManifestEntry
+	reused      int
+	concurrency int
 }
 
-func New() *Hasher {
-	return &Hasher{
-		globalHash: sha256.New(),
-		fileHashes: make(map[string]string),
+type Option func(hasher *Hasher)
+
+// WithExcluder skips the files and directories excluded by the excluder.
+func WithExcluder(excluder *excluder.Excluder) Option {
+	return func(hasher *Hasher) {
+		hasher.excluder = excluder
+	}
+}
+
+// WithManifest re-uses the hashes from the manifest for the regular files
+// whose size and modification time match the ones recorded in the manifest.
+func WithManifest(manifest Manifest) Option {
+	return func(hasher *Hasher) {
+		hasher.manifest = make(map[string]ManifestEntry, len(manifest))
+
+		for _, entry := range manifest {
+			hasher.manifest[entry.Path] = entry
+		}
+	}
+}
+
+// WithConcurrency sets the number of files hashed in parallel, defaults to GOMAXPROCS.
+func WithConcurrency(concurrency int) Option {
+	return func(hasher *Hasher) {
+		hasher.concurrency = concurrency
+	}
+}
+
+func New(opts ...Option) *Hasher {
+	hasher := &Hasher{
+		files:       make(map[string]ManifestEntry),
+		concurrency: runtime.GOMAXPROCS(0),
 	}
+
+	for _, opt := range opts {
+		opt(hasher)
+	}
+
+	return hasher
 }
 
 func (hasher *Hasher) SHA() string {
-	digest := hasher.globalHash.Sum(nil)
-	return fmt.Sprintf("%x", digest)
+	globalHash := sha256.New()
+
+	for _, path := range hasher.order {
+		fileHash, _ := hex.DecodeString(hasher.files[path].Hash)
+		globalHash.Write(fileHash)
+	}
+
+	return fmt.Sprintf("%x", globalHash.Sum(nil))
 }
 
 func (hasher *Hasher) Len() int {
-	return len(hasher.fileHashes)
+	return len(hasher.files)
+}
+
+// Reused returns the number of file hashes that were taken from the manifest instead of being calculated.
+func (hasher *Hasher) Reused() int {
+	return hasher.reused
 }
 
 func (hasher *Hasher) DiffWithNewer(newer *Hasher) []DiffEntry {
 	var result []DiffEntry
 
-	for newPath, newHash := range newer.fileHashes {
-		oldHash, ok := hasher.fileHashes[newPath]
+	for newPath, newEntry := range newer.files {
+		oldEntry, ok := hasher.files[newPath]
 		if !ok {
 			result = append(result, DiffEntry{Type: Created, Path: newPath})
-		} else if newHash != oldHash {
+		} else if newEntry.Hash != oldEntry.Hash {
 			result = append(result, DiffEntry{Type: Modified, Path: newPath})
 		}
 	}
 
-	for oldPath := range hasher.fileHashes {
-		_, ok := newer.fileHashes[oldPath]
+	for oldPath := range hasher.files {
+		_, ok := newer.files[oldPath]
 		if !ok {
 			result = append(result, DiffEntry{Type: Deleted, Path: oldPath})
 		}
@@ -79,41 +132,107 @@ func (hasher *Hasher) DiffWithNewer(newer *Hasher) []DiffEntry {
 	return result
 }
 
+type hashJob struct {
+	path         string
+	relativePath string
+	info         os.FileInfo
+	entry        ManifestEntry
+	skip         bool
+}
+
 func (hasher *Hasher) AddFolder(baseFolder string, folderPath string) error {
 	if _, err := os.Stat(folderPath); os.IsNotExist(err) {
 		return nil
 	}
-	return filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+
+	var jobs []*hashJob
+
+	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
+		if hasher.excluder.Excluded(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		fileHash, err := fileHash(path)
-		// symlink can still be a directory
-		if err != nil && strings.Contains(err.Error(), "is a directory") {
+		if info.IsDir() {
 			return nil
 		}
-		if err != nil && os.IsNotExist(err) && (info.Mode()&os.ModeSymlink != 0) {
-			destination, linkErr := os.Readlink(path)
-			if linkErr == nil {
-				hasher := sha256.New()
-				_, err = hasher.Write([]byte(destination))
-				fileHash = hasher.Sum(nil)
-			}
-		}
-		if err != nil {
-			return err
-		}
 		relativePath, err := filepath.Rel(baseFolder, path)
 		if err != nil {
 			return err
 		}
-		hasher.fileHashes[relativePath] = fmt.Sprintf("%x", fileHash)
-		_, err = hasher.globalHash.Write(fileHash)
-		return err
+		jobs = append(jobs, &hashJob{path: path, relativePath: relativePath, info: info})
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	var group errgroup.Group
+	group.SetLimit(max(hasher.concurrency, 1))
+
+	for _, job := range jobs {
+		if manifestEntry, ok := hasher.manifest[filepath.ToSlash(job.relativePath)]; ok && job.info.Mode().IsRegular() &&
+			manifestEntry.Size == job.info.Size() && manifestEntry.ModTime == job.info.ModTime().UnixNano() {
+			job.entry = manifestEntry
+			hasher.reused++
+
+			continue
+		}
+
+		job := job
+
+		group.Go(func() error {
+			return job.hash()
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.skip {
+			continue
+		}
+
+		hasher.files[job.relativePath] = job.entry
+		hasher.order = append(hasher.order, job.relativePath)
+	}
+
+	return nil
+}
+
+func (job *hashJob) hash() error {
+	fileHash, err := fileHash(job.path)
+	// symlink can still be a directory
+	if err != nil && strings.Contains(err.Error(), "is a directory") {
+		job.skip = true
+		return nil
+	}
+	if err != nil && os.IsNotExist(err) && (job.info.Mode()&os.ModeSymlink != 0) {
+		destination, linkErr := os.Readlink(job.path)
+		if linkErr == nil {
+			hasher := sha256.New()
+			_, err = hasher.Write([]byte(destination))
+			fileHash = hasher.Sum(nil)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	job.entry = ManifestEntry{
+		Path:    filepath.ToSlash(job.relativePath),
+		Size:    job.info.Size(),
+		ModTime: job.info.ModTime().UnixNano(),
+		Hash:    fmt.Sprintf("%x", fileHash),
+	}
+
+	return nil
 }
 
 func fileHash(path string) ([]byte, error) {
@@ -1,12 +1,16 @@
 package hasher_test
 
 import (
+	"bytes"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/excluder"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/hasher"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestDiffWithNewer(t *testing.T) {
@@ -105,3 +109,76 @@ func TestDiffWithNewer(t *testing.T) {
 		})
 	}
 }
+
+func TestExcluder(t *testing.T) {
+	oldDir := testutil.TempDir(t)
+	os.WriteFile(filepath.Join(oldDir, "control.txt"), []byte("control sample"), 0600)
+	os.WriteFile(filepath.Join(oldDir, "yarn.lock"), []byte("old lock"), 0600)
+
+	newDir := testutil.TempDir(t)
+	os.WriteFile(filepath.Join(newDir, "control.txt"), []byte("control sample"), 0600)
+	os.WriteFile(filepath.Join(newDir, "yarn.lock"), []byte("new lock"), 0600)
+	os.MkdirAll(filepath.Join(newDir, "build", "tmp"), 0700)
+	os.WriteFile(filepath.Join(newDir, "build", "tmp", "output.bin"), []byte("output"), 0600)
+
+	hashFolder := func(dir string) *hasher.Hasher {
+		fileExcluder, err := excluder.New(dir, []string{"*.lock", "build/tmp"})
+		require.NoError(t, err)
+
+		fileHasher := hasher.New(hasher.WithExcluder(fileExcluder))
+		require.NoError(t, fileHasher.AddFolder(dir, dir))
+
+		return fileHasher
+	}
+
+	oldHasher := hashFolder(oldDir)
+	newHasher := hashFolder(newDir)
+
+	assert.Empty(t, oldHasher.DiffWithNewer(newHasher))
+	assert.Equal(t, oldHasher.SHA(), newHasher.SHA())
+}
+
+func TestManifest(t *testing.T) {
+	dir := testutil.TempDir(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "unchanged.txt"), []byte("unchanged"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "touched.txt"), []byte("touched"), 0600))
+
+	oldHasher := hasher.New()
+	require.NoError(t, oldHasher.AddFolder(dir, dir))
+	require.Equal(t, 0, oldHasher.Reused())
+
+	// Round-trip the manifest through its serialized form
+	var buf bytes.Buffer
+	_, err := oldHasher.Manifest().WriteTo(&buf)
+	require.NoError(t, err)
+	manifest, err := hasher.ReadManifest(&buf)
+	require.NoError(t, err)
+	require.Equal(t, oldHasher.Manifest(), manifest)
+
+	// Nothing has changed, so nothing should be re-hashed
+	sameHasher := hasher.New(hasher.WithManifest(manifest))
+	require.NoError(t, sameHasher.AddFolder(dir, dir))
+	require.Equal(t, 2, sameHasher.Reused())
+	require.Equal(t, oldHasher.SHA(), sameHasher.SHA())
+	require.Empty(t, oldHasher.DiffWithNewer(sameHasher))
+
+	// The file with a new modification time is re-hashed
+	touchedPath := filepath.Join(dir, "sub", "touched.txt")
+	require.NoError(t, os.WriteFile(touchedPath, []byte("changed"), 0600))
+	newModTime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(touchedPath, newModTime, newModTime))
+
+	newHasher := hasher.New(hasher.WithManifest(manifest))
+	require.NoError(t, newHasher.AddFolder(dir, dir))
+	require.Equal(t, 1, newHasher.Reused())
+	require.Equal(t, []hasher.DiffEntry{
+		{hasher.Modified, filepath.Join("sub", "touched.txt")},
+	}, oldHasher.DiffWithNewer(newHasher))
+
+	// ...and results in the same hashes as when hashing from scratch
+	scratchHasher := hasher.New(hasher.WithConcurrency(1))
+	require.NoError(t, scratchHasher.AddFolder(dir, dir))
+	require.Equal(t, scratchHasher.SHA(), newHasher.SHA())
+	require.Equal(t, scratchHasher.Manifest(), newHasher.Manifest())
+}
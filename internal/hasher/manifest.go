@@ -0,0 +1,82 @@
+package hasher
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// Manifest records the hashes of the files along with their sizes and modification times,
+// which allows to avoid re-hashing the files that haven't changed since the manifest was made.
+type Manifest []ManifestEntry
+
+type ManifestEntry struct {
+	// Slash-separated path relative to the base folder
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Modification time in nanoseconds since the Unix epoch
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+// Manifest returns the manifest of the files hashed so far, sorted by path.
+func (hasher *Hasher) Manifest() Manifest {
+	result := make(Manifest, 0, len(hasher.files))
+
+	for _, entry := range hasher.files {
+		result = append(result, entry)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+
+	return result
+}
+
+// WriteTo writes a gzip-compressed JSON representation of the manifest.
+func (manifest Manifest) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+
+	gzipWriter := gzip.NewWriter(counter)
+
+	if err := json.NewEncoder(gzipWriter).Encode(manifest); err != nil {
+		return counter.n, err
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return counter.n, err
+	}
+
+	return counter.n, nil
+}
+
+// ReadManifest reads the manifest written by Manifest.WriteTo().
+func ReadManifest(r io.Reader) (Manifest, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	var manifest Manifest
+
+	if err := json.NewDecoder(gzipReader).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	writer.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,182 @@
+package http_cache
+
+import (
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var encryptionKey *cachecrypt.Key
+
+// WithEncryption makes the HTTP cache encrypt the uploaded entries and decrypt
+// the downloaded ones using the specified key, so that the cache storage
+// only ever sees the ciphertext.
+func WithEncryption(key *cachecrypt.Key) Option {
+	return func() {
+		encryptionKey = key
+	}
+}
+
+func encryptionHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if encryptionKey == nil {
+			next(w, r)
+
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			downloadDecrypted(w, r, next)
+		case http.MethodHead:
+			next(&decryptedSizeResponseWriter{ResponseWriter: w}, r)
+		case http.MethodPost, http.MethodPut:
+			if r.ContentLength >= 0 {
+				r.ContentLength = cachecrypt.EncryptedSize(r.ContentLength)
+			}
+			r.Body = cachecrypt.NewEncryptingReader(r.Body, encryptionKey)
+
+			next(w, r)
+		default:
+			next(w, r)
+		}
+	}
+}
+
+func downloadDecrypted(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	// The segments can only be decrypted as a whole,
+	// so always serve the complete entry instead of a range
+	r.Header.Del("Range")
+
+	decryptingWriter := &decryptingResponseWriter{ResponseWriter: w}
+	decryptingWriter.decrypter = cachecrypt.NewDecryptingWriter(decryptingWriter.forwarder(), encryptionKey)
+
+	next(decryptingWriter, r)
+
+	err := decryptingWriter.Close()
+	if err == nil {
+		return
+	}
+
+	key := r.URL.Path[1:]
+
+	if !decryptingWriter.forwarded {
+		if errors.Is(err, cachecrypt.ErrKeyMismatch) || errors.Is(err, cachecrypt.ErrNotEncrypted) {
+			logger.Warnf("Treating %s as a cache miss: %v", key, err)
+		} else {
+			logger.Warnf("Failed to decrypt %s cache entry: %v", key, err)
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	// Abort the response so that the client won't mistake
+	// a partially decrypted entry for a complete one
+	logger.Warnf("Failed to decrypt %s cache entry midway: %v", key, err)
+
+	panic(http.ErrAbortHandler)
+}
+
+// decryptingResponseWriter decrypts the successful responses, the status is only
+// forwarded once the entry's header is verified, so that entries encrypted with
+// a different key can still be reported as missing.
+type decryptingResponseWriter struct {
+	http.ResponseWriter
+	decrypter io.WriteCloser
+	status    int
+	forwarded bool
+	err       error
+}
+
+func (writer *decryptingResponseWriter) WriteHeader(statusCode int) {
+	if writer.status != 0 {
+		return
+	}
+	writer.status = statusCode
+
+	if statusCode != http.StatusOK {
+		writer.forwarded = true
+		writer.ResponseWriter.WriteHeader(statusCode)
+
+		return
+	}
+
+	// The length of the decrypted entry is different
+	writer.Header().Del("Content-Length")
+}
+
+func (writer *decryptingResponseWriter) Write(p []byte) (int, error) {
+	if writer.status == 0 {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	if writer.status != http.StatusOK {
+		return writer.ResponseWriter.Write(p)
+	}
+
+	if writer.err != nil {
+		return 0, writer.err
+	}
+
+	n, err := writer.decrypter.Write(p)
+	if err != nil {
+		writer.err = err
+	}
+
+	return n, err
+}
+
+func (writer *decryptingResponseWriter) Close() error {
+	if writer.status != http.StatusOK {
+		return nil
+	}
+
+	if writer.err == nil {
+		writer.err = writer.decrypter.Close()
+	}
+
+	if writer.err == nil && !writer.forwarded {
+		writer.forwarded = true
+		writer.ResponseWriter.WriteHeader(http.StatusOK)
+	}
+
+	return writer.err
+}
+
+func (writer *decryptingResponseWriter) forwarder() io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		if !writer.forwarded {
+			writer.forwarded = true
+			writer.ResponseWriter.WriteHeader(http.StatusOK)
+		}
+
+		return writer.ResponseWriter.Write(p)
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// decryptedSizeResponseWriter reports the size of the decrypted entry in HEAD responses.
+type decryptedSizeResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (writer *decryptedSizeResponseWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusOK {
+		if size, err := strconv.ParseInt(writer.Header().Get("Content-Length"), 10, 64); err == nil {
+			if decryptedSize, err := cachecrypt.DecryptedSize(size); err == nil {
+				writer.Header().Set("Content-Length", strconv.FormatInt(decryptedSize, 10))
+			}
+		}
+	}
+
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
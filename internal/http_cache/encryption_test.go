@@ -0,0 +1,84 @@
+package http_cache_test
+
+import (
+	"bytes"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/cachecrypt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/ghacache/cirruscimock"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	client.InitClient(cirruscimock.ClientConn(t))
+
+	key, err := cachecrypt.NewKey("0123456789abcdef0123456789abcdef")
+	require.NoError(t, err)
+	otherKey, err := cachecrypt.NewKey("fedcba9876543210fedcba9876543210")
+	require.NoError(t, err)
+
+	httpCacheURL := "http://" + http_cache.Start(&api.TaskIdentification{}, http_cache.WithEncryption(key)) + "/"
+	t.Cleanup(http_cache.WithEncryption(nil))
+
+	get := func(key string, rangeHeader string) (int, []byte) {
+		req, err := http.NewRequest(http.MethodGet, httpCacheURL+key, nil)
+		require.NoError(t, err)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		return resp.StatusCode, body
+	}
+
+	cacheValue := bytes.Repeat([]byte("Hello, World!\n"), 10000)
+
+	resp, err := http.Post(httpCacheURL+"encrypted", "application/octet-stream", bytes.NewReader(cacheValue))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// Entries are transparently decrypted, even when only a range was requested
+	status, body := get("encrypted", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, cacheValue, body)
+
+	status, body = get("encrypted", "bytes=0-99")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, cacheValue, body)
+
+	resp, err = http.Head(httpCacheURL + "encrypted")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, strconv.Itoa(len(cacheValue)), resp.Header.Get("Content-Length"))
+
+	// Entries encrypted with a different key are treated as missing
+	http_cache.WithEncryption(otherKey)()
+	status, _ = get("encrypted", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// The storage only sees the ciphertext
+	http_cache.WithEncryption(nil)()
+	status, body = get("encrypted", "")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, cachecrypt.IsEncrypted(body))
+	require.NotContains(t, string(body), "Hello, World!")
+
+	resp, err = http.Post(httpCacheURL+"plaintext", "application/octet-stream", bytes.NewReader(cacheValue))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	// Unencrypted entries are treated as missing
+	http_cache.WithEncryption(key)()
+	status, _ = get("plaintext", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
@@ -2,11 +2,11 @@ package ghacache
 
 import (
 	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/ghacache/uploadable"
 	"github.com/go-chi/render"
 	"github.com/puzpuzpuz/xsync/v3"
 	"io"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -23,6 +23,8 @@ const (
 	jsNumberMaxSafeInteger = 9007199254740991
 )
 
+var logger = agentlog.WithSubsystem("ghacache")
+
 type GHACache struct {
 	cacheHost   string
 	mux         *http.ServeMux
@@ -247,7 +249,7 @@ func getID(request *http.Request) (int64, bool) {
 func fail(writer http.ResponseWriter, request *http.Request, status int, format string, args ...interface{}) {
 	message := fmt.Sprintf(format, args...)
 
-	log.Println(message)
+	logger.Warn(message)
 
 	writer.WriteHeader(status)
 	jsonResp := struct {
@@ -6,17 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/agentlog"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/ghacache"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/rangedownload"
 	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -32,9 +34,29 @@ var sem = semaphore.NewWeighted(int64(runtime.NumCPU() * activeRequestsPerLogica
 
 var httpProxyClient = &http.Client{}
 
-func Start(taskIdentification *api.TaskIdentification) string {
+var logger = agentlog.WithSubsystem("http_cache")
+
+var downloadConcurrency = rangedownload.DefaultConcurrency
+
+var rangeDownloadURLs = newURLCache(time.Minute)
+
+type Option func()
+
+// WithDownloadConcurrency sets the number of concurrent Range requests used
+// to download a single cache entry, 1 disables the ranged downloads.
+func WithDownloadConcurrency(concurrency int) Option {
+	return func() {
+		downloadConcurrency = concurrency
+	}
+}
+
+func Start(taskIdentification *api.TaskIdentification, opts ...Option) string {
 	cirrusTaskIdentification = taskIdentification
 
+	for _, opt := range opts {
+		opt()
+	}
+
 	maxConcurrentConnections := runtime.NumCPU() * activeRequestsPerLogicalCPU
 	httpProxyClient = &http.Client{
 		Transport: &http.Transport{
@@ -47,26 +69,26 @@ func Start(taskIdentification *api.TaskIdentification) string {
 	mux := http.NewServeMux()
 
 	// HTTP cache protocol
-	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/", encryptionHandler(handler))
 
 	address := "127.0.0.1:12321"
 	listener, err := net.Listen("tcp", address)
 
 	if err != nil {
-		log.Printf("Port 12321 is occupied: %s. Looking for another one...\n", err)
+		logger.Infof("Port 12321 is occupied: %s. Looking for another one...", err)
 		listener, err = net.Listen("tcp", "127.0.0.1:0")
 	}
 	if err == nil {
 		address = listener.Addr().String()
-		log.Printf("Starting http cache server %s\n", address)
+		logger.Infof("Starting http cache server %s", address)
 
 		// GitHub Actions cache API
 		mux.Handle(ghacache.APIMountPoint+"/", http.StripPrefix(ghacache.APIMountPoint,
 			ghacache.New(address)))
 
-		go http.Serve(listener, mux)
+		go http.Serve(listener, readOnlyHandler(mux))
 	} else {
-		log.Printf("Failed to start http cache server %s: %s\n", address, err)
+		logger.Warnf("Failed to start http cache server %s: %s", address, err)
 	}
 	return address
 }
@@ -74,7 +96,7 @@ func Start(taskIdentification *api.TaskIdentification) string {
 func handler(w http.ResponseWriter, r *http.Request) {
 	// Limit request concurrency
 	if err := sem.Acquire(r.Context(), 1); err != nil {
-		log.Printf("Failed to acquite the semaphore: %s\n", err)
+		logger.Warnf("Failed to acquite the semaphore: %s", err)
 		if errors.Is(err, context.Canceled) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -98,10 +120,14 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if r.Method == http.MethodGet {
+	if r.Method == http.MethodGet && localCache != nil {
+		downloadCacheViaLocalCache(w, r, key)
+	} else if r.Method == http.MethodGet {
 		downloadCache(w, r, key)
 	} else if r.Method == http.MethodHead {
 		checkCacheExists(w, key)
+	} else if (r.Method == http.MethodPost || r.Method == http.MethodPut) && localCache != nil {
+		uploadCacheEntryViaLocalCache(w, r, key)
 	} else if r.Method == http.MethodPost {
 		uploadCacheEntry(w, r, key)
 	} else if r.Method == http.MethodPut {
@@ -109,7 +135,7 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == http.MethodDelete {
 		deleteCacheEntry(w, key)
 	} else {
-		log.Printf("Not supported request method: %s\n", r.Method)
+		logger.Warnf("Not supported request method: %s", r.Method)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
@@ -121,7 +147,7 @@ func checkCacheExists(w http.ResponseWriter, cacheKey string) {
 	}
 	response, err := client.CirrusClient.CacheInfo(context.Background(), &cacheInfoRequest)
 	if err != nil {
-		log.Printf("%s cache info failed: %v\n", cacheKey, err)
+		logger.Warnf("%s cache info failed: %v", cacheKey, err)
 		w.WriteHeader(http.StatusNotFound)
 	} else {
 		if response.Info.CreatedByTaskId > 0 {
@@ -133,17 +159,28 @@ func checkCacheExists(w http.ResponseWriter, cacheKey string) {
 }
 
 func downloadCache(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	// Clients doing ranged downloads issue many requests for the same
+	// cache entry, so avoid generating the download URLs for each of them
+	isRangeRequest := r.Header.Get("Range") != ""
+	if isRangeRequest {
+		if urls, ok := rangeDownloadURLs.Load(cacheKey); ok {
+			proxyDownloadFromURLs(w, r, urls)
+
+			return
+		}
+	}
+
 	key := api.CacheKey{
 		TaskIdentification: cirrusTaskIdentification,
 		CacheKey:           cacheKey,
 	}
 	response, err := client.CirrusClient.GenerateCacheDownloadURLs(context.Background(), &key)
 	if err != nil {
-		log.Printf("%s cache download failed: %v\n", cacheKey, err)
+		logger.Warnf("%s cache download failed: %v", cacheKey, err)
 
 		// RPC fallback
 		if status.Code(err) == codes.Unimplemented {
-			log.Println("Falling back to downloading cache over RPC...")
+			logger.Info("Falling back to downloading cache over RPC...")
 			downloadCacheViaRPC(w, r, cacheKey)
 
 			return
@@ -151,43 +188,86 @@ func downloadCache(w http.ResponseWriter, r *http.Request, cacheKey string) {
 
 		w.WriteHeader(http.StatusNotFound)
 	} else {
-		log.Printf("Redirecting cache download of %s\n", cacheKey)
-		proxyDownloadFromURLs(w, response.Urls)
+		if isRangeRequest {
+			rangeDownloadURLs.Store(cacheKey, response.Urls)
+		} else {
+			logger.Infof("Redirecting cache download of %s", cacheKey)
+		}
+		proxyDownloadFromURLs(w, r, response.Urls)
 	}
 }
 
-func proxyDownloadFromURLs(w http.ResponseWriter, urls []string) {
+func proxyDownloadFromURLs(w http.ResponseWriter, r *http.Request, urls []string) {
 	for _, url := range urls {
-		if proxyDownloadFromURL(w, url) {
+		if proxyDownloadFromURL(w, r, url) {
 			return
 		}
 	}
 	w.WriteHeader(http.StatusNotFound)
 }
 
-func proxyDownloadFromURL(w http.ResponseWriter, url string) bool {
-	resp, err := httpProxyClient.Get(url)
+func proxyDownloadFromURL(w http.ResponseWriter, r *http.Request, url string) bool {
+	// The client is doing the ranged downloads itself
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		return proxyRangeFromURL(w, r, url, rangeHeader)
+	}
+
+	body, err := rangedownload.Open(r.Context(), httpProxyClient, url, downloadConcurrency, rangedownload.DefaultPartSize)
 	if err != nil {
-		log.Printf("Proxying cache %s failed: %v\n", url, err)
+		var statusErr *rangedownload.StatusError
+		if errors.As(err, &statusErr) {
+			logger.Warnf("Proxying cache %s failed with %d status", url, statusErr.StatusCode)
+		} else {
+			logger.Warnf("Proxying cache %s failed: %v", url, err)
+		}
+		return false
+	}
+	defer body.Close()
+	w.WriteHeader(http.StatusOK)
+	bytesRead, err := io.Copy(w, body)
+	if err != nil {
+		logger.Warnf("Proxying cache download for %s failed with %v", url, err)
+	} else {
+		logger.Infof("Proxying cache %s succeded! Proxies %d bytes!", url, bytesRead)
+	}
+	return true
+}
+
+func proxyRangeFromURL(w http.ResponseWriter, r *http.Request, url string, rangeHeader string) bool {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		logger.Warnf("Proxying cache %s failed: %v", url, err)
+		return false
+	}
+	req.Header.Set("Range", rangeHeader)
+
+	resp, err := httpProxyClient.Do(req)
+	if err != nil {
+		logger.Warnf("Proxying cache %s failed: %v", url, err)
 		return false
 	}
 	defer resp.Body.Close()
 	successfulStatus := 100 <= resp.StatusCode && resp.StatusCode < 300
 	if !successfulStatus {
-		log.Printf("Proxying cache %s failed with %d status\n", url, resp.StatusCode)
+		logger.Warnf("Proxying cache %s failed with %d status", url, resp.StatusCode)
 		return false
 	}
+	for _, header := range []string{"Content-Length", "Content-Range"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
 	w.WriteHeader(resp.StatusCode)
-	bytesRead, err := io.Copy(w, resp.Body)
-	if err != nil {
-		log.Printf("Proxying cache download for %s failed with %v\n", url, err)
-	} else {
-		log.Printf("Proxying cache %s succeded! Proxies %d bytes!\n", url, bytesRead)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.Warnf("Proxying cache download for %s (%s) failed with %v", url, rangeHeader, err)
 	}
 	return true
 }
 
 func uploadCacheEntry(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	// The download URLs might point to the previous contents of the entry
+	rangeDownloadURLs.Delete(cacheKey)
+
 	key := api.CacheKey{
 		TaskIdentification: cirrusTaskIdentification,
 		CacheKey:           cacheKey,
@@ -195,11 +275,11 @@ func uploadCacheEntry(w http.ResponseWriter, r *http.Request, cacheKey string) {
 	generateResp, err := client.CirrusClient.GenerateCacheUploadURL(context.Background(), &key)
 	if err != nil {
 		errorMsg := fmt.Sprintf("Failed to initialized uploading of %s cache! %s", cacheKey, err)
-		log.Println(errorMsg)
+		logger.Warn(errorMsg)
 
 		// RPC fallback
 		if status.Code(err) == codes.Unimplemented {
-			log.Println("Falling back to uploading cache over RPC...")
+			logger.Info("Falling back to uploading cache over RPC...")
 			uploadCacheEntryViaRPC(w, r, cacheKey)
 
 			return
@@ -211,7 +291,7 @@ func uploadCacheEntry(w http.ResponseWriter, r *http.Request, cacheKey string) {
 	}
 	req, err := http.NewRequest("PUT", generateResp.Url, bufio.NewReader(r.Body))
 	if err != nil {
-		log.Printf("%s cache upload failed: %v\n", cacheKey, err)
+		logger.Warnf("%s cache upload failed: %v", cacheKey, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -223,22 +303,29 @@ func uploadCacheEntry(w http.ResponseWriter, r *http.Request, cacheKey string) {
 	resp, err := httpProxyClient.Do(req)
 	if err != nil {
 		errorMsg := fmt.Sprintf("Failed to proxy upload of %s cache! %s", cacheKey, err)
-		log.Println(errorMsg)
+		logger.Warn(errorMsg)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(errorMsg))
 		return
 	}
 	if resp.StatusCode >= 400 {
-		log.Printf("Failed to proxy upload of %s cache! %s", cacheKey, resp.Status)
-		log.Printf("Headers for PUT request to  %s\n", generateResp.Url)
-		req.Header.Write(log.Writer())
-		log.Println("Failed response:")
-		resp.Write(log.Writer())
+		var requestHeaders, failedResponse strings.Builder
+		_ = req.Header.Write(&requestHeaders)
+		_ = resp.Write(&failedResponse)
+		logger.Warnf("Failed to proxy upload of %s cache! %s", cacheKey, resp.Status)
+		logger.Warnf("Headers for PUT request to %s:\n%s", generateResp.Url, requestHeaders.String())
+		logger.Warnf("Failed response:\n%s", failedResponse.String())
 	}
 	w.WriteHeader(resp.StatusCode)
 }
 
 func deleteCacheEntry(w http.ResponseWriter, cacheKey string) {
+	rangeDownloadURLs.Delete(cacheKey)
+
+	if localCache != nil {
+		localCache.Remove(cacheKey)
+	}
+
 	request := api.DeleteCacheRequest{
 		TaskIdentification: cirrusTaskIdentification,
 		CacheKey:           cacheKey,
@@ -247,7 +334,7 @@ func deleteCacheEntry(w http.ResponseWriter, cacheKey string) {
 	_, err := client.CirrusClient.DeleteCache(context.Background(), &request)
 	if err != nil {
 		errorMsg := fmt.Sprintf("Failed to delete cache entry %s: %v", cacheKey, err)
-		log.Println(errorMsg)
+		logger.Warn(errorMsg)
 
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(errorMsg))
@@ -0,0 +1,175 @@
+package http_cache
+
+import (
+	"context"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/localcache"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"net/http"
+	"time"
+)
+
+var localCache *localcache.LocalCache
+
+var localCachePopulation singleflight.Group
+
+// WithLocalCache makes the HTTP cache keep the entries it has served
+// or uploaded in the specified local cache and serve them from there.
+func WithLocalCache(cache *localcache.LocalCache) Option {
+	return func() {
+		localCache = cache
+	}
+}
+
+func downloadCacheViaLocalCache(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	// Validate the local entry against the server's view of it
+	cacheInfoRequest := api.CacheInfoRequest{
+		TaskIdentification: cirrusTaskIdentification,
+		CacheKey:           cacheKey,
+	}
+	response, err := client.CirrusClient.CacheInfo(context.Background(), &cacheInfoRequest)
+	if err != nil {
+		logger.Warnf("%s cache info failed, bypassing the local cache: %v", cacheKey, err)
+		downloadCache(w, r, cacheKey)
+
+		return
+	}
+
+	expected := localcache.Metadata{
+		Key:             cacheKey,
+		SizeInBytes:     response.Info.SizeInBytes,
+		CreatedByTaskID: response.Info.CreatedByTaskId,
+	}
+
+	file, ok := localCache.Open(expected)
+	if ok {
+		hits, misses := localCache.Stats()
+		logger.Infof("Local cache hit for %s (%d hits and %d misses so far)", cacheKey, hits, misses)
+	} else {
+		hits, misses := localCache.Stats()
+		logger.Infof("Local cache miss for %s (%d hits and %d misses so far)", cacheKey, hits, misses)
+
+		// Download the whole entry first, even if only a range of it was requested,
+		// this also deduplicates the downloads when serving concurrent Range requests
+		_, err, _ := localCachePopulation.Do(cacheKey, func() (interface{}, error) {
+			return nil, populateLocalCache(r, expected)
+		})
+		if err != nil {
+			logger.Warnf("Failed to store %s in the local cache: %v", cacheKey, err)
+		}
+
+		file, ok = localCache.Open(expected)
+		if !ok {
+			downloadCache(w, r, cacheKey)
+
+			return
+		}
+	}
+	defer file.Close()
+
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+func populateLocalCache(r *http.Request, expected localcache.Metadata) error {
+	entry, err := localCache.Create(expected.Key)
+	if err != nil {
+		return err
+	}
+
+	// The population is shared between the concurrent requests,
+	// so it shouldn't be canceled when one of them is canceled
+	populationRequest := r.Clone(context.WithoutCancel(r.Context()))
+	populationRequest.Header.Del("Range")
+
+	recorder := &entryResponseWriter{header: http.Header{}, w: entry}
+	downloadCache(recorder, populationRequest, expected.Key)
+
+	if recorder.status != http.StatusOK || recorder.written != expected.SizeInBytes {
+		entry.Discard()
+
+		return nil
+	}
+
+	return entry.Commit(expected.CreatedByTaskID)
+}
+
+func uploadCacheEntryViaLocalCache(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	entry, err := localCache.Create(cacheKey)
+	if err != nil {
+		logger.Warnf("Failed to store %s in the local cache: %v", cacheKey, err)
+		uploadCacheEntry(w, r, cacheKey)
+
+		return
+	}
+
+	// Write through
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(r.Body, entry), r.Body}
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	uploadCacheEntry(recorder, r, cacheKey)
+
+	if recorder.status >= http.StatusBadRequest {
+		entry.Discard()
+
+		return
+	}
+
+	if err := entry.Commit(cirrusTaskIdentification.GetTaskId()); err != nil {
+		logger.Warnf("Failed to store %s in the local cache: %v", cacheKey, err)
+	}
+}
+
+// entryResponseWriter captures the response into a local cache entry.
+type entryResponseWriter struct {
+	header  http.Header
+	status  int
+	w       io.Writer
+	written int64
+}
+
+func (erw *entryResponseWriter) Header() http.Header {
+	return erw.header
+}
+
+func (erw *entryResponseWriter) WriteHeader(statusCode int) {
+	if erw.status == 0 {
+		erw.status = statusCode
+	}
+}
+
+func (erw *entryResponseWriter) Write(p []byte) (int, error) {
+	if erw.status == 0 {
+		erw.status = http.StatusOK
+	}
+
+	n, err := erw.w.Write(p)
+	erw.written += int64(n)
+
+	return n, err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if sr.status == 0 {
+		sr.status = statusCode
+	}
+
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+
+	return sr.ResponseWriter.Write(p)
+}
@@ -0,0 +1,76 @@
+package http_cache_test
+
+import (
+	"bytes"
+	"github.com/cirruslabs/cirrus-ci-agent/api"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/client"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/ghacache/cirruscimock"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/localcache"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestLocalCache(t *testing.T) {
+	client.InitClient(cirruscimock.ClientConn(t))
+
+	localCache, err := localcache.New(t.TempDir(), 1024*1024)
+	require.NoError(t, err)
+
+	httpCacheURL := "http://" + http_cache.Start(&api.TaskIdentification{},
+		http_cache.WithLocalCache(localCache)) + "/"
+
+	cacheValue := []byte("Hello, World!\n")
+
+	// Entries that don't exist on the server are not served
+	resp, err := http.Get(httpCacheURL + "key")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Uploads are written through to the local cache
+	resp, err = http.Post(httpCacheURL+"key", "application/octet-stream", bytes.NewReader(cacheValue))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	hitsBefore, _ := localCache.Stats()
+
+	resp, err = http.Get(httpCacheURL + "key")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, cacheValue, body)
+
+	// Ranges are served from the local cache too
+	req, err := http.NewRequest(http.MethodGet, httpCacheURL+"key", nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=7-12")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "World!", string(body))
+
+	hitsAfter, _ := localCache.Stats()
+	require.EqualValues(t, 2, hitsAfter-hitsBefore)
+
+	// Missing entries are downloaded from the server and stored locally
+	localCache.Remove("key")
+
+	resp, err = http.Get(httpCacheURL + "key")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, cacheValue, body)
+
+	file, ok := localCache.Open(localcache.Metadata{Key: "key", SizeInBytes: int64(len(cacheValue))})
+	require.True(t, ok)
+	require.NoError(t, file.Close())
+}
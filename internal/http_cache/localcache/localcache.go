@@ -0,0 +1,321 @@
+package localcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dataSuffix     = ".data"
+	metadataSuffix = ".json"
+	tempSuffix     = ".tmp"
+
+	// The temporary files are only removed when they weren't written to for this long,
+	// since the cache directory might be shared with another agent that's still running
+	staleTempFileAge = 24 * time.Hour
+)
+
+// LocalCache is a size-bounded on-disk cache of the HTTP cache entries
+// that allows persistent workers to avoid re-downloading the same entries.
+//
+// The least recently used entries are evicted first, the recency is tracked
+// using the modification time of the entry's files.
+type LocalCache struct {
+	dir      string
+	maxBytes int64
+
+	mtx sync.Mutex
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// Metadata is stored alongside each entry and is used to validate the entry
+// against the server's view of it, so that a stale entry is never served.
+type Metadata struct {
+	Key             string `json:"key"`
+	SizeInBytes     int64  `json:"size_in_bytes"`
+	CreatedByTaskID int64  `json:"created_by_task_id"`
+}
+
+func New(dir string, maxBytes int64) (*LocalCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create local cache directory %s: %w", dir, err)
+	}
+
+	localCache := &LocalCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+
+	// Clean up after the previous agent runs that were interrupted
+	tempFiles, err := filepath.Glob(filepath.Join(dir, "*"+tempSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, tempFile := range tempFiles {
+		info, err := os.Stat(tempFile)
+		if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+			continue
+		}
+
+		_ = os.Remove(tempFile)
+	}
+
+	localCache.mtx.Lock()
+	defer localCache.mtx.Unlock()
+
+	if err := localCache.evict(); err != nil {
+		return nil, err
+	}
+
+	return localCache, nil
+}
+
+func (localCache *LocalCache) Dir() string {
+	return localCache.dir
+}
+
+// Open returns the entry if it's present locally and matches the expected metadata,
+// the mismatching entries are removed. Each call is accounted as either a hit or a miss.
+func (localCache *LocalCache) Open(expected Metadata) (*os.File, bool) {
+	localCache.mtx.Lock()
+	defer localCache.mtx.Unlock()
+
+	dataPath, metadataPath := localCache.paths(expected.Key)
+
+	metadataBytes, err := os.ReadFile(metadataPath)
+	if err != nil {
+		localCache.misses.Add(1)
+
+		return nil, false
+	}
+
+	var actual Metadata
+
+	if err := json.Unmarshal(metadataBytes, &actual); err != nil || actual != expected {
+		localCache.remove(expected.Key)
+		localCache.misses.Add(1)
+
+		return nil, false
+	}
+
+	file, err := os.Open(dataPath)
+	if err != nil {
+		localCache.remove(expected.Key)
+		localCache.misses.Add(1)
+
+		return nil, false
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.Size() != expected.SizeInBytes {
+		_ = file.Close()
+		localCache.remove(expected.Key)
+		localCache.misses.Add(1)
+
+		return nil, false
+	}
+
+	// Mark the entry as recently used
+	now := time.Now()
+	_ = os.Chtimes(dataPath, now, now)
+
+	localCache.hits.Add(1)
+
+	return file, true
+}
+
+// Create starts writing a new entry, which only becomes visible after Commit().
+func (localCache *LocalCache) Create(key string) (*Entry, error) {
+	file, err := os.CreateTemp(localCache.dir, "*"+tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Entry{
+		localCache: localCache,
+		key:        key,
+		file:       file,
+	}, nil
+}
+
+func (localCache *LocalCache) Remove(key string) {
+	localCache.mtx.Lock()
+	defer localCache.mtx.Unlock()
+
+	localCache.remove(key)
+}
+
+// Stats returns the number of hits and misses so far.
+func (localCache *LocalCache) Stats() (int64, int64) {
+	return localCache.hits.Load(), localCache.misses.Load()
+}
+
+func (localCache *LocalCache) paths(key string) (string, string) {
+	keyHash := sha256.Sum256([]byte(key))
+	basePath := filepath.Join(localCache.dir, hex.EncodeToString(keyHash[:]))
+
+	return basePath + dataSuffix, basePath + metadataSuffix
+}
+
+func (localCache *LocalCache) remove(key string) {
+	dataPath, metadataPath := localCache.paths(key)
+
+	_ = os.Remove(metadataPath)
+	_ = os.Remove(dataPath)
+}
+
+// evict removes the least recently used entries until the cache fits into maxBytes.
+func (localCache *LocalCache) evict() error {
+	dataPaths, err := filepath.Glob(filepath.Join(localCache.dir, "*"+dataSuffix))
+	if err != nil {
+		return err
+	}
+
+	type entryInfo struct {
+		dataPath string
+		size     int64
+		usedAt   time.Time
+	}
+
+	var entries []entryInfo
+	var totalBytes int64
+
+	for _, dataPath := range dataPaths {
+		info, err := os.Stat(dataPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		entries = append(entries, entryInfo{
+			dataPath: dataPath,
+			size:     info.Size(),
+			usedAt:   info.ModTime(),
+		})
+		totalBytes += info.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].usedAt.Before(entries[j].usedAt)
+	})
+
+	for _, entry := range entries {
+		if totalBytes <= localCache.maxBytes {
+			break
+		}
+
+		_ = os.Remove(strings.TrimSuffix(entry.dataPath, dataSuffix) + metadataSuffix)
+		if err := os.Remove(entry.dataPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		totalBytes -= entry.size
+	}
+
+	return nil
+}
+
+// Entry is a local cache entry that is being written.
+//
+// Write errors are not propagated to the caller, since the local cache
+// is merely an optimization, instead, such entry is never committed.
+type Entry struct {
+	localCache *LocalCache
+	key        string
+	file       *os.File
+	written    int64
+	err        error
+}
+
+func (entry *Entry) Write(p []byte) (int, error) {
+	if entry.err != nil {
+		return len(p), nil
+	}
+
+	n, err := entry.file.Write(p)
+	entry.written += int64(n)
+	if err != nil {
+		entry.err = err
+	}
+
+	return len(p), nil
+}
+
+// Commit makes the entry visible to Open() and evicts
+// the least recently used entries if necessary.
+func (entry *Entry) Commit(createdByTaskID int64) error {
+	if entry.err != nil {
+		entry.Discard()
+
+		return entry.err
+	}
+
+	if entry.written > entry.localCache.maxBytes {
+		entry.Discard()
+
+		return fmt.Errorf("entry size of %d bytes exceeds the local cache size of %d bytes",
+			entry.written, entry.localCache.maxBytes)
+	}
+
+	if err := entry.file.Close(); err != nil {
+		_ = os.Remove(entry.file.Name())
+
+		return err
+	}
+
+	metadataBytes, err := json.Marshal(&Metadata{
+		Key:             entry.key,
+		SizeInBytes:     entry.written,
+		CreatedByTaskID: createdByTaskID,
+	})
+	if err != nil {
+		_ = os.Remove(entry.file.Name())
+
+		return err
+	}
+
+	localCache := entry.localCache
+
+	localCache.mtx.Lock()
+	defer localCache.mtx.Unlock()
+
+	dataPath, metadataPath := localCache.paths(entry.key)
+
+	// Remove the old metadata first, so that it won't be matched against the new data
+	_ = os.Remove(metadataPath)
+
+	if err := os.Rename(entry.file.Name(), dataPath); err != nil {
+		_ = os.Remove(entry.file.Name())
+
+		return err
+	}
+
+	if err := os.WriteFile(metadataPath, metadataBytes, 0600); err != nil {
+		_ = os.Remove(dataPath)
+
+		return err
+	}
+
+	return localCache.evict()
+}
+
+// Discard removes the entry that is being written.
+func (entry *Entry) Discard() {
+	_ = entry.file.Close()
+	_ = os.Remove(entry.file.Name())
+}
@@ -0,0 +1,113 @@
+package localcache_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/http_cache/localcache"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func put(t *testing.T, localCache *localcache.LocalCache, key string, value string) {
+	t.Helper()
+
+	entry, err := localCache.Create(key)
+	require.NoError(t, err)
+	_, err = entry.Write([]byte(value))
+	require.NoError(t, err)
+	require.NoError(t, entry.Commit(42))
+}
+
+func metadata(key string, value string) localcache.Metadata {
+	return localcache.Metadata{Key: key, SizeInBytes: int64(len(value)), CreatedByTaskID: 42}
+}
+
+func TestOpen(t *testing.T) {
+	localCache, err := localcache.New(t.TempDir(), 1024)
+	require.NoError(t, err)
+
+	_, ok := localCache.Open(metadata("key", "value"))
+	require.False(t, ok)
+
+	put(t, localCache, "key", "value")
+
+	file, ok := localCache.Open(metadata("key", "value"))
+	require.True(t, ok)
+	contents, err := io.ReadAll(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, "value", string(contents))
+
+	// An entry that doesn't match the server's view is removed
+	_, ok = localCache.Open(localcache.Metadata{Key: "key", SizeInBytes: 5, CreatedByTaskID: 43})
+	require.False(t, ok)
+	_, ok = localCache.Open(metadata("key", "value"))
+	require.False(t, ok)
+
+	hits, misses := localCache.Stats()
+	require.EqualValues(t, 1, hits)
+	require.EqualValues(t, 3, misses)
+}
+
+func TestEviction(t *testing.T) {
+	localCache, err := localcache.New(t.TempDir(), 10)
+	require.NoError(t, err)
+
+	put(t, localCache, "first", "1234")
+	time.Sleep(10 * time.Millisecond)
+	put(t, localCache, "second", "1234")
+	time.Sleep(10 * time.Millisecond)
+
+	// Use the first entry, so that the second one becomes the least recently used
+	file, ok := localCache.Open(metadata("first", "1234"))
+	require.True(t, ok)
+	require.NoError(t, file.Close())
+
+	put(t, localCache, "third", "1234")
+
+	_, ok = localCache.Open(metadata("second", "1234"))
+	require.False(t, ok)
+
+	for _, key := range []string{"first", "third"} {
+		file, ok := localCache.Open(metadata(key, "1234"))
+		require.True(t, ok, key)
+		require.NoError(t, file.Close())
+	}
+
+	// Entries larger than the whole cache are not stored
+	entry, err := localCache.Create("huge")
+	require.NoError(t, err)
+	_, err = entry.Write([]byte("12345678901"))
+	require.NoError(t, err)
+	require.Error(t, entry.Commit(42))
+}
+
+func TestStaleTempFilesCleanup(t *testing.T) {
+	dir := t.TempDir()
+
+	// An entry that's being written by another agent sharing the directory
+	otherLocalCache, err := localcache.New(dir, 1024)
+	require.NoError(t, err)
+	entry, err := otherLocalCache.Create("key")
+	require.NoError(t, err)
+	_, err = entry.Write([]byte("value"))
+	require.NoError(t, err)
+
+	// A leftover of an agent that was interrupted a long time ago
+	stalePath := filepath.Join(dir, "stale.tmp")
+	require.NoError(t, os.WriteFile(stalePath, []byte("stale"), 0600))
+	staleTime := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(stalePath, staleTime, staleTime))
+
+	localCache, err := localcache.New(dir, 1024)
+	require.NoError(t, err)
+
+	require.NoFileExists(t, stalePath)
+
+	require.NoError(t, entry.Commit(42))
+	file, ok := localCache.Open(metadata("key", "value"))
+	require.True(t, ok)
+	require.NoError(t, file.Close())
+}
@@ -0,0 +1,27 @@
+package http_cache
+
+import "net/http"
+
+var readOnly bool
+
+// WithReadOnly makes the HTTP cache (including the GitHub Actions cache API)
+// refuse all the requests that modify the cache entries, which prevents
+// the untrusted tasks from poisoning the caches of the trusted ones.
+func WithReadOnly() Option {
+	return func() {
+		readOnly = true
+	}
+}
+
+func readOnlyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			logger.Warnf("Refusing %s request to %s since the HTTP cache is read-only", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -6,7 +6,6 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"io"
-	"log"
 	"net/http"
 )
 
@@ -16,7 +15,7 @@ func downloadCacheViaRPC(w http.ResponseWriter, r *http.Request, cacheKey string
 		CacheKey:           cacheKey,
 	})
 	if err != nil {
-		log.Printf("%s cache download initialization (RPC fallback) failed: %v\n", cacheKey, err)
+		logger.Warnf("%s cache download initialization (RPC fallback) failed: %v", cacheKey, err)
 
 		if status.Code(err) == codes.NotFound {
 			w.WriteHeader(http.StatusNotFound)
@@ -31,9 +30,9 @@ func downloadCacheViaRPC(w http.ResponseWriter, r *http.Request, cacheKey string
 		chunk, err := cacheStream.Recv()
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("%s cache download (RPC fallback) finished...\n", cacheKey)
+				logger.Infof("%s cache download (RPC fallback) finished...", cacheKey)
 			} else {
-				log.Printf("%s cache download (RPC fallback) failed: %v\n", cacheKey, err)
+				logger.Warnf("%s cache download (RPC fallback) failed: %v", cacheKey, err)
 
 				if status.Code(err) == codes.NotFound {
 					w.WriteHeader(http.StatusNotFound)
@@ -46,8 +45,8 @@ func downloadCacheViaRPC(w http.ResponseWriter, r *http.Request, cacheKey string
 		}
 
 		if chunk.RedirectUrl != "" {
-			log.Printf("%s cache download (RPC fallback) requested a redirect\n", cacheKey)
-			proxyDownloadFromURLs(w, []string{chunk.RedirectUrl})
+			logger.Infof("%s cache download (RPC fallback) requested a redirect", cacheKey)
+			proxyDownloadFromURLs(w, r, []string{chunk.RedirectUrl})
 
 			return
 		}
@@ -57,7 +56,7 @@ func downloadCacheViaRPC(w http.ResponseWriter, r *http.Request, cacheKey string
 		}
 
 		if _, err := w.Write(chunk.Data); err != nil {
-			log.Printf("%s cache download (RPC fallback) failed: %v\n", cacheKey, err)
+			logger.Warnf("%s cache download (RPC fallback) failed: %v", cacheKey, err)
 			w.WriteHeader(http.StatusInternalServerError)
 
 			return
@@ -68,7 +67,7 @@ func downloadCacheViaRPC(w http.ResponseWriter, r *http.Request, cacheKey string
 func uploadCacheEntryViaRPC(w http.ResponseWriter, r *http.Request, cacheKey string) {
 	uploadCacheClient, err := client.CirrusClient.UploadCache(r.Context())
 	if err != nil {
-		log.Printf("%s cache upload initialization (RPC fallback) failed: %v\n", cacheKey, err)
+		logger.Warnf("%s cache upload initialization (RPC fallback) failed: %v", cacheKey, err)
 		w.WriteHeader(http.StatusInternalServerError)
 
 		return
@@ -82,7 +81,7 @@ func uploadCacheEntryViaRPC(w http.ResponseWriter, r *http.Request, cacheKey str
 			},
 		},
 	}); err != nil {
-		log.Printf("%s cache upload (RPC fallback) failed: %v\n", cacheKey, err)
+		logger.Warnf("%s cache upload (RPC fallback) failed: %v", cacheKey, err)
 		w.WriteHeader(http.StatusInternalServerError)
 
 		return
@@ -101,7 +100,7 @@ func uploadCacheEntryViaRPC(w http.ResponseWriter, r *http.Request, cacheKey str
 				},
 			})
 			if err != nil {
-				log.Printf("%s cache upload (RPC fallback) failed: %v\n", cacheKey, err)
+				logger.Warnf("%s cache upload (RPC fallback) failed: %v", cacheKey, err)
 				w.WriteHeader(http.StatusInternalServerError)
 
 				_, _ = uploadCacheClient.CloseAndRecv()
@@ -110,12 +109,12 @@ func uploadCacheEntryViaRPC(w http.ResponseWriter, r *http.Request, cacheKey str
 			}
 		}
 		if err == io.EOF {
-			log.Printf("%s cache upload (RPC fallback) finished...\n", cacheKey)
+			logger.Infof("%s cache upload (RPC fallback) finished...", cacheKey)
 
 			break
 		}
 		if err != nil {
-			log.Printf("%s cache upload (RPC fallback) failed: %v\n", cacheKey, err)
+			logger.Warnf("%s cache upload (RPC fallback) failed: %v", cacheKey, err)
 			w.WriteHeader(http.StatusBadRequest)
 
 			_, _ = uploadCacheClient.CloseAndRecv()
@@ -125,7 +124,7 @@ func uploadCacheEntryViaRPC(w http.ResponseWriter, r *http.Request, cacheKey str
 	}
 
 	if _, err := uploadCacheClient.CloseAndRecv(); err != nil {
-		log.Printf("%s cache upload (RPC fallback) failed: %v\n", cacheKey, err)
+		logger.Warnf("%s cache upload (RPC fallback) failed: %v", cacheKey, err)
 		w.WriteHeader(http.StatusInternalServerError)
 	} else {
 		w.WriteHeader(http.StatusCreated)
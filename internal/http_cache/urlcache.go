@@ -0,0 +1,70 @@
+package http_cache
+
+import (
+	"sync"
+	"time"
+)
+
+// urlCache remembers the generated download URLs for a short period of time.
+type urlCache struct {
+	ttl     time.Duration
+	mtx     sync.Mutex
+	entries map[string]urlCacheEntry
+}
+
+type urlCacheEntry struct {
+	urls      []string
+	expiresAt time.Time
+}
+
+func newURLCache(ttl time.Duration) *urlCache {
+	return &urlCache{
+		ttl:     ttl,
+		entries: map[string]urlCacheEntry{},
+	}
+}
+
+func (cache *urlCache) Load(cacheKey string) ([]string, bool) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	entry, ok := cache.entries[cacheKey]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(cache.entries, cacheKey)
+
+		return nil, false
+	}
+
+	return entry.urls, true
+}
+
+func (cache *urlCache) Store(cacheKey string, urls []string) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	now := time.Now()
+
+	// Opportunistically forget about the expired entries
+	for key, entry := range cache.entries {
+		if now.After(entry.expiresAt) {
+			delete(cache.entries, key)
+		}
+	}
+
+	cache.entries[cacheKey] = urlCacheEntry{
+		urls:      urls,
+		expiresAt: now.Add(cache.ttl),
+	}
+}
+
+// Delete forgets the download URLs of an entry that was overwritten or deleted.
+func (cache *urlCache) Delete(cacheKey string) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	delete(cache.entries, cacheKey)
+}
@@ -0,0 +1,30 @@
+package http_cache
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestURLCache(t *testing.T) {
+	cache := newURLCache(time.Minute)
+
+	cache.Store("key", []string{"https://example.com/key"})
+
+	urls, ok := cache.Load("key")
+	require.True(t, ok)
+	require.Equal(t, []string{"https://example.com/key"}, urls)
+
+	// Overwritten and deleted entries are forgotten
+	cache.Delete("key")
+
+	_, ok = cache.Load("key")
+	require.False(t, ok)
+
+	// Expired entries are forgotten too
+	cache = newURLCache(-time.Second)
+	cache.Store("key", []string{"https://example.com/key"})
+
+	_, ok = cache.Load("key")
+	require.False(t, ok)
+}
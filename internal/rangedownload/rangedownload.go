@@ -0,0 +1,282 @@
+package rangedownload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultConcurrency = 4
+	DefaultPartSize    = 8 * 1024 * 1024
+
+	maxPartAttempts = 3
+)
+
+// StatusError is returned when the server responds with a non-successful status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status: %s", err.Status)
+}
+
+// Open issues a GET request and returns a reader for the response body.
+//
+// When concurrency is greater than one, the first request asks for the first
+// part of the object using the Range header. If the server honors it, the rest
+// of the parts are fetched concurrently using their own Range requests (with
+// at most concurrency parts buffered in memory) and stitched together in order.
+// Otherwise, the response body is returned as is, i.e. we gracefully fall back
+// to a single-stream download.
+func Open(
+	ctx context.Context,
+	client *http.Client,
+	url string,
+	concurrency int,
+	partSize int64,
+) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	if concurrency > 1 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", partSize-1))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		total, err := totalSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			_ = resp.Body.Close()
+			cancel()
+
+			return nil, err
+		}
+
+		return newParallelReader(ctx, cancel, client, url, resp.Body, total, concurrency, partSize), nil
+	case http.StatusOK:
+		return &cancelingReadCloser{ReadCloser: resp.Body, cancel: cancel}, nil
+	default:
+		_ = resp.Body.Close()
+		cancel()
+
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+}
+
+// totalSize extracts the complete length from the "bytes 0-1023/4096" Content-Range header value.
+func totalSize(contentRange string) (int64, error) {
+	_, total, found := strings.Cut(contentRange, "/")
+	if !found || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, fmt.Errorf("unsupported Content-Range header value: %q", contentRange)
+	}
+
+	result, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported Content-Range header value: %q", contentRange)
+	}
+
+	return result, nil
+}
+
+type cancelingReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (crc *cancelingReadCloser) Close() error {
+	defer crc.cancel()
+
+	return crc.ReadCloser.Close()
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+type parallelReader struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	client      *http.Client
+	url         string
+	total       int64
+	concurrency int
+	partSize    int64
+
+	parts     []chan partResult
+	scheduled int
+	consumed  int
+	current   *bytes.Reader
+	err       error
+
+	wg sync.WaitGroup
+}
+
+func newParallelReader(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	client *http.Client,
+	url string,
+	firstPart io.ReadCloser,
+	total int64,
+	concurrency int,
+	partSize int64,
+) *parallelReader {
+	numParts := (total + partSize - 1) / partSize
+
+	reader := &parallelReader{
+		ctx:         ctx,
+		cancel:      cancel,
+		client:      client,
+		url:         url,
+		total:       total,
+		concurrency: concurrency,
+		partSize:    partSize,
+		parts:       make([]chan partResult, numParts),
+	}
+
+	for i := range reader.parts {
+		reader.parts[i] = make(chan partResult, 1)
+	}
+
+	if numParts == 0 {
+		_ = firstPart.Close()
+
+		return reader
+	}
+
+	// The first part is already being received as a part of the initial request
+	reader.wg.Add(1)
+	go func() {
+		defer reader.wg.Done()
+		defer firstPart.Close()
+
+		data, err := io.ReadAll(firstPart)
+		if err == nil && int64(len(data)) != reader.partLength(0) {
+			err = fmt.Errorf("received %d bytes for the first part, expected %d", len(data), reader.partLength(0))
+		}
+		reader.parts[0] <- partResult{data: data, err: err}
+	}()
+	reader.scheduled = 1
+
+	for reader.scheduled < len(reader.parts) && reader.scheduled < concurrency {
+		reader.schedule()
+	}
+
+	return reader
+}
+
+func (reader *parallelReader) Read(p []byte) (int, error) {
+	for {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+
+		if reader.current != nil && reader.current.Len() != 0 {
+			return reader.current.Read(p)
+		}
+
+		if reader.consumed == len(reader.parts) {
+			return 0, io.EOF
+		}
+
+		result := <-reader.parts[reader.consumed]
+		if result.err != nil {
+			reader.err = result.err
+
+			continue
+		}
+
+		reader.current = bytes.NewReader(result.data)
+		reader.consumed++
+
+		// A part was freed, fetch the next one
+		if reader.scheduled < len(reader.parts) {
+			reader.schedule()
+		}
+	}
+}
+
+func (reader *parallelReader) Close() error {
+	reader.cancel()
+	reader.wg.Wait()
+
+	return nil
+}
+
+func (reader *parallelReader) schedule() {
+	idx := reader.scheduled
+	reader.scheduled++
+
+	reader.wg.Add(1)
+	go func() {
+		defer reader.wg.Done()
+
+		var result partResult
+
+		for attempt := 0; attempt < maxPartAttempts; attempt++ {
+			result.data, result.err = reader.fetchPart(idx)
+			if result.err == nil || errors.Is(reader.ctx.Err(), context.Canceled) {
+				break
+			}
+		}
+
+		reader.parts[idx] <- result
+	}()
+}
+
+func (reader *parallelReader) fetchPart(idx int) ([]byte, error) {
+	start := int64(idx) * reader.partSize
+	length := reader.partLength(idx)
+
+	req, err := http.NewRequestWithContext(reader.ctx, http.MethodGet, reader.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+
+	resp, err := reader.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("failed to read part %d: %w", idx, err)
+	}
+
+	return data, nil
+}
+
+func (reader *parallelReader) partLength(idx int) int64 {
+	start := int64(idx) * reader.partSize
+
+	return min(reader.partSize, reader.total-start)
+}
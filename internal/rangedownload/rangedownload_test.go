@@ -0,0 +1,73 @@
+package rangedownload_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/rangedownload"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	contents := make([]byte, 10*1024+1)
+	_, err := rand.Read(contents)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Name             string
+		SupportsRanges   bool
+		Concurrency      int
+		ExpectedRequests int64
+	}{
+		{"ranges", true, 4, 11},
+		{"ranges without concurrency", true, 1, 1},
+		{"no ranges", false, 4, 1},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			var requests atomic.Int64
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+
+				if testCase.SupportsRanges {
+					http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+				} else {
+					_, _ = w.Write(contents)
+				}
+			}))
+			defer server.Close()
+
+			body, err := rangedownload.Open(context.Background(), http.DefaultClient, server.URL,
+				testCase.Concurrency, 1024)
+			require.NoError(t, err)
+
+			actual, err := io.ReadAll(body)
+			require.NoError(t, err)
+			require.NoError(t, body.Close())
+
+			require.Equal(t, contents, actual)
+			require.Equal(t, testCase.ExpectedRequests, requests.Load())
+		})
+	}
+}
+
+func TestOpenNotFound(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := rangedownload.Open(context.Background(), http.DefaultClient, server.URL, 4, 1024)
+
+	var statusErr *rangedownload.StatusError
+	require.ErrorAs(t, err, &statusErr)
+	require.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+}
@@ -0,0 +1,108 @@
+package steplogs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// markerName is the file that marks the directories created by the agent,
+// only these directories are removed once expired, so that pointing the agent
+// at a directory with other contents (e.g. $HOME) won't result in a data loss.
+const markerName = ".cirrus-step-logs"
+
+// StepLogs stores each step's output in a separate file under
+// the "<base directory>/<task ID>/<command name>.log" path,
+// allowing operators of persistent workers to inspect recent
+// task logs locally.
+type StepLogs struct {
+	taskDir string
+}
+
+// New creates a task-specific directory in baseDir and removes
+// other tasks' directories that are older than retention
+// (zero retention disables the removal). Only the directories
+// created by the agent are ever removed.
+func New(baseDir string, taskID string, retention time.Duration) (*StepLogs, error) {
+	taskDir := filepath.Join(baseDir, sanitize(taskID))
+
+	if err := os.MkdirAll(taskDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create step logs directory %s: %w", taskDir, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(taskDir, markerName), nil, 0600); err != nil {
+		return nil, fmt.Errorf("failed to mark step logs directory %s: %w", taskDir, err)
+	}
+
+	if retention != 0 {
+		if err := prune(baseDir, taskDir, time.Now().Add(-retention)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &StepLogs{
+		taskDir: taskDir,
+	}, nil
+}
+
+func (stepLogs *StepLogs) Dir() string {
+	return stepLogs.taskDir
+}
+
+// Create creates (or truncates) the log file for the specified command.
+func (stepLogs *StepLogs) Create(commandName string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(stepLogs.taskDir, sanitize(commandName)+".log"),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+}
+
+func prune(baseDir string, taskDir string, olderThan time.Time) error {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return fmt.Errorf("failed to list step logs directory %s: %w", baseDir, err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(baseDir, entry.Name())
+
+		if !entry.IsDir() || path == taskDir {
+			continue
+		}
+
+		if _, err := os.Lstat(filepath.Join(path, markerName)); err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		if info.ModTime().Before(olderThan) {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("failed to remove expired step logs directory %s: %w", path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// sanitize makes sure that the name can be safely used as a single path component.
+func sanitize(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', 0:
+			return '_'
+		default:
+			return r
+		}
+	}, name)
+
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+
+	return name
+}
@@ -0,0 +1,55 @@
+package steplogs_test
+
+import (
+	"github.com/cirruslabs/cirrus-ci-agent/internal/steplogs"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	baseDir := t.TempDir()
+
+	stepLogs, err := steplogs.New(baseDir, "42", 0)
+	require.NoError(t, err)
+
+	file, err := stepLogs.Create("build/../main")
+	require.NoError(t, err)
+	_, err = file.WriteString("Hello, World!\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	contents, err := os.ReadFile(filepath.Join(baseDir, "42", "build_.._main.log"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello, World!\n", string(contents))
+}
+
+func TestRetention(t *testing.T) {
+	baseDir := t.TempDir()
+
+	expiredAt := time.Now().Add(-48 * time.Hour)
+
+	_, err := steplogs.New(baseDir, "1", 0)
+	require.NoError(t, err)
+	expiredTaskDir := filepath.Join(baseDir, "1")
+	require.NoError(t, os.Chtimes(expiredTaskDir, expiredAt, expiredAt))
+
+	_, err = steplogs.New(baseDir, "2", 0)
+	require.NoError(t, err)
+	recentTaskDir := filepath.Join(baseDir, "2")
+
+	// Directories that weren't created by the agent are left intact
+	foreignDir := filepath.Join(baseDir, "Documents")
+	require.NoError(t, os.Mkdir(foreignDir, 0700))
+	require.NoError(t, os.Chtimes(foreignDir, expiredAt, expiredAt))
+
+	_, err = steplogs.New(baseDir, "3", 24*time.Hour)
+	require.NoError(t, err)
+
+	require.NoDirExists(t, expiredTaskDir)
+	require.DirExists(t, recentTaskDir)
+	require.DirExists(t, foreignDir)
+	require.DirExists(t, filepath.Join(baseDir, "3"))
+}
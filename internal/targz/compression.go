@@ -0,0 +1,194 @@
+package targz
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/excluder"
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"io"
+	"os"
+	"runtime"
+)
+
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var ErrUnknownCompression = errors.New("unknown archive compression")
+
+func ParseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case CompressionGzip, CompressionZstd:
+		return Compression(s), nil
+	default:
+		return "", fmt.Errorf("%w: %q, supported compressions are %q and %q",
+			ErrUnknownCompression, s, CompressionGzip, CompressionZstd)
+	}
+}
+
+type Option func(archiver *archiver)
+
+// WithCompression selects the compression algorithm used by Archive(), defaults to gzip.
+func WithCompression(compression Compression) Option {
+	return func(archiver *archiver) {
+		archiver.compression = compression
+	}
+}
+
+// WithLevel sets the compression level, which is interpreted according to the
+// selected compression algorithm (e.g. 1-9 for gzip and 1-22 for zstd),
+// zero means the algorithm's default level.
+func WithLevel(level int) Option {
+	return func(archiver *archiver) {
+		archiver.level = level
+	}
+}
+
+// WithConcurrency sets the number of goroutines used for compression, defaults to GOMAXPROCS.
+func WithConcurrency(concurrency int) Option {
+	return func(archiver *archiver) {
+		archiver.concurrency = concurrency
+	}
+}
+
+// WithExcluder skips the files and directories excluded by the excluder.
+func WithExcluder(excluder *excluder.Excluder) Option {
+	return func(archiver *archiver) {
+		archiver.excluder = excluder
+	}
+}
+
+// WithXattrs stores the extended attributes of the files when archiving
+// and restores them when unarchiving, only supported on Linux.
+func WithXattrs() Option {
+	return func(archiver *archiver) {
+		archiver.xattrs = true
+	}
+}
+
+// WithOwnership restores the numeric owner and group of the files when unarchiving,
+// which only has effect when running as root.
+func WithOwnership() Option {
+	return func(archiver *archiver) {
+		archiver.ownership = true
+	}
+}
+
+type archiver struct {
+	compression Compression
+	level       int
+	concurrency int
+	excluder    *excluder.Excluder
+	xattrs      bool
+	ownership   bool
+}
+
+func newArchiver(opts ...Option) *archiver {
+	archiver := &archiver{
+		compression: CompressionGzip,
+		concurrency: runtime.GOMAXPROCS(0),
+	}
+
+	for _, opt := range opts {
+		opt(archiver)
+	}
+
+	return archiver
+}
+
+func (archiver *archiver) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch archiver.compression {
+	case CompressionGzip:
+		level := gzip.DefaultCompression
+		if archiver.level != 0 {
+			level = archiver.level
+		}
+
+		gzipWriter, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := gzipWriter.SetConcurrency(DEFAULT_BUFFER_SIZE, max(archiver.concurrency, 1)); err != nil {
+			return nil, err
+		}
+
+		return gzipWriter, nil
+	case CompressionZstd:
+		zstdOpts := []zstd.EOption{
+			zstd.WithEncoderConcurrency(max(archiver.concurrency, 1)),
+		}
+
+		if archiver.level != 0 {
+			zstdOpts = append(zstdOpts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(archiver.level)))
+		}
+
+		return zstd.NewWriter(w, zstdOpts...)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCompression, archiver.compression)
+	}
+}
+
+// Detect determines the compression of an archive by looking at its magic bytes.
+func Detect(path string) (Compression, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return DetectFrom(bufio.NewReader(file))
+}
+
+// DetectFrom determines the compression of an archive by peeking at its magic bytes,
+// the reader can be subsequently passed to UnarchiveFrom() without losing any data.
+func DetectFrom(reader *bufio.Reader) (Compression, error) {
+	magic, err := reader.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressionZstd, nil
+	default:
+		return "", ErrUnknownCompression
+	}
+}
+
+func decompressor(reader *bufio.Reader) (io.ReadCloser, error) {
+	compression, err := DetectFrom(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case CompressionZstd:
+		zstdReader, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new zstd reader: %v", err)
+		}
+
+		return zstdReader.IOReadCloser(), nil
+	default:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create new gzip reader: %v", err)
+		}
+
+		return gzipReader, nil
+	}
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package targz
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+// Extended attributes are stored in the PAX records using the same prefix as GNU tar and bsdtar
+const paxXattrPrefix = "SCHILY.xattr."
+
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	namesBuf := make([]byte, size)
+
+	size, err = unix.Llistxattr(path, namesBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+
+	for _, name := range bytes.Split(namesBuf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		value, err := readXattr(path, string(name))
+		if err != nil {
+			// The attribute might've been removed in the meantime
+			if errors.Is(err, unix.ENODATA) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		result[string(name)] = value
+	}
+
+	return result, nil
+}
+
+func readXattr(path string, name string) (string, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return "", err
+	}
+
+	value := make([]byte, size)
+
+	size, err = unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value[:size]), nil
+}
+
+func writeXattr(path string, name string, value string) error {
+	return unix.Lsetxattr(path, name, []byte(value), 0)
+}
+
+func lchtimes(path string, modTime time.Time) error {
+	timestamp := unix.NsecToTimespec(modTime.UnixNano())
+
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{timestamp, timestamp}, unix.AT_SYMLINK_NOFOLLOW)
+}
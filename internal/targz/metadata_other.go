@@ -0,0 +1,20 @@
+//go:build !linux
+
+package targz
+
+import "time"
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeXattr(path string, name string, value string) error {
+	return nil
+}
+
+// lchtimes is a no-op, since the symbolic link times are rarely relied upon
+func lchtimes(path string, modTime time.Time) error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package targz
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Most filesystems allocate space in 4 KiB blocks, so that's
+// the smallest hole that makes sense to create
+const sparseBlockSize = 4096
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// sparseWriter seeks over the block-aligned runs of zeros instead of writing them,
+// which results in a sparse file on the filesystems that support it.
+//
+// The file needs to be truncated to the final size after writing,
+// otherwise the trailing hole won't be accounted in the file's size.
+type sparseWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (writer *sparseWriter) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) != 0 {
+		// Find the run of blocks that are either all zero or all non-zero
+		zero := isZeroBlock(p[:writer.blockLength(len(p), 0)])
+
+		var runLength int
+		for runLength < len(p) {
+			blockLength := writer.blockLength(len(p), runLength)
+			if isZeroBlock(p[runLength:runLength+blockLength]) != zero {
+				break
+			}
+			runLength += blockLength
+		}
+
+		if zero {
+			if _, err := writer.file.Seek(int64(runLength), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else {
+			if _, err := writer.file.Write(p[:runLength]); err != nil {
+				return written, err
+			}
+		}
+
+		writer.offset += int64(runLength)
+		written += runLength
+		p = p[runLength:]
+	}
+
+	return written, nil
+}
+
+// blockLength returns the length of the block starting at the specified position
+// in the buffer that's being written, such that it ends on the block boundary.
+func (writer *sparseWriter) blockLength(bufferLength int, position int) int {
+	offset := writer.offset + int64(position)
+	blockLength := sparseBlockSize - int(offset%sparseBlockSize)
+
+	return min(blockLength, bufferLength-position)
+}
+
+func isZeroBlock(block []byte) bool {
+	return bytes.Equal(block, zeroBlock[:len(block)])
+}
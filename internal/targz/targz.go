@@ -3,53 +3,136 @@ package targz
 import (
 	"archive/tar"
 	"bufio"
+	"errors"
 	"fmt"
-	gzip "github.com/klauspost/pgzip"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const DEFAULT_BUFFER_SIZE = 1024 * 1024
 
-func Archive(baseFolder string, folderPaths []string, dest string) error {
+// ErrUnsafePath is returned when an archive entry would be extracted outside of the destination folder.
+var ErrUnsafePath = errors.New("archive entry resolves outside of the destination folder")
+
+func Archive(baseFolder string, folderPaths []string, dest string, opts ...Option) error {
+	archiver := newArchiver(opts...)
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", dest, err)
+	}
+	defer out.Close()
+
+	compressedWriter, err := archiver.compressor(out)
+	if err != nil {
+		return fmt.Errorf("error creating %s compressor for %s: %v", archiver.compression, dest, err)
+	}
+	defer compressedWriter.Close()
+
+	return writeTar(baseFolder, folderPaths, compressedWriter, archiver)
+}
+
+// Compress compresses an uncompressed tar archive read from the reader,
+// which allows to snapshot the files quickly and compress them later.
+func Compress(reader io.Reader, dest string, opts ...Option) error {
+	archiver := newArchiver(opts...)
+
 	out, err := os.Create(dest)
 	if err != nil {
 		return fmt.Errorf("error creating %s: %v", dest, err)
 	}
 	defer out.Close()
 
-	gzipWriter := gzip.NewWriter(out)
-	defer gzipWriter.Close()
+	compressedWriter, err := archiver.compressor(out)
+	if err != nil {
+		return fmt.Errorf("error creating %s compressor for %s: %v", archiver.compression, dest, err)
+	}
+
+	if _, err := io.CopyBuffer(compressedWriter, reader, make([]byte, DEFAULT_BUFFER_SIZE)); err != nil {
+		_ = compressedWriter.Close()
+
+		return fmt.Errorf("error compressing %s: %v", dest, err)
+	}
+
+	if err := compressedWriter.Close(); err != nil {
+		return fmt.Errorf("error compressing %s: %v", dest, err)
+	}
+
+	return out.Close()
+}
+
+// ArchiveUncompressed writes an uncompressed tar archive to the writer,
+// the compression options are ignored.
+func ArchiveUncompressed(baseFolder string, folderPaths []string, w io.Writer, opts ...Option) error {
+	return writeTar(baseFolder, folderPaths, w, newArchiver(opts...))
+}
 
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+func writeTar(baseFolder string, folderPaths []string, w io.Writer, archiver *archiver) error {
+	tarWriter := tar.NewWriter(w)
 
 	buffer := make([]byte, DEFAULT_BUFFER_SIZE)
 
 	for _, folderPath := range folderPaths {
-		if err := archiveSingleFolder(baseFolder, folderPath, tarWriter, buffer); err != nil {
+		if err := archiveSingleFolder(baseFolder, folderPath, tarWriter, buffer, archiver); err != nil {
+			_ = tarWriter.Close()
+
 			return err
 		}
 	}
 
-	return nil
+	return tarWriter.Close()
 }
 
-func archiveSingleFolder(baseFolder string, folderPath string, tarWriter *tar.Writer, buffer []byte) error {
+func archiveSingleFolder(
+	baseFolder string,
+	folderPath string,
+	tarWriter *tar.Writer,
+	buffer []byte,
+	archiver *archiver,
+) error {
 	return filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("error walking folder %s: %v", path, err)
 		}
 
+		if archiver.excluder.Excluded(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
 		header, err := tar.FileInfoHeader(info, path)
 		if err != nil {
 			return fmt.Errorf("error  making header %s: %v", path, err)
 		}
 		header.Name = filepath.ToSlash(strings.TrimPrefix(path, baseFolder))
 
+		// PAX format preserves the sub-second modification times and the long paths,
+		// access and change times are not restored, so there's no point in storing them
+		header.Format = tar.FormatPAX
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+
+		if archiver.xattrs {
+			xattrs, err := readXattrs(path)
+			if err != nil {
+				return fmt.Errorf("%s: reading extended attributes: %v", path, err)
+			}
+
+			for name, value := range xattrs {
+				if header.PAXRecords == nil {
+					header.PAXRecords = map[string]string{}
+				}
+				header.PAXRecords[paxXattrPrefix+name] = value
+			}
+		}
+
 		if header.Typeflag == tar.TypeSymlink {
 			linkDest, _ := os.Readlink(path)
 			if filepath.IsAbs(linkDest) && strings.HasPrefix(linkDest, baseFolder) {
@@ -89,79 +172,357 @@ func archiveSingleFolder(baseFolder string, folderPath string, tarWriter *tar.Wr
 	})
 }
 
-func Unarchive(tarPath string, destFolder string) error {
+func Unarchive(tarPath string, destFolder string, opts ...Option) error {
 	tarFile, err := os.Open(tarPath)
 	if err != nil {
 		return fmt.Errorf("failed to open tar %s: %v", tarPath, err)
 	}
 	defer tarFile.Close()
 
-	gzipReader, err := gzip.NewReader(bufio.NewReaderSize(tarFile, DEFAULT_BUFFER_SIZE))
+	if err := UnarchiveFrom(tarFile, destFolder, opts...); err != nil {
+		return fmt.Errorf("failed to unarchive %s: %w", tarPath, err)
+	}
+
+	return nil
+}
+
+// UnarchiveFrom extracts the archive as it's being read, which allows
+// extracting the archive while it's still being downloaded.
+//
+// The reader is consumed until EOF, so that the checksum of the
+// compressed stream is verified even if there are trailing bytes
+// after the end of the tar archive.
+//
+// Entries that would end up outside of the destination folder, either
+// directly (e.g. "../file") or through the symbolic links that exist in
+// the destination folder or were extracted earlier, result in ErrUnsafePath.
+// Symbolic links themselves are extracted as is, regardless of their target,
+// since they are never followed when extracting the subsequent entries.
+//
+// Modification times and permissions are restored for all entries (for the directories
+// after their contents are extracted), the ownership and the extended attributes
+// are only restored when requested using WithOwnership() and WithXattrs().
+func UnarchiveFrom(reader io.Reader, destFolder string, opts ...Option) error {
+	decompressedReader, err := decompressor(bufio.NewReaderSize(reader, DEFAULT_BUFFER_SIZE))
 	if err != nil {
-		return fmt.Errorf("failed to create new gzip reader %s: %v", tarPath, err)
+		return fmt.Errorf("failed to decompress: %w", err)
 	}
-	defer gzipReader.Close()
+	defer decompressedReader.Close()
 
-	gzipTar := tar.NewReader(gzipReader)
+	return UnarchiveUncompressed(decompressedReader, destFolder, opts...)
+}
 
-	buffer := make([]byte, DEFAULT_BUFFER_SIZE)
+// UnarchiveUncompressed extracts an uncompressed tar archive, see UnarchiveFrom() for the details.
+func UnarchiveUncompressed(reader io.Reader, destFolder string, opts ...Option) error {
+	unarchiver, err := newUnarchiver(destFolder, newArchiver(opts...))
+	if err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(reader)
 
 	for {
-		header, err := gzipTar.Next()
+		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
 
-		if err := untarFile(gzipTar, header, destFolder, buffer); err != nil {
+		if err := unarchiver.untarFile(tarReader, header); err != nil {
 			return err
 		}
 	}
+
+	if err := unarchiver.finalizeDirs(); err != nil {
+		return err
+	}
+
+	_, err = io.CopyBuffer(
+		io.Discard,
+		// Work around pgzip's WriteTo() not supporting partially consumed streams
+		struct{ io.Reader }{reader},
+		unarchiver.buffer,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to read the remainder of the archive: %w", err)
+	}
+
 	return nil
 }
 
-func untarFile(tr *tar.Reader, header *tar.Header, destination string, buffer []byte) error {
+type unarchiver struct {
+	destFolder     string
+	realDestFolder string
+
+	// Directories that are already known to resolve inside of the destination folder
+	safeDirs map[string]struct{}
+
+	// Directories whose metadata is restored after their contents are extracted,
+	// since creating the contents changes the modification time and the directory
+	// permissions may prevent the contents from being created in the first place
+	dirs []extractedDir
+
+	ownership bool
+	xattrs    bool
+
+	buffer []byte
+}
+
+type extractedDir struct {
+	path   string
+	header *tar.Header
+}
+
+func newUnarchiver(destFolder string, archiver *archiver) (*unarchiver, error) {
+	destFolder, err := filepath.Abs(destFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	realDestFolder, err := resolveExisting(destFolder)
+	if err != nil {
+		return nil, fmt.Errorf("%s: resolving destination folder: %v", destFolder, err)
+	}
+
+	return &unarchiver{
+		destFolder:     destFolder,
+		realDestFolder: realDestFolder,
+		safeDirs:       map[string]struct{}{},
+		ownership:      archiver.ownership && os.Geteuid() == 0,
+		xattrs:         archiver.xattrs,
+		buffer:         make([]byte, DEFAULT_BUFFER_SIZE),
+	}, nil
+}
+
+func (unarchiver *unarchiver) untarFile(tr *tar.Reader, header *tar.Header) error {
+	fpath, err := unarchiver.safePath(header.Name)
+	if err != nil {
+		return err
+	}
+
 	switch header.Typeflag {
 	case tar.TypeDir:
-		return mkdir(filepath.Join(destination, filepath.FromSlash(header.Name)))
+		if err := mkdir(fpath); err != nil {
+			return err
+		}
+
+		unarchiver.dirs = append(unarchiver.dirs, extractedDir{path: fpath, header: header})
+
+		return nil
 	case tar.TypeReg, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
-		return writeNewFile(filepath.Join(destination, filepath.FromSlash(header.Name)), tr, header.FileInfo(), buffer)
+		if err := unarchiver.removeSymbolicLink(fpath); err != nil {
+			return err
+		}
+
+		if err := writeNewFile(fpath, tr, header.FileInfo(), unarchiver.buffer); err != nil {
+			return err
+		}
+
+		return unarchiver.restoreMetadata(fpath, header)
 	case tar.TypeSymlink:
-		return writeNewSymbolicLink(filepath.Join(destination, filepath.FromSlash(header.Name)), filepath.FromSlash(header.Linkname))
+		if err := writeNewSymbolicLink(fpath, filepath.FromSlash(header.Linkname)); err != nil {
+			return err
+		}
+
+		return unarchiver.restoreMetadata(fpath, header)
 	case tar.TypeLink:
-		return writeNewHardLink(filepath.Join(destination, filepath.FromSlash(header.Name)), filepath.Join(destination, filepath.FromSlash(header.Linkname)))
+		target, err := unarchiver.safePath(header.Linkname)
+		if err != nil {
+			return err
+		}
+
+		return writeNewHardLink(fpath, target)
 	default:
 		return fmt.Errorf("%s: unknown type flag: %c", header.Name, header.Typeflag)
 	}
 }
 
+// finalizeDirs restores the metadata of the extracted directories, the nested ones first.
+func (unarchiver *unarchiver) finalizeDirs() error {
+	for i := len(unarchiver.dirs) - 1; i >= 0; i-- {
+		dir := unarchiver.dirs[i]
+
+		if err := unarchiver.restoreMetadata(dir.path, dir.header); err != nil {
+			return err
+		}
+	}
+
+	unarchiver.dirs = nil
+
+	return nil
+}
+
+func (unarchiver *unarchiver) restoreMetadata(fpath string, header *tar.Header) error {
+	isSymlink := header.Typeflag == tar.TypeSymlink
+
+	if unarchiver.ownership {
+		if err := os.Lchown(fpath, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("%s: changing ownership: %v", fpath, err)
+		}
+	}
+
+	if unarchiver.xattrs {
+		for key, value := range header.PAXRecords {
+			name, ok := strings.CutPrefix(key, paxXattrPrefix)
+			if !ok {
+				continue
+			}
+
+			if err := writeXattr(fpath, name, value); err != nil {
+				return fmt.Errorf("%s: setting extended attribute %s: %v", fpath, name, err)
+			}
+		}
+	}
+
+	// Regular files already have their permissions set, but changing
+	// the ownership might've reset the setuid and setgid bits
+	if header.Typeflag == tar.TypeDir || (unarchiver.ownership && !isSymlink) {
+		if err := os.Chmod(fpath, header.FileInfo().Mode()); err != nil && runtime.GOOS != "windows" {
+			return fmt.Errorf("%s: changing mode: %v", fpath, err)
+		}
+	}
+
+	if header.ModTime.IsZero() {
+		return nil
+	}
+
+	if isSymlink {
+		if err := lchtimes(fpath, header.ModTime); err != nil {
+			return fmt.Errorf("%s: changing symbolic link times: %v", fpath, err)
+		}
+
+		return nil
+	}
+
+	if err := os.Chtimes(fpath, header.ModTime, header.ModTime); err != nil {
+		return fmt.Errorf("%s: changing times: %v", fpath, err)
+	}
+
+	return nil
+}
+
+// safePath returns the path of the entry inside of the destination folder or ErrUnsafePath
+// if it, or any of its parent directories that already exist, resolves outside of it.
+func (unarchiver *unarchiver) safePath(name string) (string, error) {
+	fpath := filepath.Join(unarchiver.destFolder, filepath.FromSlash(name))
+
+	if !within(unarchiver.destFolder, fpath) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+
+	// The last path component is never followed: directories and symbolic
+	// links are not overwritten and regular files replace the symbolic links
+	dir := filepath.Dir(fpath)
+	if fpath == unarchiver.destFolder {
+		dir = fpath
+	}
+
+	if _, ok := unarchiver.safeDirs[dir]; ok {
+		return fpath, nil
+	}
+
+	realDir, err := resolveExisting(dir)
+	if err != nil {
+		return "", fmt.Errorf("%s: resolving parent directory: %v", name, err)
+	}
+
+	if !within(unarchiver.realDestFolder, realDir) {
+		return "", fmt.Errorf("%w: %s (through a symbolic link to %s)", ErrUnsafePath, name, realDir)
+	}
+
+	// Only remember the directories that exist, since the missing ones
+	// might still be created as symbolic links by the subsequent entries
+	if _, err := os.Lstat(dir); err == nil {
+		unarchiver.safeDirs[dir] = struct{}{}
+	}
+
+	return fpath, nil
+}
+
+// removeSymbolicLink makes sure that a regular file won't be written through a symbolic link.
+func (unarchiver *unarchiver) removeSymbolicLink(fpath string) error {
+	info, err := os.Lstat(fpath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	if err := os.Remove(fpath); err != nil {
+		return fmt.Errorf("%s: removing symbolic link: %v", fpath, err)
+	}
+
+	// The removed link might've been a part of the cached directory paths
+	clear(unarchiver.safeDirs)
+
+	return nil
+}
+
+// resolveExisting evaluates the symbolic links in the longest existing prefix of the path.
+func resolveExisting(path string) (string, error) {
+	var missing []string
+
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return "", err
+			}
+
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+
+		missing = append([]string{filepath.Base(path)}, missing...)
+		path = parent
+	}
+}
+
+func within(base string, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func writeNewFile(fpath string, in io.Reader, fi os.FileInfo, buffer []byte) error {
 	err := os.MkdirAll(filepath.Dir(fpath), 0755)
 	if err != nil {
-		return fmt.Errorf("%s: making directory for file: %v", fpath, err)
+		return fmt.Errorf("%s: making directory for file: %w", fpath, err)
 	}
 
 	out, err := os.Create(fpath)
 	if err != nil {
-		return fmt.Errorf("%s: creating new file: %v", fpath, err)
+		return fmt.Errorf("%s: creating new file: %w", fpath, err)
 	}
 	defer out.Close()
 
 	err = out.Chmod(fi.Mode())
 	if err != nil && runtime.GOOS != "windows" {
-		return fmt.Errorf("%s: changing file mode: %v", fpath, err)
+		return fmt.Errorf("%s: changing file mode: %w", fpath, err)
 	}
 
 	writtenBytes, err := io.CopyBuffer(
-		// Work around https://github.com/golang/go/issues/16474
-		struct{ io.Writer }{out},
+		&sparseWriter{file: out},
 		io.LimitReader(in, fi.Size()),
 		buffer,
 	)
 	if err != nil {
-		return fmt.Errorf("%s: writing file after %d bytes (expected %d): %v", fpath, writtenBytes, fi.Size(), err)
+		return fmt.Errorf("%s: writing file after %d bytes (expected %d): %w", fpath, writtenBytes, fi.Size(), err)
 	}
+
+	// Materialize the trailing hole, if any
+	if err := out.Truncate(writtenBytes); err != nil {
+		return fmt.Errorf("%s: truncating file: %w", fpath, err)
+	}
+
 	return nil
 }
 
@@ -196,7 +557,7 @@ func writeNewHardLink(fpath string, target string) error {
 func mkdir(dirPath string) error {
 	err := os.MkdirAll(dirPath, 0755)
 	if err != nil {
-		return fmt.Errorf("%s: making directory: %v", dirPath, err)
+		return fmt.Errorf("%s: making directory: %w", dirPath, err)
 	}
 	return nil
 }
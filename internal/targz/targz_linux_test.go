@@ -0,0 +1,90 @@
+//go:build linux
+
+package targz_test
+
+import (
+	"archive/tar"
+	"errors"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUnarchiveXattrs(t *testing.T) {
+	folderPath := testutil.TempDir(t)
+	filePath := filepath.Join(folderPath, "file.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("contents"), 0600))
+
+	if err := unix.Lsetxattr(filePath, "user.cirrus", []byte("value"), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			t.Skip("extended attributes are not supported by the filesystem")
+		}
+
+		require.NoError(t, err)
+	}
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.Archive(folderPath, []string{folderPath}, archivePath, targz.WithXattrs()))
+
+	// Extended attributes are not restored unless requested
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, destFolder))
+	_, err := unix.Lgetxattr(filepath.Join(destFolder, "file.txt"), "user.cirrus", nil)
+	require.ErrorIs(t, err, unix.ENODATA)
+
+	destFolder = testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, destFolder, targz.WithXattrs()))
+	value := make([]byte, 64)
+	n, err := unix.Lgetxattr(filepath.Join(destFolder, "file.txt"), "user.cirrus", value)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value[:n]))
+}
+
+func TestUnarchiveOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("restoring ownership requires running as root")
+	}
+
+	folderPath := testutil.TempDir(t)
+	filePath := filepath.Join(folderPath, "file.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("contents"), 0600))
+	require.NoError(t, os.Lchown(filePath, 1234, 5678))
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.Archive(folderPath, []string{folderPath}, archivePath))
+
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, destFolder, targz.WithOwnership()))
+
+	info, err := os.Lstat(filepath.Join(destFolder, "file.txt"))
+	require.NoError(t, err)
+	stat := info.Sys().(*syscall.Stat_t)
+	require.EqualValues(t, 1234, stat.Uid)
+	require.EqualValues(t, 5678, stat.Gid)
+}
+
+func TestUnarchiveSparseAllocation(t *testing.T) {
+	contents := make([]byte, 8*1024*1024)
+	copy(contents[len(contents)/2:], "data")
+
+	archivePath := writeTarGzHelper(t, []PartialTarHeader{
+		{tar.TypeReg, "/sparse.bin", "", contents},
+	})
+
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, destFolder))
+
+	info, err := os.Stat(filepath.Join(destFolder, "sparse.bin"))
+	require.NoError(t, err)
+	require.EqualValues(t, len(contents), info.Size())
+
+	// Only the block containing the data should be allocated,
+	// but leave some leeway for the filesystem's metadata
+	stat := info.Sys().(*syscall.Stat_t)
+	require.Less(t, stat.Blocks*512, int64(len(contents)/2))
+}
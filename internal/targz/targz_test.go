@@ -2,14 +2,20 @@ package targz_test
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"github.com/cirruslabs/cirrus-ci-agent/internal/excluder"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/targz"
 	"github.com/cirruslabs/cirrus-ci-agent/internal/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type PartialTarHeader struct {
@@ -157,3 +163,347 @@ func TestArchiveMultiple(t *testing.T) {
 	}
 	assert.Equal(t, expected, TarGzContentsHelper(t, dest))
 }
+
+func TestCompression(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Options  []targz.Option
+		Expected targz.Compression
+	}{
+		{"default", nil, targz.CompressionGzip},
+		{"gzip with level", []targz.Option{targz.WithLevel(1)}, targz.CompressionGzip},
+		{"zstd", []targz.Option{targz.WithCompression(targz.CompressionZstd)}, targz.CompressionZstd},
+		{"single-threaded zstd with level", []targz.Option{
+			targz.WithCompression(targz.CompressionZstd),
+			targz.WithLevel(19),
+			targz.WithConcurrency(1),
+		}, targz.CompressionZstd},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			folderPath := testutil.TempDir(t)
+			require.NoError(t, os.WriteFile(filepath.Join(folderPath, "file.txt"), []byte("contents"), 0600))
+
+			dest := filepath.Join(testutil.TempDir(t), "archive")
+			require.NoError(t, targz.Archive(folderPath, []string{folderPath}, dest, testCase.Options...))
+
+			compression, err := targz.Detect(dest)
+			require.NoError(t, err)
+			require.Equal(t, testCase.Expected, compression)
+
+			destFolder := testutil.TempDir(t)
+			require.NoError(t, targz.Unarchive(dest, destFolder))
+
+			contents, err := os.ReadFile(filepath.Join(destFolder, "file.txt"))
+			require.NoError(t, err)
+			require.Equal(t, "contents", string(contents))
+		})
+	}
+}
+
+func TestUnknownCompression(t *testing.T) {
+	dest := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, os.WriteFile(dest, []byte("not an archive"), 0600))
+
+	_, err := targz.Detect(dest)
+	require.ErrorIs(t, err, targz.ErrUnknownCompression)
+
+	require.ErrorIs(t, targz.Unarchive(dest, testutil.TempDir(t)), targz.ErrUnknownCompression)
+}
+
+func TestUnarchiveFrom(t *testing.T) {
+	folderPath := testutil.TempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(folderPath, "file.txt"), []byte("contents"), 0600))
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive")
+	require.NoError(t, targz.Archive(folderPath, []string{folderPath}, archivePath,
+		targz.WithCompression(targz.CompressionZstd)))
+
+	archive, err := os.Open(archivePath)
+	require.NoError(t, err)
+	defer archive.Close()
+
+	// Simulate a network stream that returns the data in small pieces
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.UnarchiveFrom(iotest.HalfReader(archive), destFolder))
+
+	contents, err := os.ReadFile(filepath.Join(destFolder, "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "contents", string(contents))
+}
+
+func TestArchiveExcluder(t *testing.T) {
+	baseFolder := testutil.TempDir(t)
+
+	os.WriteFile(filepath.Join(baseFolder, "file.txt"), []byte("contents"), 0600)
+	os.WriteFile(filepath.Join(baseFolder, "yarn.lock"), []byte("lock"), 0600)
+	os.MkdirAll(filepath.Join(baseFolder, "caches", "8.0", "journal-1"), 0700)
+	os.WriteFile(filepath.Join(baseFolder, "caches", "8.0", "journal-1", "file.bin"), []byte("journal"), 0600)
+
+	fileExcluder, err := excluder.New(baseFolder, []string{"*.lock", "caches/*/journal-*"})
+	require.NoError(t, err)
+
+	dest := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.Archive(baseFolder, []string{baseFolder}, dest, targz.WithExcluder(fileExcluder)))
+
+	expected := []PartialTarHeader{
+		{tar.TypeDir, "", "", []byte{}},
+		{tar.TypeDir, "/caches", "", []byte{}},
+		{tar.TypeDir, "/caches/8.0", "", []byte{}},
+		{tar.TypeReg, "/file.txt", "", []byte("contents")},
+	}
+	assert.Equal(t, expected, TarGzContentsHelper(t, dest))
+}
+
+func writeTarGzHelper(t *testing.T, entries []PartialTarHeader) string {
+	path := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+
+	archive, err := os.Create(path)
+	require.NoError(t, err)
+	defer archive.Close()
+
+	gzWriter := gzip.NewWriter(archive)
+	defer gzWriter.Close()
+
+	tarWriter := tar.NewWriter(gzWriter)
+	defer tarWriter.Close()
+
+	for _, entry := range entries {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{
+			Typeflag: entry.Typeflag,
+			Name:     entry.Name,
+			Linkname: entry.Linkname,
+			Mode:     0600,
+			Size:     int64(len(entry.Contents)),
+		}))
+		_, err := tarWriter.Write(entry.Contents)
+		require.NoError(t, err)
+	}
+
+	return path
+}
+
+func TestUnarchiveUnsafePaths(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Prepare func(destFolder string, outsideFolder string)
+		Entries func(outsideFolder string) []PartialTarHeader
+	}{
+		{"parent directory reference", nil, func(outsideFolder string) []PartialTarHeader {
+			return []PartialTarHeader{
+				{tar.TypeReg, "/../outside/file.txt", "", []byte("pwned")},
+			}
+		}},
+		{"write through an absolute symbolic link", nil, func(outsideFolder string) []PartialTarHeader {
+			return []PartialTarHeader{
+				{tar.TypeSymlink, "/link", outsideFolder, []byte{}},
+				{tar.TypeReg, "/link/file.txt", "", []byte("pwned")},
+			}
+		}},
+		{"write through a relative symbolic link", nil, func(outsideFolder string) []PartialTarHeader {
+			return []PartialTarHeader{
+				{tar.TypeDir, "/sub", "", []byte{}},
+				{tar.TypeSymlink, "/sub/link", "../../outside", []byte{}},
+				{tar.TypeReg, "/sub/link/file.txt", "", []byte("pwned")},
+			}
+		}},
+		{"write through a chain of symbolic links", nil, func(outsideFolder string) []PartialTarHeader {
+			return []PartialTarHeader{
+				{tar.TypeSymlink, "/first", "second", []byte{}},
+				{tar.TypeSymlink, "/second", outsideFolder, []byte{}},
+				{tar.TypeDir, "/first/sub", "", []byte{}},
+				{tar.TypeReg, "/first/sub/file.txt", "", []byte("pwned")},
+			}
+		}},
+		{"write through a pre-existing symbolic link", func(destFolder string, outsideFolder string) {
+			require.NoError(t, os.Symlink(outsideFolder, filepath.Join(destFolder, "link")))
+		}, func(outsideFolder string) []PartialTarHeader {
+			return []PartialTarHeader{
+				{tar.TypeReg, "/link/file.txt", "", []byte("pwned")},
+			}
+		}},
+		{"hard link to an outside file", nil, func(outsideFolder string) []PartialTarHeader {
+			return []PartialTarHeader{
+				{tar.TypeLink, "/hard", "../outside/secret.txt", []byte{}},
+			}
+		}},
+		{"hard link through a symbolic link", nil, func(outsideFolder string) []PartialTarHeader {
+			return []PartialTarHeader{
+				{tar.TypeSymlink, "/link", outsideFolder, []byte{}},
+				{tar.TypeLink, "/hard", "/link/secret.txt", []byte{}},
+			}
+		}},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.Name, func(t *testing.T) {
+			baseFolder := testutil.TempDir(t)
+			destFolder := filepath.Join(baseFolder, "dest")
+			outsideFolder := filepath.Join(baseFolder, "outside")
+			require.NoError(t, os.Mkdir(destFolder, 0700))
+			require.NoError(t, os.Mkdir(outsideFolder, 0700))
+			require.NoError(t, os.WriteFile(filepath.Join(outsideFolder, "secret.txt"), []byte("secret"), 0600))
+
+			if testCase.Prepare != nil {
+				testCase.Prepare(destFolder, outsideFolder)
+			}
+
+			archivePath := writeTarGzHelper(t, testCase.Entries(outsideFolder))
+			require.ErrorIs(t, targz.Unarchive(archivePath, destFolder), targz.ErrUnsafePath)
+
+			// Nothing should've been written outside of the destination folder
+			outsideEntries, err := os.ReadDir(outsideFolder)
+			require.NoError(t, err)
+			require.Len(t, outsideEntries, 1)
+			require.Equal(t, "secret.txt", outsideEntries[0].Name())
+			require.NoFileExists(t, filepath.Join(destFolder, "hard"))
+		})
+	}
+}
+
+func TestUnarchiveSafeSymbolicLinks(t *testing.T) {
+	baseFolder := testutil.TempDir(t)
+	destFolder := filepath.Join(baseFolder, "dest")
+	outsideFile := filepath.Join(baseFolder, "secret.txt")
+	require.NoError(t, os.WriteFile(outsideFile, []byte("secret"), 0600))
+
+	archivePath := writeTarGzHelper(t, []PartialTarHeader{
+		// Symbolic links pointing outside are fine as long as nothing is written through them
+		{tar.TypeSymlink, "/outside", "../secret.txt", []byte{}},
+		// ...and so are the absolute ones (e.g. bin/python in a virtualenv)
+		{tar.TypeSymlink, "/absolute", outsideFile, []byte{}},
+		// A regular file replaces the symbolic link instead of following it
+		{tar.TypeSymlink, "/replaced", outsideFile, []byte{}},
+		{tar.TypeReg, "/replaced", "", []byte("replaced")},
+		// Symbolic links pointing inside can be written through
+		{tar.TypeDir, "/real", "", []byte{}},
+		{tar.TypeSymlink, "/alias", "real", []byte{}},
+		{tar.TypeReg, "/alias/file.txt", "", []byte("contents")},
+		{tar.TypeLink, "/hard.txt", "/alias/file.txt", []byte{}},
+	})
+	require.NoError(t, targz.Unarchive(archivePath, destFolder))
+
+	linkTarget, err := os.Readlink(filepath.Join(destFolder, "outside"))
+	require.NoError(t, err)
+	require.Equal(t, "../secret.txt", linkTarget)
+
+	linkTarget, err = os.Readlink(filepath.Join(destFolder, "absolute"))
+	require.NoError(t, err)
+	require.Equal(t, outsideFile, linkTarget)
+
+	secret, err := os.ReadFile(outsideFile)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(secret))
+
+	replaced, err := os.ReadFile(filepath.Join(destFolder, "replaced"))
+	require.NoError(t, err)
+	require.Equal(t, "replaced", string(replaced))
+
+	for _, path := range []string{"real/file.txt", "hard.txt"} {
+		contents, err := os.ReadFile(filepath.Join(destFolder, path))
+		require.NoError(t, err)
+		require.Equal(t, "contents", string(contents))
+	}
+}
+
+func TestUnarchiveRestoresMetadata(t *testing.T) {
+	baseFolder := testutil.TempDir(t)
+
+	longDir := filepath.Join(baseFolder, strings.Repeat("d", 120), strings.Repeat("e", 120))
+	require.NoError(t, os.MkdirAll(longDir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(longDir, "file.txt"), []byte("contents"), 0640))
+	require.NoError(t, os.Mkdir(filepath.Join(baseFolder, "read-only"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(baseFolder, "read-only", "file.txt"), []byte("contents"), 0600))
+	require.NoError(t, os.Chmod(filepath.Join(baseFolder, "read-only"), 0500))
+	t.Cleanup(func() {
+		_ = os.Chmod(filepath.Join(baseFolder, "read-only"), 0700)
+	})
+
+	// Use distinct sub-second times to make sure that they're preserved precisely
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	paths := []string{
+		filepath.Join(longDir, "file.txt"),
+		longDir,
+		filepath.Dir(longDir),
+		filepath.Join(baseFolder, "read-only", "file.txt"),
+		filepath.Join(baseFolder, "read-only"),
+	}
+	for i, path := range paths {
+		pathModTime := modTime.Add(time.Duration(i) * time.Hour)
+		require.NoError(t, os.Chtimes(path, pathModTime, pathModTime))
+	}
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.Archive(baseFolder, []string{baseFolder}, archivePath))
+
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, destFolder))
+	t.Cleanup(func() {
+		_ = os.Chmod(filepath.Join(destFolder, "read-only"), 0700)
+	})
+
+	for i, path := range paths {
+		rel, err := filepath.Rel(baseFolder, path)
+		require.NoError(t, err)
+
+		info, err := os.Stat(filepath.Join(destFolder, rel))
+		require.NoError(t, err)
+		require.True(t, modTime.Add(time.Duration(i)*time.Hour).Equal(info.ModTime()),
+			"%s has unexpected modification time %s", rel, info.ModTime())
+	}
+
+	fileInfo, err := os.Stat(filepath.Join(destFolder, strings.TrimPrefix(longDir, baseFolder), "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm())
+
+	dirInfo, err := os.Stat(filepath.Join(destFolder, "read-only"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0500), dirInfo.Mode().Perm())
+}
+
+func TestUnarchiveSparse(t *testing.T) {
+	contents := bytes.Join([][]byte{
+		make([]byte, 1024*1024),
+		[]byte("data"),
+		make([]byte, 3*4096+17),
+		[]byte("more data"),
+		make([]byte, 1024*1024),
+	}, nil)
+
+	archivePath := writeTarGzHelper(t, []PartialTarHeader{
+		{tar.TypeReg, "/sparse.bin", "", contents},
+	})
+
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, destFolder))
+
+	actual, err := os.ReadFile(filepath.Join(destFolder, "sparse.bin"))
+	require.NoError(t, err)
+	require.Equal(t, contents, actual)
+}
+
+func TestArchiveRoundTripWithOutsideSymbolicLinks(t *testing.T) {
+	baseFolder := testutil.TempDir(t)
+	require.NoError(t, os.Symlink("../../../etc/passwd", filepath.Join(baseFolder, "relative")))
+	require.NoError(t, os.Symlink("/usr/bin/python3", filepath.Join(baseFolder, "absolute")))
+
+	archivePath := filepath.Join(testutil.TempDir(t), "archive.tar.gz")
+	require.NoError(t, targz.Archive(baseFolder, []string{baseFolder}, archivePath))
+
+	destFolder := testutil.TempDir(t)
+	require.NoError(t, targz.Unarchive(archivePath, destFolder))
+
+	for name, expectedTarget := range map[string]string{
+		"relative": "../../../etc/passwd",
+		"absolute": "/usr/bin/python3",
+	} {
+		linkTarget, err := os.Readlink(filepath.Join(destFolder, name))
+		require.NoError(t, err)
+		require.Equal(t, filepath.FromSlash(expectedTarget), linkTarget)
+	}
+}